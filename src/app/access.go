@@ -0,0 +1,571 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"goji.io/pat"
+	"golang.org/x/net/context"
+)
+
+// 部屋の公開範囲と描ける人。設定の無い部屋は public で誰でも描ける。
+//
+//	public:   一覧に出て、誰でも見られる
+//	unlisted: 一覧に出ないが、ID を知っていれば誰でも見られる
+//	private:  作成者と招待された人だけが見られる
+//
+// drawing が invited の部屋と private な部屋には、作成者と draw で招待された人だけが描ける。
+// 設定と招待は tokens と同じくメモリに持ち、書き込みは MySQL にも通す。
+//
+// 招待は inviteTTL で期限が切れ、作成者が取り消すこともできる。
+// 期限切れや取り消しで使えなくなるのは招待のリンクだけで、受けた人の権限はそのまま残る。
+
+const (
+	visibilityPublic   = "public"
+	visibilityUnlisted = "unlisted"
+	visibilityPrivate  = "private"
+
+	drawingAnyone  = "anyone"
+	drawingInvited = "invited"
+
+	permissionView = "view"
+	permissionDraw = "draw"
+)
+
+var (
+	errRoomViewDeny   = errors.New("この部屋を見る権限がありません")
+	errRoomDrawDeny   = errors.New("この部屋に描く権限がありません")
+	errRoomOwnerOnly  = errors.New("部屋の作成者だけが変更できます")
+	errInviteNotFound = errors.New("この招待は存在しません")
+
+	// 招待を使える期間
+	inviteTTL = 7 * 24 * time.Hour
+)
+
+type roomSettings struct {
+	Visibility string `json:"visibility"`
+	Drawing    string `json:"drawing"`
+}
+
+var defaultRoomSettings = roomSettings{Visibility: visibilityPublic, Drawing: drawingAnyone}
+
+// normalize は空の項目をデフォルトで埋め、不正な値なら false を返す
+func (s *roomSettings) normalize() bool {
+	if s.Visibility == "" {
+		s.Visibility = visibilityPublic
+	}
+	if s.Drawing == "" {
+		s.Drawing = drawingAnyone
+	}
+	switch s.Visibility {
+	case visibilityPublic, visibilityUnlisted, visibilityPrivate:
+	default:
+		return false
+	}
+	switch s.Drawing {
+	case drawingAnyone, drawingInvited:
+	default:
+		return false
+	}
+	return true
+}
+
+type roomMember struct {
+	RoomID     int64  `db:"room_id"`
+	TokenID    int64  `db:"token_id"`
+	UserID     int64  `db:"user_id"`
+	Permission string `db:"permission"`
+}
+
+type roomInvite struct {
+	Token      string    `json:"token" db:"invite_token"`
+	RoomID     int64     `json:"room_id" db:"room_id"`
+	Permission string    `json:"permission" db:"permission"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at" db:"-"`
+}
+
+func (inv *roomInvite) expired(now time.Time) bool {
+	return !inv.ExpiresAt.After(now)
+}
+
+type roomACL struct {
+	mu       sync.RWMutex
+	settings map[int64]roomSettings
+	members  map[int64][]roomMember
+	invites  map[string]*roomInvite
+	// 部屋ごとの、設定か招待で得た権限が変わった回数。ストリームはこれが変わったときだけ権限を確かめ直す
+	versions map[int64]int64
+}
+
+var acl = newRoomACL()
+
+func newRoomACL() *roomACL {
+	return &roomACL{
+		settings: map[int64]roomSettings{},
+		members:  map[int64][]roomMember{},
+		invites:  map[string]*roomInvite{},
+		versions: map[int64]int64{},
+	}
+}
+
+func (a *roomACL) Load() error {
+	start := time.Now()
+
+	settings := []struct {
+		RoomID int64 `db:"room_id"`
+		roomSettings
+	}{}
+	if err := dbx.Select(&settings, "SELECT `room_id`, `visibility`, `drawing` FROM `room_settings`"); err != nil {
+		return err
+	}
+	members := []roomMember{}
+	if err := dbx.Select(&members, "SELECT `room_id`, `token_id`, `user_id`, `permission` FROM `room_members`"); err != nil {
+		return err
+	}
+	invites := []*roomInvite{}
+	if err := dbx.Select(&invites, "SELECT `invite_token`, `room_id`, `permission`, `created_at` FROM `room_invites`"); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.settings = make(map[int64]roomSettings, len(settings))
+	for _, s := range settings {
+		a.settings[s.RoomID] = s.roomSettings
+	}
+	a.members = map[int64][]roomMember{}
+	for _, m := range members {
+		a.members[m.RoomID] = append(a.members[m.RoomID], m)
+	}
+	a.invites = make(map[string]*roomInvite, len(invites))
+	for _, inv := range invites {
+		inv.ExpiresAt = inv.CreatedAt.Add(inviteTTL)
+		a.invites[inv.Token] = inv
+	}
+
+	startupStats.Set("room_acl_load", expvarDuration(time.Since(start)))
+	log.Printf("loaded %d room settings, %d members, %d invites in %s", len(settings), len(members), len(invites), time.Since(start))
+	return nil
+}
+
+func (a *roomACL) Settings(roomID int64) roomSettings {
+	a.mu.RLock()
+	s, ok := a.settings[roomID]
+	a.mu.RUnlock()
+	if !ok {
+		return defaultRoomSettings
+	}
+	return s
+}
+
+// Version は部屋の設定か、招待で得た権限が変わるたびに増える値を返す
+func (a *roomACL) Version(roomID int64) int64 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.versions[roomID]
+}
+
+// set はメモリだけを書き換える。部屋の作成時に RoomStore から呼ぶ
+func (a *roomACL) set(roomID int64, s roomSettings) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.versions[roomID]++
+	if s == defaultRoomSettings {
+		delete(a.settings, roomID)
+		return
+	}
+	a.settings[roomID] = s
+}
+
+func (a *roomACL) Update(roomID int64, s roomSettings) error {
+	query := "REPLACE INTO `room_settings` (`room_id`, `visibility`, `drawing`) VALUES (?, ?, ?)"
+	if _, err := dbx.Exec(query, roomID, s.Visibility, s.Drawing); err != nil {
+		return err
+	}
+	a.set(roomID, s)
+	return nil
+}
+
+// HiddenCount は一覧に出さない部屋の数を返す
+func (a *roomACL) HiddenCount() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	n := 0
+	for _, s := range a.settings {
+		if s.Visibility != visibilityPublic {
+			n++
+		}
+	}
+	return n
+}
+
+// memberPermission は招待で得た権限を返す。招待されていなければ ""
+func (a *roomACL) memberPermission(roomID int64, t *Token) string {
+	userID := t.UserID()
+	perm := ""
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, m := range a.members[roomID] {
+		if m.TokenID != t.ID && (userID == 0 || m.UserID != userID) {
+			continue
+		}
+		if m.Permission == permissionDraw {
+			return permissionDraw
+		}
+		perm = m.Permission
+	}
+	return perm
+}
+
+func (a *roomACL) CreateInvite(roomID int64, permission string) (*roomInvite, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	inv := &roomInvite{
+		Token:      hex.EncodeToString(b),
+		RoomID:     roomID,
+		Permission: permission,
+		CreatedAt:  time.Now().Truncate(time.Microsecond),
+	}
+	inv.ExpiresAt = inv.CreatedAt.Add(inviteTTL)
+	query := "INSERT INTO `room_invites` (`invite_token`, `room_id`, `permission`, `created_at`) VALUES (?, ?, ?, ?)"
+	if _, err := dbx.Exec(query, inv.Token, inv.RoomID, inv.Permission, inv.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.invites[inv.Token] = inv
+	a.mu.Unlock()
+	return inv, nil
+}
+
+// AcceptInvite は招待の権限をトークン(とそのアカウント)に与える。既に draw なら view には下げない
+func (a *roomACL) AcceptInvite(inviteToken string, t *Token) (*roomInvite, error) {
+	a.mu.RLock()
+	inv, ok := a.invites[inviteToken]
+	a.mu.RUnlock()
+	if !ok || inv.expired(time.Now()) {
+		return nil, errInviteNotFound
+	}
+
+	m := roomMember{RoomID: inv.RoomID, TokenID: t.ID, UserID: t.UserID(), Permission: inv.Permission}
+	query := "INSERT INTO `room_members` (`room_id`, `token_id`, `user_id`, `permission`) VALUES (?, ?, ?, ?)"
+	query += " ON DUPLICATE KEY UPDATE `user_id` = VALUES(`user_id`),"
+	query += " `permission` = IF(`permission` = 'draw', 'draw', VALUES(`permission`))"
+	if _, err := dbx.Exec(query, m.RoomID, m.TokenID, m.UserID, m.Permission); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.versions[m.RoomID]++
+	members := a.members[m.RoomID]
+	for i := range members {
+		if members[i].TokenID == m.TokenID {
+			members[i].UserID = m.UserID
+			if members[i].Permission != permissionDraw {
+				members[i].Permission = m.Permission
+			}
+			return inv, nil
+		}
+	}
+	a.members[m.RoomID] = append(members, m)
+	return inv, nil
+}
+
+// TransferMembers はトークンを作り直したときに招待で得た権限を引き継ぐ
+func (a *roomACL) TransferMembers(fromTokenID int64, toTokenID int64) error {
+	query := "UPDATE `room_members` SET `token_id` = ? WHERE `token_id` = ?"
+	if _, err := dbx.Exec(query, toTokenID, fromTokenID); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for roomID, members := range a.members {
+		for i := range members {
+			if members[i].TokenID == fromTokenID {
+				members[i].TokenID = toTokenID
+				a.versions[roomID]++
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteInvite は部屋の招待を取り消す。受けた人の権限はそのまま残る
+func (a *roomACL) DeleteInvite(roomID int64, inviteToken string) error {
+	a.mu.RLock()
+	inv, ok := a.invites[inviteToken]
+	a.mu.RUnlock()
+	if !ok || inv.RoomID != roomID {
+		return errInviteNotFound
+	}
+	if _, err := dbx.Exec("DELETE FROM `room_invites` WHERE `invite_token` = ?", inviteToken); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	delete(a.invites, inviteToken)
+	a.mu.Unlock()
+	return nil
+}
+
+// PurgeInvites は期限切れの招待をメモリと MySQL から消す
+func (a *roomACL) PurgeInvites() error {
+	now := time.Now()
+	if _, err := dbx.Exec("DELETE FROM `room_invites` WHERE `created_at` <= ?", now.Add(-inviteTTL)); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for token, inv := range a.invites {
+		if inv.expired(now) {
+			delete(a.invites, token)
+		}
+	}
+	return nil
+}
+
+func isRoomOwner(t *Token, owner roomOwner) bool {
+	if t.ID == owner.TokenID {
+		return true
+	}
+	// アカウントに紐付いていれば、作ったときと違うトークンでも作成者として扱う
+	userID := t.UserID()
+	return userID != 0 && userID == owner.UserID
+}
+
+// roomPermission は t がその部屋でできることを返す。t は nil でもよい
+func roomPermission(t *Token, room *Room) (string, error) {
+	s := acl.Settings(room.ID)
+	if t != nil {
+		owner, err := store.RoomOwner(room.ID)
+		if err != nil {
+			return "", err
+		}
+		if isRoomOwner(t, owner) {
+			return permissionDraw, nil
+		}
+		if perm := acl.memberPermission(room.ID, t); perm == permissionDraw ||
+			(perm == permissionView && s.Visibility == visibilityPrivate) {
+			return perm, nil
+		}
+	}
+
+	switch {
+	case s.Visibility == visibilityPrivate:
+		return "", nil
+	case t == nil || s.Drawing == drawingInvited:
+		return permissionView, nil
+	}
+	return permissionDraw, nil
+}
+
+func checkCanView(t *Token, room *Room) error {
+	perm, err := roomPermission(t, room)
+	if err != nil {
+		return err
+	}
+	if perm == "" {
+		return errRoomViewDeny
+	}
+	return nil
+}
+
+// checkCanDraw は部屋に描く権限と、1画目の制限を確かめる
+func checkCanDraw(t *Token, room *Room) error {
+	if err := checkDrawPermission(t, room); err != nil {
+		return err
+	}
+	return checkFirstStroke(t, room)
+}
+
+// checkDrawPermission は部屋に描く権限だけを確かめる。ストロークを消すときに使う
+func checkDrawPermission(t *Token, room *Room) error {
+	perm, err := roomPermission(t, room)
+	if err != nil {
+		return err
+	}
+	if perm != permissionDraw {
+		return errRoomDrawDeny
+	}
+	return nil
+}
+
+// viewerToken は見るだけのリクエストのトークンを読む。
+// img タグや EventSource からはヘッダを付けられないのでクエリも見る
+func viewerToken(r *http.Request) (*Token, error) {
+	csrfToken := r.Header.Get("x-csrf-token")
+	if csrfToken == "" {
+		csrfToken = r.URL.Query().Get("csrf_token")
+	}
+	return checkToken(csrfToken)
+}
+
+func outputAccessError(w http.ResponseWriter, err error) {
+	switch err {
+	case errRoomViewDeny, errRoomDrawDeny, errRoomOwnerOnly:
+		outputErrorMsg(w, http.StatusForbidden, err.Error())
+	case errInviteNotFound:
+		outputErrorMsg(w, http.StatusNotFound, err.Error())
+	default:
+		outputStrokeError(w, err)
+	}
+}
+
+// parseOwnerRequest は部屋の作成者だけが使えるエンドポイントのトークンと部屋を読む
+func parseOwnerRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) (*Room, bool) {
+	t, err := checkToken(r.Header.Get("x-csrf-token"))
+	if err != nil {
+		outputError(w, err)
+		return nil, false
+	}
+	if t == nil {
+		outputErrorMsg(w, http.StatusBadRequest, "トークンエラー。ページを再読み込みしてください。")
+		return nil, false
+	}
+
+	id, err := strconv.ParseInt(pat.Param(ctx, "id"), 10, 64)
+	if err != nil {
+		outputErrorMsg(w, http.StatusNotFound, "この部屋は存在しません。")
+		return nil, false
+	}
+	room, err := store.GetRoom(id)
+	if err != nil {
+		outputAccessError(w, err)
+		return nil, false
+	}
+	owner, err := store.RoomOwner(room.ID)
+	if err != nil {
+		outputError(w, err)
+		return nil, false
+	}
+	if !isRoomOwner(t, owner) {
+		outputAccessError(w, errRoomOwnerOnly)
+		return nil, false
+	}
+	return room, true
+}
+
+func putAPIRoomsIDSettings(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	room, ok := parseOwnerRequest(ctx, w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	s := acl.Settings(room.ID)
+	if err := json.Unmarshal(body, &s); err != nil || !s.normalize() {
+		outputErrorMsg(w, http.StatusBadRequest, "リクエストが正しくありません。")
+		return
+	}
+	if err := acl.Update(room.ID, s); err != nil {
+		outputError(w, err)
+		return
+	}
+	// 見られなくなった人のストリームを閉じさせる
+	hub.Notify(room.ID)
+	room.touch()
+
+	b, _ := json.Marshal(struct {
+		Room *Room `json:"room"`
+	}{Room: room.View()})
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func postAPIRoomsIDInvites(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	room, ok := parseOwnerRequest(ctx, w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	posted := struct {
+		Permission string `json:"permission"`
+	}{}
+	if err := json.Unmarshal(body, &posted); err != nil ||
+		(posted.Permission != permissionView && posted.Permission != permissionDraw) {
+		outputErrorMsg(w, http.StatusBadRequest, "リクエストが正しくありません。")
+		return
+	}
+
+	inv, err := acl.CreateInvite(room.ID, posted.Permission)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+
+	b, _ := json.Marshal(struct {
+		Invite *roomInvite `json:"invite"`
+	}{Invite: inv})
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func deleteAPIRoomsIDInvitesToken(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	room, ok := parseOwnerRequest(ctx, w, r)
+	if !ok {
+		return
+	}
+	if err := acl.DeleteInvite(room.ID, pat.Param(ctx, "invite_token")); err != nil {
+		outputAccessError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func postAPIInvitesToken(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	t, err := checkToken(r.Header.Get("x-csrf-token"))
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	if t == nil {
+		outputErrorMsg(w, http.StatusBadRequest, "トークンエラー。ページを再読み込みしてください。")
+		return
+	}
+
+	inv, err := acl.AcceptInvite(pat.Param(ctx, "invite_token"), t)
+	if err != nil {
+		outputAccessError(w, err)
+		return
+	}
+	room, err := store.GetRoom(inv.RoomID)
+	if err != nil {
+		outputAccessError(w, err)
+		return
+	}
+
+	b, _ := json.Marshal(struct {
+		Room       *Room  `json:"room"`
+		Permission string `json:"permission"`
+	}{Room: room.View(), Permission: inv.Permission})
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
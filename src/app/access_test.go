@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setupAccessRoom は visibility の部屋を作り、作成者と、見るだけと描ける招待を受けた人と、
+// 招待されていない人と、トークンの無い人を用意する
+func setupAccessRoom(t *testing.T, ts *httptest.Server, visibility string) (*Room, map[string]*Token) {
+	owner := newTestToken()
+	code, b := doRequest(t, "POST", ts.URL+"/api/rooms", owner, map[string]interface{}{
+		"name":          "access",
+		"canvas_width":  100,
+		"canvas_height": 100,
+		"visibility":    visibility,
+	})
+	if code != http.StatusOK {
+		t.Fatalf("POST /api/rooms: %d %s", code, b)
+	}
+	var created struct {
+		Room *Room `json:"room"`
+	}
+	if err := json.Unmarshal(b, &created); err != nil {
+		t.Fatal(err)
+	}
+	room := created.Room
+
+	// 1画目は作成者しか描けないので、先に描いておく
+	code, b = doRequest(t, "POST", fmt.Sprintf("%s/api/strokes/rooms/%d", ts.URL, room.ID), owner, testStrokeBody())
+	if code != http.StatusOK {
+		t.Fatalf("POST first stroke: %d %s", code, b)
+	}
+
+	roles := map[string]*Token{
+		"owner":     owner,
+		"stranger":  newTestToken(),
+		"anonymous": nil,
+	}
+	for _, perm := range []string{permissionView, permissionDraw} {
+		code, b := doRequest(t, "POST", fmt.Sprintf("%s/api/rooms/%d/invites", ts.URL, room.ID), owner, map[string]string{"permission": perm})
+		if code != http.StatusOK {
+			t.Fatalf("POST invites: %d %s", code, b)
+		}
+		var res struct {
+			Invite roomInvite `json:"invite"`
+		}
+		if err := json.Unmarshal(b, &res); err != nil {
+			t.Fatal(err)
+		}
+		member := newTestToken()
+		if code, b := doRequest(t, "POST", ts.URL+"/api/invites/"+res.Invite.Token, member, nil); code != http.StatusOK {
+			t.Fatalf("POST /api/invites: %d %s", code, b)
+		}
+		roles["member-"+perm] = member
+	}
+	return room, roles
+}
+
+// firstStreamEvent はストリームを開いて最初のイベントの名前を返す
+func firstStreamEvent(t *testing.T, url string) string {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	event := make(chan string, 1)
+	go func() {
+		sc := bufio.NewScanner(res.Body)
+		for sc.Scan() {
+			if strings.HasPrefix(sc.Text(), "event:") {
+				event <- strings.TrimPrefix(sc.Text(), "event:")
+				return
+			}
+		}
+		event <- ""
+	}()
+	select {
+	case ev := <-event:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event from %s", url)
+	}
+	return ""
+}
+
+func roleSet(roles string) map[string]bool {
+	m := map[string]bool{}
+	for _, r := range strings.Fields(roles) {
+		m[r] = true
+	}
+	return m
+}
+
+func TestRoomAccess(t *testing.T) {
+	defer useTestDB(t)()
+
+	tests := []struct {
+		visibility string
+		canView    map[string]bool
+		canDraw    map[string]bool
+		listed     bool
+	}{
+		{visibilityPublic, roleSet("owner member-view member-draw stranger anonymous"), roleSet("owner member-view member-draw stranger"), true},
+		{visibilityUnlisted, roleSet("owner member-view member-draw stranger anonymous"), roleSet("owner member-view member-draw stranger"), false},
+		{visibilityPrivate, roleSet("owner member-view member-draw"), roleSet("owner member-draw"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.visibility, func(t *testing.T) {
+			ts := newTestServer(t)
+			defer ts.Close()
+			room, roles := setupAccessRoom(t, ts, tt.visibility)
+
+			for role, tk := range roles {
+				for _, path := range []string{"/api/rooms/%d", "/api/rooms/%d/strokes", "/img/%d", "/img/%d/thumb"} {
+					url := ts.URL + fmt.Sprintf(path, room.ID)
+					want := http.StatusForbidden
+					if tt.canView[role] {
+						want = http.StatusOK
+					}
+					if code, b := doRequest(t, "GET", url, tk, nil); code != want {
+						t.Errorf("%s: GET %s: got %d %s, want %d", role, path, code, b, want)
+					}
+				}
+
+				// ストリームはトークンが必要で、見られなければ bad_request を送って閉じる
+				url := fmt.Sprintf("%s/api/stream/rooms/%d", ts.URL, room.ID)
+				if tk != nil {
+					url += "?csrf_token=" + tk.CSRFToken
+				}
+				ev := firstStreamEvent(t, url)
+				if allowed := tt.canView[role] && tk != nil; allowed != (ev != "bad_request") {
+					t.Errorf("%s: stream: first event %q, allowed %v", role, ev, allowed)
+				}
+
+				want := http.StatusForbidden
+				if tk == nil {
+					want = http.StatusBadRequest
+				} else if tt.canDraw[role] {
+					want = http.StatusOK
+				}
+				code, b := doRequest(t, "POST", fmt.Sprintf("%s/api/strokes/rooms/%d", ts.URL, room.ID), tk, testStrokeBody())
+				if code != want {
+					t.Errorf("%s: POST stroke: got %d %s, want %d", role, code, b, want)
+				}
+			}
+
+			code, b := doRequest(t, "GET", ts.URL+"/api/rooms", nil, nil)
+			if code != http.StatusOK {
+				t.Fatalf("GET /api/rooms: %d %s", code, b)
+			}
+			if listed := strings.Contains(string(b), fmt.Sprintf(`"id":%d,`, room.ID)); listed != tt.listed {
+				t.Errorf("GET /api/rooms: listed %v, want %v", listed, tt.listed)
+			}
+		})
+	}
+}
+
+func TestOwnerOnlyEndpoints(t *testing.T) {
+	defer useTestDB(t)()
+	ts := newTestServer(t)
+	defer ts.Close()
+	room, roles := setupAccessRoom(t, ts, visibilityPublic)
+
+	for role, tk := range roles {
+		if tk == nil {
+			continue
+		}
+		want := http.StatusForbidden
+		if role == "owner" {
+			want = http.StatusOK
+		}
+		code, b := doRequest(t, "PUT", fmt.Sprintf("%s/api/rooms/%d/settings", ts.URL, room.ID), tk, map[string]string{"visibility": visibilityPublic})
+		if code != want {
+			t.Errorf("%s: PUT settings: got %d %s, want %d", role, code, b, want)
+		}
+		code, b = doRequest(t, "POST", fmt.Sprintf("%s/api/rooms/%d/invites", ts.URL, room.ID), tk, map[string]string{"permission": permissionView})
+		if code != want {
+			t.Errorf("%s: POST invites: got %d %s, want %d", role, code, b, want)
+		}
+	}
+
+	if code, _ := doRequest(t, "POST", ts.URL+"/api/invites/unknown", roles["stranger"], nil); code != http.StatusNotFound {
+		t.Errorf("POST unknown invite: got %d", code)
+	}
+}
+
+// ownerCountingStore は RoomOwner を呼んだ回数を数える
+type ownerCountingStore struct {
+	RoomStore
+	calls int64
+}
+
+func (s *ownerCountingStore) RoomOwner(roomID int64) (roomOwner, error) {
+	atomic.AddInt64(&s.calls, 1)
+	return s.RoomStore.RoomOwner(roomID)
+}
+
+// TestStreamRechecksOnACLChange はストリームが起こされるたびではなく、
+// 部屋の設定が変わったときに権限を確かめ直して、見られなくなったら閉じることを確かめる
+func TestStreamRechecksOnACLChange(t *testing.T) {
+	defer useTestDB(t)()
+	ts := newTestServer(t)
+	defer ts.Close()
+	room, roles := setupAccessRoom(t, ts, visibilityPublic)
+	counting := &ownerCountingStore{RoomStore: store}
+	store = counting
+
+	res, err := http.Get(fmt.Sprintf("%s/api/stream/rooms/%d?csrf_token=%s", ts.URL, room.ID, roles["stranger"].CSRFToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	events := make(chan string, 64)
+	go func() {
+		defer close(events)
+		sc := bufio.NewScanner(res.Body)
+		for sc.Scan() {
+			if strings.HasPrefix(sc.Text(), "event:") {
+				events <- strings.TrimPrefix(sc.Text(), "event:")
+			}
+		}
+	}()
+	waitEvent := func(name string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					t.Fatalf("stream closed before %s", name)
+				}
+				if ev == name {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for %s", name)
+			}
+		}
+	}
+	waitEvent("layers")
+
+	calls := atomic.LoadInt64(&counting.calls)
+	for i := 0; i < 10; i++ {
+		hub.Notify(room.ID)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&counting.calls) - calls; n != 0 {
+		t.Errorf("access is checked %d times without changes", n)
+	}
+
+	settingsURL := fmt.Sprintf("%s/api/rooms/%d/settings", ts.URL, room.ID)
+	if code, b := doRequest(t, "PUT", settingsURL, roles["owner"], roomSettings{Visibility: visibilityPrivate}); code != http.StatusOK {
+		t.Fatalf("PUT settings: %d %s", code, b)
+	}
+	waitEvent("access_denied")
+}
+
+// TestInviteExpiryAndDelete は期限の切れた招待と、作成者が取り消した招待を使えないことを確かめる
+func TestInviteExpiryAndDelete(t *testing.T) {
+	defer useTestDB(t)()
+	ts := newTestServer(t)
+	defer ts.Close()
+	room, roles := setupAccessRoom(t, ts, visibilityPrivate)
+	invitesURL := fmt.Sprintf("%s/api/rooms/%d/invites", ts.URL, room.ID)
+
+	createInvite := func() roomInvite {
+		code, b := doRequest(t, "POST", invitesURL, roles["owner"], map[string]string{"permission": permissionView})
+		if code != http.StatusOK {
+			t.Fatalf("POST invites: %d %s", code, b)
+		}
+		var res struct {
+			Invite roomInvite `json:"invite"`
+		}
+		if err := json.Unmarshal(b, &res); err != nil {
+			t.Fatal(err)
+		}
+		if !res.Invite.ExpiresAt.After(time.Now()) {
+			t.Errorf("invite expires at %s", res.Invite.ExpiresAt)
+		}
+		return res.Invite
+	}
+
+	deleted := createInvite()
+	if code, b := doRequest(t, "DELETE", invitesURL+"/"+deleted.Token, roles["member-draw"], nil); code != http.StatusForbidden {
+		t.Errorf("DELETE invite by a member: got %d %s, want %d", code, b, http.StatusForbidden)
+	}
+	if code, b := doRequest(t, "DELETE", invitesURL+"/"+deleted.Token, roles["owner"], nil); code != http.StatusNoContent {
+		t.Errorf("DELETE invite: got %d %s, want %d", code, b, http.StatusNoContent)
+	}
+	if code, b := doRequest(t, "DELETE", invitesURL+"/"+deleted.Token, roles["owner"], nil); code != http.StatusNotFound {
+		t.Errorf("DELETE deleted invite: got %d %s, want %d", code, b, http.StatusNotFound)
+	}
+
+	expired := createInvite()
+	acl.mu.Lock()
+	acl.invites[expired.Token].ExpiresAt = time.Now()
+	acl.mu.Unlock()
+
+	for _, inv := range []roomInvite{deleted, expired} {
+		if code, b := doRequest(t, "POST", ts.URL+"/api/invites/"+inv.Token, roles["stranger"], nil); code != http.StatusNotFound {
+			t.Errorf("POST /api/invites/%s: got %d %s, want %d", inv.Token, code, b, http.StatusNotFound)
+		}
+	}
+	if code, _ := doRequest(t, "GET", fmt.Sprintf("%s/api/rooms/%d", ts.URL, room.ID), roles["stranger"], nil); code != http.StatusForbidden {
+		t.Errorf("GET room after using unusable invites: got %d, want %d", code, http.StatusForbidden)
+	}
+
+	if err := acl.PurgeInvites(); err != nil {
+		t.Fatal(err)
+	}
+	acl.mu.RLock()
+	_, ok := acl.invites[expired.Token]
+	acl.mu.RUnlock()
+	if ok {
+		t.Error("expired invite is not purged")
+	}
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"bytes"
-	"database/sql"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -23,12 +25,29 @@ import (
 var (
 	dbx      *sqlx.DB
 	roomRepo = NewRoomRepo()
+
+	// ストリームを維持する最大時間。0 ならクライアントが切断するまで維持する。
+	// STREAM_MAX_LIFETIME で定期的につなぎ直させられる
+	streamMaxLifetime time.Duration
+	// プロキシに切られないように送るコメント行の間隔
+	streamHeartbeatInterval = 15 * time.Second
 )
 
 type Token struct {
 	ID        int64     `db:"id"`
 	CSRFToken string    `db:"csrf_token"`
 	CreatedAt time.Time `db:"created_at"`
+
+	// 失効したら close される
+	revoked chan struct{}
+	// 紐付いているアカウント。無ければ 0。UserID() で読む
+	userMu sync.Mutex
+	userID int64
+	// 描いたストロークの作者にするトークン。Refresh で作り直しても最初のトークンを引き継ぐ。
+	// 0 なら自分。AuthorTokenID() で読む
+	authorTokenID int64
+	// メモリに無かった署名付きトークンは、アカウントと作者を初めて使うときに MySQL から読む
+	userUnknown bool
 }
 
 type Point struct {
@@ -48,6 +67,18 @@ type Stroke struct {
 	Alpha     float64   `json:"alpha" db:"alpha"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 	Points    []Point   `json:"points" db:"points"`
+	// 0 なら土台のレイヤー
+	LayerID int64 `json:"layer_id" db:"layer_id"`
+	// 図形の種類と塗りと文字。空の type は折れ線。shape.go を参照
+	Type string `json:"type,omitempty" db:"type"`
+	Fill bool   `json:"fill,omitempty" db:"fill"`
+	Text string `json:"text,omitempty" db:"text"`
+	// 描いた人のハンドル。setAuthor で埋める
+	Author string `json:"author,omitempty" db:"-"`
+
+	// 描いたトークンとアカウント。消せるかどうかの判定に使う
+	AuthorTokenID int64 `json:"-" db:"author_token_id"`
+	AuthorUserID  int64 `json:"-" db:"author_user_id"`
 
 	json []byte
 }
@@ -61,14 +92,49 @@ type Room struct {
 	Strokes      []Stroke  `json:"strokes"`
 	StrokeCount  int       `json:"stroke_count"`
 	WatcherCount int       `json:"watcher_count"`
-
-	watchers map[int64]time.Time
-	ownerID  int64
-
-	svgMtx        sync.RWMutex
-	svgInit       bool
-	svgBuf        *bytes.Buffer
-	svgCompressed []byte
+	Visibility   string    `json:"visibility"`
+	Drawing      string    `json:"drawing"`
+	Layers       []Layer   `json:"layers"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty"`
+
+	// Strokes と StrokeCount を守る。
+	// RoomRepo に入れた Room は直接 JSON にせず、View() でコピーを作ること
+	mu       sync.Mutex
+	snapshot atomic.Value // []Stroke
+	// 消したストロークの記録。ID 順で、Room.mu で守る
+	tombstones []strokeTombstone
+	// TransferRooms や ClaimRooms で書き換わるので Owner() で読む
+	ownerID     int64
+	ownerUserID int64
+
+	// 最後のストロークの ID が変わらずに中身が変わった時刻の UnixNano。cache.go を参照
+	changedAt int64
+
+	// ストロークと削除の記録の採番から RoomRepo に入れるまでを守る。
+	// 入れ替わるとストリームが先に大きい ID まで進んで、小さい ID のものを取りこぼす
+	addMtx sync.Mutex
+
+	svgMtx    sync.RWMutex
+	svgInit   bool
+	svgCount  int
+	svgLayers map[int64]*bytes.Buffer
+	// svgLayers と同じ中身を圧縮した deflate のブロック。gzipseg.go を参照
+	svgGzipLayers map[int64]*deflateSegment
+	// encoding ごとの SVG。identity は圧縮していないもの
+	svgVariants map[string][]byte
+	// svgVariants を作り直すたびに増やす。svgMtx の外で圧縮したものを入れてよいかを見る
+	svgVersion int64
+
+	pngMtx sync.Mutex
+	// 倍率ごとの PNG
+	pngCache map[float64][]byte
+	// pngCache を捨てるたびに増やす。pngMtx の外で描いたものを入れてよいかを見る
+	pngVersion int64
+	// 倍率ごとに描いている最中の PNG。同じ倍率を頼まれたら描き終わるのを待って同じものを返す
+	pngRendering map[float64]*pngRender
+
+	thumbMtx sync.Mutex
+	thumbs   map[string]*roomThumbnail
 }
 
 func getFlusher(w http.ResponseWriter) http.Flusher {
@@ -92,22 +158,7 @@ func checkToken(csrfToken string) (*Token, error) {
 	if csrfToken == "" {
 		return nil, nil
 	}
-
-	query := "SELECT `id`, `csrf_token`, `created_at` FROM `tokens`"
-	query += " WHERE `csrf_token` = ? AND `created_at` > CURRENT_TIMESTAMP(6) - INTERVAL 1 DAY"
-
-	t := &Token{}
-	err := dbx.Get(t, query, csrfToken)
-
-	if err != nil && err != sql.ErrNoRows {
-		return nil, err
-	}
-
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
-
-	return t, nil
+	return tokens.Get(csrfToken), nil
 }
 
 func getStrokePoints(strokeID int64) ([]Point, error) {
@@ -120,9 +171,16 @@ func getStrokePoints(strokeID int64) ([]Point, error) {
 	return ps, nil
 }
 
+const strokeSelectQuery = "SELECT s.`id`, s.`room_id`, s.`width`, s.`red`, s.`green`, s.`blue`, s.`alpha`, s.`created_at`," +
+	" COALESCE(a.`token_id`, 0) AS `author_token_id`, COALESCE(a.`user_id`, 0) AS `author_user_id`," +
+	" COALESCE(l.`layer_id`, 0) AS `layer_id`," +
+	" COALESCE(sh.`type`, '') AS `type`, COALESCE(sh.`fill`, 0) AS `fill`, COALESCE(sh.`text`, '') AS `text`" +
+	" FROM `strokes` s LEFT JOIN `stroke_authors` a ON a.`stroke_id` = s.`id`" +
+	" LEFT JOIN `stroke_layers` l ON l.`stroke_id` = s.`id`" +
+	" LEFT JOIN `stroke_shapes` sh ON sh.`stroke_id` = s.`id`"
+
 func getStrokes(roomID int64, greaterThanID int64) ([]Stroke, error) {
-	query := "SELECT `id`, `room_id`, `width`, `red`, `green`, `blue`, `alpha`, `created_at` FROM `strokes`"
-	query += " WHERE `room_id` = ? AND `id` > ? ORDER BY `id` ASC"
+	query := strokeSelectQuery + " WHERE s.`room_id` = ? AND s.`id` > ? ORDER BY s.`id` ASC"
 	strokes := []Stroke{}
 	err := dbx.Select(&strokes, query, roomID, greaterThanID)
 	if err != nil {
@@ -131,6 +189,7 @@ func getStrokes(roomID int64, greaterThanID int64) ([]Stroke, error) {
 	// 空スライスを入れてJSONでnullを返さないように
 	for i := range strokes {
 		strokes[i].Points = []Point{}
+		strokes[i].setAuthor()
 	}
 	return strokes, nil
 }
@@ -147,31 +206,6 @@ func getRoom(roomID int64) (*Room, error) {
 	return r, nil
 }
 
-/*
-func getWatcherCount(roomID int64) (int, error) {
-	query := "SELECT COUNT(*) AS `watcher_count` FROM `room_watchers`"
-	query += " WHERE `room_id` = ? AND `updated_at` > CURRENT_TIMESTAMP(6) - INTERVAL 3 SECOND"
-
-	var watcherCount int
-	err := dbx.QueryRow(query, roomID).Scan(&watcherCount)
-	if err != nil && err != sql.ErrNoRows {
-		return 0, err
-	}
-	if err == sql.ErrNoRows {
-		return 0, nil
-	}
-	return watcherCount, nil
-}
-
-func updateRoomWatcher(roomID int64, tokenID int64) error {
-	query := "INSERT INTO `room_watchers` (`room_id`, `token_id`) VALUES (?, ?)"
-	query += " ON DUPLICATE KEY UPDATE `updated_at` = CURRENT_TIMESTAMP(6)"
-
-	_, err := dbx.Exec(query, roomID, tokenID)
-	return err
-}
-*/
-
 func outputErrorMsg(w http.ResponseWriter, status int, msg string) {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 
@@ -196,28 +230,28 @@ func outputError(w http.ResponseWriter, err error) {
 }
 
 func postAPICsrfToken(w http.ResponseWriter, r *http.Request) {
-	query := "INSERT INTO `tokens` (`csrf_token`) VALUES"
-	query += " (SHA2(CONCAT(RAND(), UUID_SHORT()), 256))"
-
-	result, err := dbx.Exec(query)
+	t, err := tokens.Create()
 	if err != nil {
 		outputError(w, err)
 		return
 	}
 
-	id, err := result.LastInsertId()
+	// ログインしていれば新しいトークンもアカウントに紐付ける
+	userID, err := sessionUserID(r)
 	if err != nil {
 		outputError(w, err)
 		return
 	}
-
-	t := Token{}
-	query = "SELECT `id`, `csrf_token`, `created_at` FROM `tokens` WHERE id = ?"
-	err = dbx.Get(&t, query, id)
-	if err != nil {
-		outputError(w, err)
-		return
+	if userID != 0 {
+		if err := tokens.Bind(t, userID); err != nil {
+			outputError(w, err)
+			return
+		}
 	}
+	outputToken(w, t)
+}
+
+func outputToken(w http.ResponseWriter, t *Token) {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 
 	b, _ := json.Marshal(struct {
@@ -228,18 +262,48 @@ func postAPICsrfToken(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
-func getAPIRooms(w http.ResponseWriter, r *http.Request) {
-	query := "SELECT `room_id`, MAX(`id`) AS `max_id` FROM `strokes`"
-	query += " GROUP BY `room_id` ORDER BY `max_id` DESC LIMIT 100"
+// postAPICsrfTokenRefresh は今のトークンを失効させて、部屋の持ち主を引き継いだ新しいトークンを返す
+func postAPICsrfTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	old, err := checkToken(r.Header.Get("x-csrf-token"))
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	if old == nil {
+		outputErrorMsg(w, http.StatusBadRequest, "トークンエラー。ページを再読み込みしてください。")
+		return
+	}
 
-	type result struct {
-		RoomID int64 `db:"room_id"`
-		MaxID  int64 `db:"max_id"`
+	t, err := tokens.Refresh(old)
+	if err != nil {
+		outputError(w, err)
+		return
 	}
+	outputToken(w, t)
+}
 
-	results := []result{}
+// postAPICsrfTokenRevoke はトークンを失効させ、そのトークンのストリームを閉じる
+func postAPICsrfTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	t, err := checkToken(r.Header.Get("x-csrf-token"))
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	if t == nil {
+		outputErrorMsg(w, http.StatusBadRequest, "トークンエラー。ページを再読み込みしてください。")
+		return
+	}
 
-	err := dbx.Select(&results, query)
+	if err := tokens.Revoke(t); err != nil {
+		outputError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getAPIRooms(w http.ResponseWriter, r *http.Request) {
+	// 一覧に出さない部屋を除いても100件になるように多めに取る
+	recent, err := store.RecentRooms(100 + acl.HiddenCount())
 	if err != nil {
 		outputError(w, err)
 		return
@@ -247,19 +311,23 @@ func getAPIRooms(w http.ResponseWriter, r *http.Request) {
 
 	rooms := []*Room{}
 
-	for _, r := range results {
-		room, ok := roomRepo.Get(r.RoomID)
-		if !ok {
+	for _, room := range recent {
+		if len(rooms) >= 100 {
+			break
+		}
+		if acl.Settings(room.ID).Visibility != visibilityPublic {
 			continue
 		}
 		// このAPIでは Points が要らないので削る
-		var r Room = *room
-		r.Strokes = make([]Stroke, len(room.Strokes))
-		copy(r.Strokes, room.Strokes)
+		r := room.View()
+		strokes := make([]Stroke, len(r.Strokes))
+		copy(strokes, r.Strokes)
+		r.Strokes = strokes
 		for i := 0; i < len(r.Strokes); i++ {
 			r.Strokes[i].Points = nil
 		}
-		rooms = append(rooms, &r)
+		r.ThumbnailURL = thumbnailURL(r.ID)
+		rooms = append(rooms, r)
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
@@ -298,43 +366,22 @@ func postAPIRooms(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if postedRoom.Name == "" || postedRoom.CanvasWidth == 0 || postedRoom.CanvasHeight == 0 {
+	settings := roomSettings{Visibility: postedRoom.Visibility, Drawing: postedRoom.Drawing}
+	if postedRoom.Name == "" || postedRoom.CanvasWidth == 0 || postedRoom.CanvasHeight == 0 || !settings.normalize() {
 		outputErrorMsg(w, http.StatusBadRequest, "リクエストが正しくありません。")
 		return
 	}
 
-	tx := dbx.MustBegin()
-	query := "INSERT INTO `rooms` (`name`, `canvas_width`, `canvas_height`)"
-	query += " VALUES (?, ?, ?)"
-
-	result := tx.MustExec(query, postedRoom.Name, postedRoom.CanvasWidth, postedRoom.CanvasHeight)
-	roomID, err := result.LastInsertId()
-	if err != nil {
-		outputError(w, err)
-		return
-	}
-
-	query = "INSERT INTO `room_owners` (`room_id`, `token_id`) VALUES (?, ?)"
-	tx.MustExec(query, roomID, t.ID)
-
-	err = tx.Commit()
-	if err != nil {
-		tx.Rollback()
-		outputError(w, err)
-		return
-	}
-
-	room, err := getRoom(roomID)
+	owner := roomOwner{TokenID: t.ID, UserID: t.UserID()}
+	room, err := store.CreateRoom(postedRoom.Name, postedRoom.CanvasWidth, postedRoom.CanvasHeight, owner, settings)
 	if err != nil {
 		outputError(w, err)
 		return
 	}
 
-	roomRepo.AddRoom(room, t.ID)
-
 	b, _ := json.Marshal(struct {
 		Room *Room `json:"room"`
-	}{Room: room})
+	}{Room: room.View()})
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	w.WriteHeader(http.StatusOK)
@@ -349,15 +396,36 @@ func getAPIRoomsID(ctx context.Context, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	room, ok := roomRepo.Get(id)
-	if !ok {
+	room, err := store.GetRoom(id)
+	if err == errRoomNotFound {
 		outputErrorMsg(w, http.StatusNotFound, "この部屋は存在しません。")
 		return
 	}
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+
+	t, err := viewerToken(r)
+	if err == nil {
+		err = checkCanView(t, room)
+	}
+	if err != nil {
+		outputAccessError(w, err)
+		return
+	}
+
+	// 見ている人の数も JSON に入るので ETag に含める。
+	// 見ている人の数は Last-Modified に表せないので、JSON には Last-Modified を付けない
+	tag, _ := roomValidators(room)
+	etag := fmt.Sprintf(`W/"%s-%d"`, tag, hub.GetWatcherCount(room.ID))
+	if checkNotModified(w, r, roomCacheControl(room, roomMaxAge), etag, time.Time{}) {
+		return
+	}
 
 	b, _ := json.Marshal(struct {
 		Room *Room `json:"room"`
-	}{Room: room})
+	}{Room: room.View()})
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	w.WriteHeader(http.StatusOK)
@@ -390,53 +458,93 @@ func getAPIStreamRoomsID(ctx context.Context, w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	_, ok := roomRepo.Get(id)
-	if !ok {
+	// 確かめた後に権限が変わったら、ループで確かめ直す
+	aclVersion, aclUserID := acl.Version(id), t.UserID()
+	room, err := store.GetRoom(id)
+	if err == errRoomNotFound {
 		w.Write([]byte("event:bad_request\n" + "data:この部屋は存在しません\n\n"))
 		return
 	}
+	if err == nil {
+		err = checkCanView(t, room)
+	}
+	if err == errRoomViewDeny {
+		w.Write([]byte("event:bad_request\n" + "data:" + err.Error() + "\n\n"))
+		return
+	}
+	if err != nil {
+		outputError(w, err)
+		return
+	}
 
-	roomRepo.UpdateWatcherCount(id, t.ID)
+	notify := hub.Subscribe(id)
+	defer hub.Unsubscribe(id, notify)
 
-	room, _ := roomRepo.Get(id)
-	watcherCount := room.WatcherCount
+	watcherCount := hub.AddWatcher(id, t.ID)
+	defer hub.RemoveWatcher(id, t.ID)
 
 	fmt.Fprintf(w, "retry:500\n\nevent:watcher_count\ndata:%d\n\n", watcherCount)
 	flusher.Flush()
 
 	var lastStrokeID int64
+	lastTombstoneID := int64(-1)
 	lastEventIDStr := r.Header.Get("Last-Event-ID")
 	if lastEventIDStr != "" {
-		lastEventID, err := strconv.ParseInt(lastEventIDStr, 10, 64)
+		lastStrokeID, lastTombstoneID, err = parseStreamEventID(lastEventIDStr)
 		if err != nil {
 			outputError(w, err)
 			return
 		}
-		lastStrokeID = lastEventID
 	}
 
-	loop := 6
-	for loop > 0 {
-		loop--
-		time.Sleep(500 * time.Millisecond)
+	missed, lastTombstoneID, err := missedTombstones(id, lastStrokeID, lastTombstoneID)
+	if err != nil {
+		log.Println("stream:", err)
+		return
+	}
+
+	// ポーリングせずに AddStroke や watcher 数の変化で起こしてもらう。
+	// watcher の期限切れ(3秒)より短い間隔で自分の watcher を更新する。
 
-		/*
-			strokes, err := getStrokes(room.ID, int64(lastStrokeID))
-			if err != nil {
-				outputError(w, err)
+	var expire <-chan time.Time
+	if streamMaxLifetime > 0 {
+		timeout := time.NewTimer(streamMaxLifetime)
+		defer timeout.Stop()
+		expire = timeout.C
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	liveSeq := int64(-1)
+	layerVersion := int64(-1)
+	for {
+		// 部屋の設定や招待、アカウントが変わって見られなくなったら閉じる
+		if v, u := acl.Version(id), t.UserID(); v != aclVersion || u != aclUserID {
+			aclVersion, aclUserID = v, u
+			if err := checkCanView(t, room); err != nil {
+				w.Write([]byte("event:access_denied\ndata:{}\n\n"))
 				return
 			}
-		*/
-		strokes := roomRepo.GetStrokes(id, int64(lastStrokeID))
+		}
+		// stroke_end が stroke より先に届かないように live イベントを先に読んでおく
+		liveEvents, newLiveSeq := hub.GetLiveEvents(id, liveSeq)
+		liveSeq = newLiveSeq
+		tombstones, err := store.GetTombstones(id, lastTombstoneID)
+		if err != nil {
+			log.Println("stream:", err)
+			return
+		}
+		tombstones = append(missed, tombstones...)
+		missed = nil
+		strokes, err := store.GetStrokes(id, lastStrokeID)
+		if err != nil {
+			log.Println("stream:", err)
+			return
+		}
 
 		for _, s := range strokes {
-			/*
-				s.Points, err = getStrokePoints(s.ID)
-				if err != nil {
-					outputError(w, err)
-					return
-				}
-			*/
 			var d []byte
 			var err error
 			if s.json != nil {
@@ -447,31 +555,48 @@ func getAPIStreamRoomsID(ctx context.Context, w http.ResponseWriter, r *http.Req
 					panic(err)
 				}
 			}
-			//printAndFlush(w, "id:"+strconv.FormatInt(s.ID, 10)+"\n\n"+"event:stroke\n"+"data:"+string(d)+"\n\n")
-			fmt.Fprintf(w, "id:%d\n\nevent:stroke\ndata:%s\n\n", s.ID, d)
 			lastStrokeID = s.ID
+			fmt.Fprintf(w, "id:%s\nevent:%s\ndata:%s\n\n", streamEventID(lastStrokeID, lastTombstoneID), s.streamEvent(), d)
 		}
-
-		newWatcherCount := roomRepo.UpdateWatcherCount(id, t.ID)
-		/*
-			err = updateRoomWatcher(room.ID, t.ID)
-			if err != nil {
-				outputError(w, err)
-				return
+		for _, ts := range tombstones {
+			d, _ := json.Marshal(ts)
+			if ts.ID > lastTombstoneID {
+				lastTombstoneID = ts.ID
 			}
-		*/
+			fmt.Fprintf(w, "id:%s\nevent:stroke_deleted\ndata:%s\n\n", streamEventID(lastStrokeID, lastTombstoneID), d)
+		}
+		for _, e := range liveEvents {
+			fmt.Fprintf(w, "event:%s\ndata:%s\n\n", e.event, e.data)
+		}
+		// 最初と、レイヤーが変わったときに全部送る
+		if v := layers.Version(id); v != layerVersion {
+			layerVersion = v
+			d, _ := json.Marshal(layers.Layers(id))
+			fmt.Fprintf(w, "event:layers\ndata:%s\n\n", d)
+		}
 
-		/*
-			if err != nil {
-				outputError(w, err)
-				return
-			}
-		*/
+		newWatcherCount := hub.GetWatcherCount(id)
 		if newWatcherCount != watcherCount {
 			watcherCount = newWatcherCount
 			w.Write([]byte("event:watcher_count\n" + "data:" + strconv.Itoa(watcherCount) + "\n\n"))
 		}
 		flusher.Flush()
+
+		select {
+		case <-notify:
+		case <-ticker.C:
+			hub.UpdateWatcherCount(id, t.ID)
+		case <-heartbeat.C:
+			w.Write([]byte(":heartbeat\n\n"))
+		case <-r.Context().Done():
+			return
+		case <-expire:
+			return
+		case <-t.revoked:
+			w.Write([]byte("event:token_revoked\ndata:{}\n\n"))
+			flusher.Flush()
+			return
+		}
 	}
 }
 
@@ -494,23 +619,6 @@ func postAPIStrokesRoomsID(ctx context.Context, w http.ResponseWriter, r *http.R
 		return
 	}
 
-	/*
-		room, err := getRoom(id)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				outputErrorMsg(w, http.StatusNotFound, "この部屋は存在しません。")
-			} else {
-				outputError(w, err)
-			}
-			return
-		}
-	*/
-	room, ok := roomRepo.Get(id)
-	if !ok {
-		outputErrorMsg(w, http.StatusNotFound, "この部屋は存在しません。")
-		return
-	}
-
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		outputError(w, err)
@@ -523,97 +631,115 @@ func postAPIStrokesRoomsID(ctx context.Context, w http.ResponseWriter, r *http.R
 		return
 	}
 
-	if postedStroke.Width == 0 || len(postedStroke.Points) == 0 {
-		outputErrorMsg(w, http.StatusBadRequest, "リクエストが正しくありません。")
+	s, err := createStroke(t, id, postedStroke)
+	if err != nil {
+		outputStrokeError(w, err)
 		return
 	}
 
-	/*
-		strokes, err := getStrokes(id, 0)
-		if err != nil {
-			outputError(w, err)
-			return
-		}
-	*/
-	strokeCount := roomRepo.GetStrokeCount(id)
-	if strokeCount == 0 {
-		if t.ID != room.ownerID {
-			outputErrorMsg(w, http.StatusBadRequest, "他人の作成した部屋に1画目を描くことはできません")
-			return
-		}
-		/*
-			query := "SELECT COUNT(*) AS cnt FROM `room_owners` WHERE `room_id` = ? AND `token_id` = ?"
-			cnt := 0
-			err = dbx.QueryRow(query, id, t.ID).Scan(&cnt)
-			if err != nil {
-				outputError(w, err)
-				return
-			}
-			if cnt == 0 {
-				outputErrorMsg(w, http.StatusBadRequest, "他人の作成した部屋に1画目を描くことはできません")
-				return
-			}
-		*/
-	}
+	b, _ := json.Marshal(struct {
+		Stroke Stroke `json:"stroke"`
+	}{Stroke: *s})
 
-	tx := dbx.MustBegin()
-	query := "INSERT INTO `strokes` (`room_id`, `width`, `red`, `green`, `blue`, `alpha`)"
-	query += " VALUES(?, ?, ?, ?, ?, ?)"
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
 
-	result := tx.MustExec(query,
-		id,
-		postedStroke.Width,
-		postedStroke.Red,
-		postedStroke.Green,
-		postedStroke.Blue,
-		postedStroke.Alpha,
-	)
-	strokeID, err := result.LastInsertId()
-	if err != nil {
+var (
+	errRoomNotFound    = errors.New("この部屋は存在しません。")
+	errInvalidStroke   = errors.New("リクエストが正しくありません。")
+	errFirstStrokeDeny = errors.New("他人の作成した部屋に1画目を描くことはできません")
+)
+
+func outputStrokeError(w http.ResponseWriter, err error) {
+	switch err {
+	case errRoomNotFound:
+		outputErrorMsg(w, http.StatusNotFound, err.Error())
+	case errInvalidStroke, errFirstStrokeDeny:
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+	case errRoomViewDeny, errRoomDrawDeny:
+		outputErrorMsg(w, http.StatusForbidden, err.Error())
+	default:
 		outputError(w, err)
-		return
 	}
+}
 
-	query = "INSERT INTO `points` (`stroke_id`, `x`, `y`) VALUES (?, ?, ?)"
-	for _, p := range postedStroke.Points {
-		tx.MustExec(query, strokeID, p.X, p.Y)
+// createStroke は POST /api/strokes/rooms/:id と WebSocket の両方から使う
+func createStroke(t *Token, roomID int64, postedStroke Stroke) (*Stroke, error) {
+	room, err := store.GetRoom(roomID)
+	if err != nil {
+		return nil, err
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		tx.Rollback()
-		outputError(w, err)
-		return
+	if postedStroke.Width == 0 || !normalizeShape(&postedStroke) || !layers.Exists(roomID, postedStroke.LayerID) {
+		return nil, errInvalidStroke
 	}
 
-	query = "SELECT `id`, `room_id`, `width`, `red`, `green`, `blue`, `alpha`, `created_at` FROM `strokes`"
-	query += " WHERE `id` = ?"
-	s := Stroke{}
-	err = dbx.Get(&s, query, strokeID)
+	err = checkCanDraw(t, room)
 	if err != nil {
-		outputError(w, err)
-		return
+		return nil, err
 	}
 
-	s.Points, err = getStrokePoints(strokeID)
+	postedStroke.AuthorTokenID = t.AuthorTokenID()
+	postedStroke.AuthorUserID = t.UserID()
+
+	s, err := store.AddStroke(roomID, postedStroke)
 	if err != nil {
-		outputError(w, err)
-		return
+		return nil, err
 	}
+	hub.Notify(roomID)
+	return s, nil
+}
 
-	roomRepo.AddStroke(id, s, s.Points)
-
-	b, _ := json.Marshal(struct {
-		Stroke Stroke `json:"stroke"`
-	}{Stroke: s})
+// checkFirstStroke は部屋の作成者以外が1画目を描こうとしていたら errFirstStrokeDeny を返す
+func checkFirstStroke(t *Token, room *Room) error {
+	if len(room.StrokesSnapshot()) > 0 {
+		return nil
+	}
+	owner, err := store.RoomOwner(room.ID)
+	if err != nil {
+		return err
+	}
+	if !isRoomOwner(t, owner) {
+		return errFirstStrokeDeny
+	}
+	return nil
+}
 
-	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write(b)
+func getEnvDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Failed to read %s from an environment variable.\nError: %s", name, err.Error())
+	}
+	return d
 }
 
 func OnStartup() {
-	roomRepo.Init()
+	start := time.Now()
+	if err := migrate(); err != nil {
+		log.Fatalf("Failed to migrate: %s", err.Error())
+	}
+	if err := store.Init(); err != nil {
+		log.Fatalf("Failed to initialize room store: %s", err.Error())
+	}
+	if err := tokens.Load(); err != nil {
+		log.Fatalf("Failed to load tokens: %s", err.Error())
+	}
+	if err := acl.Load(); err != nil {
+		log.Fatalf("Failed to load room settings: %s", err.Error())
+	}
+	if err := layers.Load(); err != nil {
+		log.Fatalf("Failed to load layers: %s", err.Error())
+	}
+	go tokens.runPurger(tokenPurgeInterval)
+	go hub.runDraftExpirer(draftExpireInterval)
+	startupStats.Set("on_startup", expvarDuration(time.Since(start)))
+	log.Printf("startup finished in %s", time.Since(start))
 }
 
 func main() {
@@ -636,6 +762,43 @@ func main() {
 	password := os.Getenv("MYSQL_PASS")
 	dbname := "isuketch"
 
+	store, err = newRoomStore(os.Getenv("ROOM_STORE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	snapshotPath = os.Getenv("SNAPSHOT_PATH")
+	snapshotInterval = getEnvDuration("SNAPSHOT_INTERVAL", snapshotInterval)
+	if snapshotInterval <= 0 {
+		log.Fatalf("SNAPSHOT_INTERVAL must be positive: %s", snapshotInterval)
+	}
+
+	if secret := os.Getenv("TOKEN_SECRET"); secret != "" {
+		tokenSecret = []byte(secret)
+	}
+	authorSecret := os.Getenv("AUTHOR_SECRET")
+	if authorSecret == "" {
+		authorSecret = os.Getenv("TOKEN_SECRET")
+	}
+	if err := setAuthorSecret(authorSecret); err != nil {
+		log.Fatal(err)
+	}
+
+	tokenPurgeInterval = getEnvDuration("TOKEN_PURGE_INTERVAL", tokenPurgeInterval)
+	if tokenPurgeInterval <= 0 {
+		log.Fatalf("TOKEN_PURGE_INTERVAL must be positive: %s", tokenPurgeInterval)
+	}
+
+	if path := os.Getenv("STROKE_JOURNAL_PATH"); path != "" {
+		strokeJournalPath = path
+	}
+
+	streamMaxLifetime = getEnvDuration("STREAM_MAX_LIFETIME", streamMaxLifetime)
+	streamHeartbeatInterval = getEnvDuration("STREAM_HEARTBEAT_INTERVAL", streamHeartbeatInterval)
+	if streamHeartbeatInterval <= 0 {
+		log.Fatalf("STREAM_HEARTBEAT_INTERVAL must be positive: %s", streamHeartbeatInterval)
+	}
+
 	dsn := fmt.Sprintf(
 		"%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=true&loc=Local&interpolateParams=true",
 		user,
@@ -666,21 +829,45 @@ func main() {
 
 	OnStartup()
 
+	log.Fatal(http.ListenAndServe(":8080", newMux()))
+}
+
+func newMux() *goji.Mux {
 	mux := goji.NewMux()
 	mux.HandleFunc(pat.Get("/startpprof"), func(w http.ResponseWriter, r *http.Request) {
 		StartProfile(time.Second * 60)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok."))
 	})
+	mux.Handle(pat.Get("/debug/vars"), expvar.Handler())
 
 	mux.HandleFunc(pat.Post("/api/csrf_token"), postAPICsrfToken)
+	mux.HandleFunc(pat.Post("/api/csrf_token/refresh"), postAPICsrfTokenRefresh)
+	mux.HandleFunc(pat.Post("/api/csrf_token/revoke"), postAPICsrfTokenRevoke)
+	mux.HandleFuncC(pat.Put("/api/rooms/:id/settings"), putAPIRoomsIDSettings)
+	mux.HandleFuncC(pat.Post("/api/rooms/:id/invites"), postAPIRoomsIDInvites)
+	mux.HandleFuncC(pat.Delete("/api/rooms/:id/invites/:invite_token"), deleteAPIRoomsIDInvitesToken)
+	mux.HandleFuncC(pat.Post("/api/rooms/:id/layers"), postAPIRoomsIDLayers)
+	mux.HandleFuncC(pat.Put("/api/rooms/:id/layers/:layer_id"), putAPIRoomsIDLayersID)
+	mux.HandleFuncC(pat.Post("/api/invites/:invite_token"), postAPIInvitesToken)
+	mux.HandleFunc(pat.Post("/api/users/register"), postAPIUsersRegister)
+	mux.HandleFunc(pat.Post("/api/users/login"), postAPIUsersLogin)
+	mux.HandleFunc(pat.Post("/api/users/logout"), postAPIUsersLogout)
 	mux.HandleFunc(pat.Get("/api/rooms"), getAPIRooms)
 	mux.HandleFunc(pat.Post("/api/rooms"), postAPIRooms)
 	mux.HandleFuncC(pat.Get("/api/rooms/:id"), getAPIRoomsID)
+	mux.HandleFuncC(pat.Get("/api/rooms/:id/strokes"), getAPIRoomsIDStrokes)
 	mux.HandleFuncC(pat.Get("/api/stream/rooms/:id"), getAPIStreamRoomsID)
 	mux.HandleFuncC(pat.Post("/api/strokes/rooms/:id"), postAPIStrokesRoomsID)
+	mux.HandleFuncC(pat.Post("/api/strokes/rooms/:id/drafts"), postAPIStrokesRoomsIDDrafts)
+	mux.HandleFuncC(pat.Post("/api/strokes/rooms/:id/drafts/:draft_id/points"), postAPIStrokesRoomsIDDraftsPoints)
+	mux.HandleFuncC(pat.Post("/api/strokes/rooms/:id/drafts/:draft_id/end"), postAPIStrokesRoomsIDDraftsEnd)
+	mux.HandleFuncC(pat.Post("/api/strokes/rooms/:id/drafts/:draft_id/cancel"), postAPIStrokesRoomsIDDraftsCancel)
+	mux.HandleFuncC(pat.Delete("/api/strokes/rooms/:id/:stroke_id"), deleteAPIStrokesRoomsIDStrokeID)
+	mux.HandleFuncC(pat.Post("/api/strokes/rooms/:id/undo"), postAPIStrokesRoomsIDUndo)
+	mux.HandleFuncC(pat.Get("/api/ws/rooms/:id"), getAPIWSRoomsID)
 
 	mux.HandleFuncC(pat.Get("/img/:id"), getRoomImageID)
-
-	log.Fatal(http.ListenAndServe(":8080", mux))
+	mux.HandleFuncC(pat.Get("/img/:id/thumb"), getRoomThumbnail)
+	return mux
 }
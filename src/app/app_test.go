@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ハンドラのテストは ROOM_STORE=memory と同じ memRoomStore で動かし、MySQL を使わない
+
+// recordDriver で作ったトークンの ID と重ならないように大きい値から振る
+var lastTestTokenID int64 = 1 << 32
+
+func newTestServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(newTestMux())
+}
+
+// newTestMux は部屋やトークンを空にして、テストのサーバーで使う mux を作る
+func newTestMux() http.Handler {
+	roomRepo = NewRoomRepo()
+	store = &memRoomStore{repo: roomRepo}
+	hub = newRoomHub()
+	tokens = newTokenRegistry()
+	acl = newRoomACL()
+	layers = newLayerRegistry()
+
+	return newMux()
+}
+
+// newTestToken は MySQL に書かずにトークンをメモリに入れる
+func newTestToken() *Token {
+	return newTestTokenAt(time.Now())
+}
+
+func newTestTokenAt(createdAt time.Time) *Token {
+	tk := &Token{
+		ID:        atomic.AddInt64(&lastTestTokenID, 1),
+		CreatedAt: createdAt,
+		revoked:   make(chan struct{}),
+	}
+	tk.CSRFToken = fmt.Sprintf("test-token-%d", tk.ID)
+	tokens.mu.Lock()
+	tokens.tokens[tk.CSRFToken] = tk
+	tokens.byID[tk.ID] = tk
+	tokens.mu.Unlock()
+	return tk
+}
+
+func doRequest(t *testing.T, method string, url string, tk *Token, body interface{}) (int, []byte) {
+	var r *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	} else {
+		r = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk != nil {
+		req.Header.Set("x-csrf-token", tk.CSRFToken)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, b
+}
+
+func createTestRoom(t *testing.T, ts *httptest.Server, tk *Token) *Room {
+	code, b := doRequest(t, "POST", ts.URL+"/api/rooms", tk, map[string]interface{}{
+		"name":          "test",
+		"canvas_width":  100,
+		"canvas_height": 100,
+	})
+	if code != http.StatusOK {
+		t.Fatalf("POST /api/rooms: %d %s", code, b)
+	}
+	var res struct {
+		Room *Room `json:"room"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Room
+}
+
+func testStrokeBody() map[string]interface{} {
+	return map[string]interface{}{
+		"width": 4, "red": 0, "green": 0, "blue": 0, "alpha": 1,
+		"points": []Point{{X: 1, Y: 1}, {X: 10, Y: 10}},
+	}
+}
+
+func TestPostRoomAndStrokes(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	tk := newTestToken()
+	room := createTestRoom(t, ts, tk)
+
+	code, b := doRequest(t, "POST", fmt.Sprintf("%s/api/strokes/rooms/%d", ts.URL, room.ID), tk, testStrokeBody())
+	if code != http.StatusOK {
+		t.Fatalf("POST stroke: %d %s", code, b)
+	}
+	var posted struct {
+		Stroke Stroke `json:"stroke"`
+	}
+	if err := json.Unmarshal(b, &posted); err != nil {
+		t.Fatal(err)
+	}
+	if posted.Stroke.ID == 0 || len(posted.Stroke.Points) != 2 {
+		t.Fatalf("unexpected stroke: %s", b)
+	}
+
+	code, b = doRequest(t, "GET", fmt.Sprintf("%s/api/rooms/%d", ts.URL, room.ID), tk, nil)
+	if code != http.StatusOK {
+		t.Fatalf("GET room: %d %s", code, b)
+	}
+	var got struct {
+		Room Room `json:"room"`
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Room.StrokeCount != 1 || got.Room.Strokes[0].ID != posted.Stroke.ID {
+		t.Fatalf("unexpected room: %s", b)
+	}
+
+	code, b = doRequest(t, "GET", ts.URL+"/api/rooms", nil, nil)
+	if code != http.StatusOK || !strings.Contains(string(b), fmt.Sprintf(`"id":%d,`, room.ID)) {
+		t.Fatalf("GET /api/rooms: %d %s", code, b)
+	}
+}
+
+func TestPostStrokeErrors(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	tk := newTestToken()
+	room := createTestRoom(t, ts, tk)
+
+	tests := []struct {
+		name string
+		url  string
+		tk   *Token
+		body map[string]interface{}
+		want int
+	}{
+		{"no token", fmt.Sprintf("/api/strokes/rooms/%d", room.ID), nil, testStrokeBody(), http.StatusBadRequest},
+		{"unknown room", "/api/strokes/rooms/999", tk, testStrokeBody(), http.StatusNotFound},
+		{"no points", fmt.Sprintf("/api/strokes/rooms/%d", room.ID), tk, map[string]interface{}{"width": 4}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		code, b := doRequest(t, "POST", ts.URL+tt.url, tt.tk, tt.body)
+		if code != tt.want {
+			t.Errorf("%s: got %d %s, want %d", tt.name, code, b, tt.want)
+		}
+	}
+
+	code, _ := doRequest(t, "GET", ts.URL+"/api/rooms/999", tk, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("GET unknown room: got %d", code)
+	}
+}
+
+func TestStreamRoom(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	tk := newTestToken()
+	room := createTestRoom(t, ts, tk)
+
+	res, err := http.Get(fmt.Sprintf("%s/api/stream/rooms/%d?csrf_token=%s", ts.URL, room.ID, tk.CSRFToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type: %q", ct)
+	}
+
+	events := make(chan string, 16)
+	go func() {
+		defer close(events)
+		sc := bufio.NewScanner(res.Body)
+		for sc.Scan() {
+			if strings.HasPrefix(sc.Text(), "event:") {
+				events <- strings.TrimPrefix(sc.Text(), "event:")
+			}
+		}
+	}()
+
+	waitEvent := func(name string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					t.Fatalf("stream closed before %s", name)
+				}
+				if ev == name {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for %s", name)
+			}
+		}
+	}
+
+	waitEvent("watcher_count")
+	code, b := doRequest(t, "POST", fmt.Sprintf("%s/api/strokes/rooms/%d", ts.URL, room.ID), tk, testStrokeBody())
+	if code != http.StatusOK {
+		t.Fatalf("POST stroke: %d %s", code, b)
+	}
+	waitEvent("stroke")
+}
+
+// TestStreamClosedOnTokenExpiry は STREAM_MAX_LIFETIME=0 でも、期限切れのトークンを
+// Purge したらそのトークンのストリームが閉じることを確かめる
+func TestStreamClosedOnTokenExpiry(t *testing.T) {
+	defer useTestDB(t)()
+	ts := newTestServer(t)
+	defer ts.Close()
+	prev := streamMaxLifetime
+	streamMaxLifetime = 0
+	defer func() { streamMaxLifetime = prev }()
+
+	owner := newTestToken()
+	room := createTestRoom(t, ts, owner)
+
+	// 期限の少し前に作ったことにして、ストリームを開いた後に期限を切らす
+	tk := newTestTokenAt(time.Now().Add(-tokenTTL + 500*time.Millisecond))
+
+	res, err := http.Get(fmt.Sprintf("%s/api/stream/rooms/%d?csrf_token=%s", ts.URL, room.ID, tk.CSRFToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET stream: %d", res.StatusCode)
+	}
+
+	time.Sleep(time.Second)
+	if err := tokens.Purge(); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan bool, 1)
+	go func() {
+		revoked := false
+		sc := bufio.NewScanner(res.Body)
+		for sc.Scan() {
+			if sc.Text() == "event:token_revoked" {
+				revoked = true
+			}
+		}
+		closed <- revoked
+	}()
+	select {
+	case revoked := <-closed:
+		if !revoked {
+			t.Error("stream closed without token_revoked")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream is still open after the token was purged")
+	}
+}
+
+// TestStreamLifetimeAndHeartbeat はストリームが STREAM_MAX_LIFETIME で閉じることと、
+// それまでの間にハートビートを送ることを確かめる
+func TestStreamLifetimeAndHeartbeat(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	prevLifetime, prevHeartbeat := streamMaxLifetime, streamHeartbeatInterval
+	streamMaxLifetime = 500 * time.Millisecond
+	streamHeartbeatInterval = 50 * time.Millisecond
+	defer func() { streamMaxLifetime, streamHeartbeatInterval = prevLifetime, prevHeartbeat }()
+
+	tk := newTestToken()
+	room := createTestRoom(t, ts, tk)
+
+	start := time.Now()
+	res, err := http.Get(fmt.Sprintf("%s/api/stream/rooms/%d?csrf_token=%s", ts.URL, room.ID, tk.CSRFToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	closed := make(chan int, 1)
+	go func() {
+		heartbeats := 0
+		sc := bufio.NewScanner(res.Body)
+		for sc.Scan() {
+			if sc.Text() == ":heartbeat" {
+				heartbeats++
+			}
+		}
+		closed <- heartbeats
+	}()
+	select {
+	case heartbeats := <-closed:
+		if elapsed := time.Since(start); elapsed < streamMaxLifetime {
+			t.Errorf("stream closed after %s, before the lifetime", elapsed)
+		}
+		if heartbeats == 0 {
+			t.Error("no heartbeat is sent")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream is still open after the lifetime")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"goji.io/pat"
+	"golang.org/x/net/context"
+)
+
+// ストロークの JSON には描いた人をトークン ID やアカウント ID のままではなく、
+// それらから作った author ハンドルで出す。アカウントに紐付いていれば
+// トークンが変わっても同じハンドルになる。
+
+// ハンドルを作る鍵。AUTHOR_SECRET か TOKEN_SECRET から作り、無ければ起動ごとに乱数で作る
+var authorSecret []byte
+
+func authorHandle(tokenID int64, userID int64) string {
+	if tokenID == 0 && userID == 0 {
+		return ""
+	}
+	var payload string
+	if userID != 0 {
+		payload = "u:" + strconv.FormatInt(userID, 10)
+	} else {
+		payload = "t:" + strconv.FormatInt(tokenID, 10)
+	}
+	mac := hmac.New(sha256.New, authorSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// setAuthor は JSON にする前に AuthorTokenID と AuthorUserID から Author を埋める
+func (s *Stroke) setAuthor() {
+	s.Author = authorHandle(s.AuthorTokenID, s.AuthorUserID)
+}
+
+// authorKeyID は鍵を見せずに、ハンドルを作った鍵が同じかどうかを比べるための値を返す
+func authorKeyID() string {
+	mac := hmac.New(sha256.New, authorSecret)
+	mac.Write([]byte("key-id"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:12])
+}
+
+func setAuthorSecret(secret string) error {
+	if secret != "" {
+		authorSecret = []byte(secret)
+		return nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	authorSecret = b
+	log.Println("[warn] AUTHOR_SECRET is not set; author handles change on restart")
+	return nil
+}
+
+// getAPIRoomsIDStrokes は部屋のストロークを返す。author を指定するとその人のものだけにする
+func getAPIRoomsIDStrokes(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(pat.Param(ctx, "id"), 10, 64)
+	if err != nil {
+		outputErrorMsg(w, http.StatusNotFound, "この部屋は存在しません。")
+		return
+	}
+	var greaterThanID int64
+	if s := r.URL.Query().Get("greater_than_id"); s != "" {
+		greaterThanID, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			outputErrorMsg(w, http.StatusBadRequest, "リクエストが正しくありません。")
+			return
+		}
+	}
+	author := r.URL.Query().Get("author")
+
+	room, err := store.GetRoom(id)
+	if err != nil {
+		outputAccessError(w, err)
+		return
+	}
+	t, err := viewerToken(r)
+	if err == nil {
+		err = checkCanView(t, room)
+	}
+	if err != nil {
+		outputAccessError(w, err)
+		return
+	}
+
+	strokes, err := store.GetStrokes(id, greaterThanID)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	if author != "" {
+		filtered := []Stroke{}
+		for _, s := range strokes {
+			if s.Author == author {
+				filtered = append(filtered, s)
+			}
+		}
+		strokes = filtered
+	}
+
+	b, _ := json.Marshal(struct {
+		Strokes []Stroke `json:"strokes"`
+	}{Strokes: strokes})
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
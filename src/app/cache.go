@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 部屋の画像と JSON は、最後のストロークの ID と部屋を最後に変えた時刻から ETag を作り、
+// 画像は最後のストロークの CreatedAt を Last-Modified にして、CDN やブラウザが 304 で確かめ直せるようにする。
+// ストロークを足すだけなら最後の ID が変わる。削除やレイヤーや設定の変更のように
+// ID が変わらない変更は touch で changedAt を進める。
+// changedAt はメモリにしか無いので、再起動した後は serverStartedAt より前の ETag と
+// Last-Modified は使わない。
+
+// 部屋の画像と JSON を確かめ直さずに使ってよい秒数。描いている最中の部屋が多いので 0 にする
+const roomMaxAge = 0
+
+var serverStartedAt = time.Now()
+
+// touch は最後のストロークの ID が変わらずに部屋の中身が変わったときに呼ぶ
+func (room *Room) touch() {
+	atomic.StoreInt64(&room.changedAt, time.Now().UnixNano())
+}
+
+// roomValidators は ETag の元になる文字列と Last-Modified を返す
+func roomValidators(room *Room) (string, time.Time) {
+	modTime := serverStartedAt
+	var lastID int64
+	if strokes := room.StrokesSnapshot(); len(strokes) > 0 {
+		s := strokes[len(strokes)-1]
+		lastID = s.ID
+		if s.CreatedAt.After(modTime) {
+			modTime = s.CreatedAt
+		}
+	}
+	changedAt := serverStartedAt.UnixNano()
+	if c := atomic.LoadInt64(&room.changedAt); c > changedAt {
+		changedAt = c
+		if t := time.Unix(0, c); t.After(modTime) {
+			modTime = t
+		}
+	}
+	return fmt.Sprintf("%d-%d-%d", room.ID, lastID, changedAt), modTime
+}
+
+// roomCacheControl は公開の部屋なら CDN にも置けるようにする
+func roomCacheControl(room *Room, maxAge int) string {
+	if acl.Settings(room.ID).Visibility == visibilityPublic {
+		return fmt.Sprintf("public, max-age=%d", maxAge)
+	}
+	return fmt.Sprintf("private, max-age=%d", maxAge)
+}
+
+// checkNotModified は Cache-Control と ETag と Last-Modified を付け、
+// 条件付きの GET で変わっていなければ 304 を返して true を返す。
+// modTime が 0 なら Last-Modified は付けない。
+// Last-Modified は秒までしか無いので、modTime と同じ秒のうちは付けない。
+// 付けると、その秒のうちに後から変わっても If-Modified-Since で 304 になってしまう
+func checkNotModified(w http.ResponseWriter, r *http.Request, cacheControl string, etag string, modTime time.Time) bool {
+	if !modTime.IsZero() && time.Now().Before(modTime.Truncate(time.Second).Add(time.Second)) {
+		modTime = time.Time{}
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	// If-None-Match があれば If-Modified-Since は見ない
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatch(inm, etag) {
+			return false
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modTime.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err != nil || modTime.Truncate(time.Second).After(t) {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	// 304 では中身のヘッダは送らない
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatch は If-None-Match のどれかが etag と弱い比較で一致するかを返す
+func etagMatch(header string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
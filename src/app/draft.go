@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"goji.io/pat"
+	"golang.org/x/net/context"
+)
+
+// 描いている途中のストローク (draft) の点を watcher に流す。
+// draft は DB には保存せず、end したときに普通のストロークとして作成する。
+//
+// ストリームには id を付けずに以下のイベントを流す。
+//   stroke_begin  {"draft_id":1,"layer_id":..,"width":..,"red":..,"green":..,"blue":..,"alpha":..,"points":[..]}
+//   stroke_points {"draft_id":1,"points":[..]}
+//   stroke_end    {"draft_id":1,"stroke_id":123} (stroke イベントの後に流れる)
+//   stroke_cancel {"draft_id":1}
+
+const (
+	// これより古い live イベントは捨てる。遅れたクライアントは途中の点を取りこぼすが
+	// 完成したストロークは stroke イベントで届く
+	liveEventBufferSize = 256
+	draftIdleTimeout    = 30 * time.Second
+	// 放置された draft を捨てる間隔
+	draftExpireInterval = 10 * time.Second
+	// 1つの draft に溜められる点の数
+	maxDraftPoints = 10000
+	// 1つのトークンが部屋や接続をまたいで同時に描ける draft の数
+	maxDraftsPerToken = 8
+)
+
+var (
+	errDraftNotFound = errors.New("描画中のストロークが見つかりません。")
+	errDraftTooLong  = errors.New("描画中のストロークの点が多すぎます。")
+	errTooManyDrafts = errors.New("描画中のストロークが多すぎます。")
+)
+
+type strokeDraft struct {
+	ID        int64
+	tokenID   int64
+	stroke    Stroke
+	updatedAt time.Time
+}
+
+type liveEvent struct {
+	seq   int64
+	event string
+	data  []byte
+}
+
+type draftEvent struct {
+	DraftID  int64   `json:"draft_id"`
+	Points   []Point `json:"points,omitempty"`
+	StrokeID int64   `json:"stroke_id,omitempty"`
+}
+
+// draftBeginEvent は黒や太さ 0 も区別できるように omitempty を付けない
+type draftBeginEvent struct {
+	DraftID int64   `json:"draft_id"`
+	LayerID int64   `json:"layer_id"`
+	Width   int     `json:"width"`
+	Red     int     `json:"red"`
+	Green   int     `json:"green"`
+	Blue    int     `json:"blue"`
+	Alpha   float64 `json:"alpha"`
+	Points  []Point `json:"points"`
+}
+
+// publishLive は liveRoom.mu を取った状態で呼ぶ。ev は draftEvent か draftBeginEvent
+func (lr *liveRoom) publishLive(event string, ev interface{}) {
+	d, err := json.Marshal(ev)
+	if err != nil {
+		panic(err)
+	}
+	lr.liveSeq++
+	lr.liveEvents = append(lr.liveEvents, liveEvent{seq: lr.liveSeq, event: event, data: d})
+	if len(lr.liveEvents) > liveEventBufferSize {
+		n := copy(lr.liveEvents, lr.liveEvents[len(lr.liveEvents)-liveEventBufferSize:])
+		lr.liveEvents = lr.liveEvents[:n]
+	}
+	lr.notify()
+}
+
+func beginEvent(d *strokeDraft) draftBeginEvent {
+	return draftBeginEvent{
+		DraftID: d.ID,
+		LayerID: d.stroke.LayerID,
+		Width:   d.stroke.Width,
+		Red:     d.stroke.Red,
+		Green:   d.stroke.Green,
+		Blue:    d.stroke.Blue,
+		Alpha:   d.stroke.Alpha,
+		Points:  d.stroke.Points,
+	}
+}
+
+// expireDrafts は liveRoom.mu を取った状態で呼ぶ
+func (h *roomHub) expireDrafts(lr *liveRoom) {
+	for id, d := range lr.drafts {
+		if time.Since(d.updatedAt) >= draftIdleTimeout {
+			h.removeDraft(lr, d)
+			lr.publishLive("stroke_cancel", draftEvent{DraftID: id})
+		}
+	}
+}
+
+// removeDraft は draft を部屋から取り除いて、トークンの draft の数を減らす。
+// liveRoom.mu を取った状態で呼ぶ
+func (h *roomHub) removeDraft(lr *liveRoom, d *strokeDraft) {
+	delete(lr.drafts, d.ID)
+	h.draftMu.Lock()
+	if h.draftsByToken[d.tokenID]--; h.draftsByToken[d.tokenID] <= 0 {
+		delete(h.draftsByToken, d.tokenID)
+	}
+	h.draftMu.Unlock()
+}
+
+// runDraftExpirer は draft の来なくなった部屋にも放置された draft が残らないように、定期的に捨てる
+func (h *roomHub) runDraftExpirer(interval time.Duration) {
+	for range time.Tick(interval) {
+		h.mu.RLock()
+		rooms := make([]*liveRoom, 0, len(h.rooms))
+		for _, lr := range h.rooms {
+			rooms = append(rooms, lr)
+		}
+		h.mu.RUnlock()
+
+		for _, lr := range rooms {
+			lr.mu.Lock()
+			h.expireDrafts(lr)
+			lr.mu.Unlock()
+		}
+	}
+}
+
+// BeginDraft は部屋が存在して描いてよいかを呼ぶ側で確認しておくこと
+func (h *roomHub) BeginDraft(roomID int64, tokenID int64, s Stroke) (int64, error) {
+	if len(s.Points) > maxDraftPoints {
+		return 0, errDraftTooLong
+	}
+	lr := h.room(roomID)
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	h.expireDrafts(lr)
+
+	h.draftMu.Lock()
+	if h.draftsByToken[tokenID] >= maxDraftsPerToken {
+		h.draftMu.Unlock()
+		return 0, errTooManyDrafts
+	}
+	h.draftsByToken[tokenID]++
+	h.draftMu.Unlock()
+
+	draftID := atomic.AddInt64(&h.lastDraftID, 1)
+	if s.Points == nil {
+		s.Points = []Point{}
+	}
+	d := &strokeDraft{
+		ID:        draftID,
+		tokenID:   tokenID,
+		stroke:    s,
+		updatedAt: time.Now(),
+	}
+	lr.drafts[d.ID] = d
+	lr.publishLive("stroke_begin", beginEvent(d))
+	return d.ID, nil
+}
+
+func (h *roomHub) AppendDraft(roomID int64, draftID int64, tokenID int64, points []Point) error {
+	lr, ok := h.get(roomID)
+	if !ok {
+		return errDraftNotFound
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	h.expireDrafts(lr)
+	d, ok := lr.drafts[draftID]
+	if !ok || d.tokenID != tokenID {
+		return errDraftNotFound
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	if len(d.stroke.Points)+len(points) > maxDraftPoints {
+		return errDraftTooLong
+	}
+	d.stroke.Points = append(d.stroke.Points, points...)
+	d.updatedAt = time.Now()
+	lr.publishLive("stroke_points", draftEvent{DraftID: draftID, Points: points})
+	return nil
+}
+
+// TakeDraft は draft を取り除いて、作成すべきストロークを返す。
+// 作成できたら FinishDraft、失敗したら CancelDraft を呼ぶ。
+func (h *roomHub) TakeDraft(roomID int64, draftID int64, tokenID int64) (Stroke, error) {
+	lr, ok := h.get(roomID)
+	if !ok {
+		return Stroke{}, errDraftNotFound
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	d, ok := lr.drafts[draftID]
+	if !ok || d.tokenID != tokenID {
+		return Stroke{}, errDraftNotFound
+	}
+	h.removeDraft(lr, d)
+	return d.stroke, nil
+}
+
+func (h *roomHub) FinishDraft(roomID int64, draftID int64, strokeID int64) {
+	lr, ok := h.get(roomID)
+	if !ok {
+		return
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	lr.publishLive("stroke_end", draftEvent{DraftID: draftID, StrokeID: strokeID})
+}
+
+func (h *roomHub) CancelDraft(roomID int64, draftID int64) {
+	lr, ok := h.get(roomID)
+	if !ok {
+		return
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	if d, ok := lr.drafts[draftID]; ok {
+		h.removeDraft(lr, d)
+	}
+	lr.publishLive("stroke_cancel", draftEvent{DraftID: draftID})
+}
+
+// GetLiveEvents は afterSeq より後の live イベントと最新の seq を返す。
+// afterSeq が負のときは、今描かれている draft を stroke_begin として返す。
+func (h *roomHub) GetLiveEvents(roomID int64, afterSeq int64) ([]liveEvent, int64) {
+	lr, ok := h.get(roomID)
+	if !ok {
+		return nil, afterSeq
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	if afterSeq < 0 {
+		var events []liveEvent
+		for _, d := range lr.drafts {
+			data, err := json.Marshal(beginEvent(d))
+			if err != nil {
+				panic(err)
+			}
+			events = append(events, liveEvent{seq: lr.liveSeq, event: "stroke_begin", data: data})
+		}
+		return events, lr.liveSeq
+	}
+
+	for i, e := range lr.liveEvents {
+		if e.seq > afterSeq {
+			events := make([]liveEvent, len(lr.liveEvents)-i)
+			copy(events, lr.liveEvents[i:])
+			return events, lr.liveSeq
+		}
+	}
+	return nil, lr.liveSeq
+}
+
+// finishDraft は draft から普通のストロークを作成して stroke_end を流す
+func finishDraft(t *Token, roomID int64, draftID int64) (*Stroke, error) {
+	postedStroke, err := hub.TakeDraft(roomID, draftID, t.ID)
+	if err != nil {
+		return nil, err
+	}
+	s, err := createStroke(t, roomID, postedStroke)
+	if err != nil {
+		hub.CancelDraft(roomID, draftID)
+		return nil, err
+	}
+	hub.FinishDraft(roomID, draftID, s.ID)
+	return s, nil
+}
+
+func outputDraftError(w http.ResponseWriter, err error) {
+	switch err {
+	case errDraftNotFound:
+		outputErrorMsg(w, http.StatusNotFound, err.Error())
+		return
+	case errDraftTooLong:
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+		return
+	case errTooManyDrafts:
+		outputErrorMsg(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	outputStrokeError(w, err)
+}
+
+// parseDraftRequest は draft 系と削除のエンドポイントで共通のトークンと部屋IDを読む
+func parseDraftRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) (*Token, int64, bool) {
+	t, err := checkToken(r.Header.Get("x-csrf-token"))
+	if err != nil {
+		outputError(w, err)
+		return nil, 0, false
+	}
+	if t == nil {
+		outputErrorMsg(w, http.StatusBadRequest, "トークンエラー。ページを再読み込みしてください。")
+		return nil, 0, false
+	}
+
+	id, err := strconv.ParseInt(pat.Param(ctx, "id"), 10, 64)
+	if err != nil {
+		outputErrorMsg(w, http.StatusNotFound, "この部屋は存在しません。")
+		return nil, 0, false
+	}
+	return t, id, true
+}
+
+func draftIDParam(ctx context.Context, w http.ResponseWriter) (int64, bool) {
+	draftID, err := strconv.ParseInt(pat.Param(ctx, "draft_id"), 10, 64)
+	if err != nil {
+		outputErrorMsg(w, http.StatusNotFound, errDraftNotFound.Error())
+		return 0, false
+	}
+	return draftID, true
+}
+
+func postAPIStrokesRoomsIDDrafts(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	t, id, ok := parseDraftRequest(ctx, w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	postedStroke := Stroke{}
+	err = json.Unmarshal(body, &postedStroke)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	if postedStroke.Width == 0 || !isDraftable(&postedStroke) || !layers.Exists(id, postedStroke.LayerID) {
+		outputErrorMsg(w, http.StatusBadRequest, errInvalidStroke.Error())
+		return
+	}
+
+	room, err := store.GetRoom(id)
+	if err == nil {
+		err = checkCanDraw(t, room)
+	}
+	if err != nil {
+		outputDraftError(w, err)
+		return
+	}
+	draftID, err := hub.BeginDraft(id, t.ID, postedStroke)
+	if err != nil {
+		outputDraftError(w, err)
+		return
+	}
+
+	b, _ := json.Marshal(struct {
+		DraftID int64 `json:"draft_id"`
+	}{DraftID: draftID})
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func postAPIStrokesRoomsIDDraftsPoints(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	t, id, ok := parseDraftRequest(ctx, w, r)
+	if !ok {
+		return
+	}
+	draftID, ok := draftIDParam(ctx, w)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	posted := struct {
+		Points []Point `json:"points"`
+	}{}
+	err = json.Unmarshal(body, &posted)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+
+	err = hub.AppendDraft(id, draftID, t.ID, posted.Points)
+	if err != nil {
+		outputDraftError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}"))
+}
+
+func postAPIStrokesRoomsIDDraftsEnd(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	t, id, ok := parseDraftRequest(ctx, w, r)
+	if !ok {
+		return
+	}
+	draftID, ok := draftIDParam(ctx, w)
+	if !ok {
+		return
+	}
+
+	s, err := finishDraft(t, id, draftID)
+	if err != nil {
+		outputDraftError(w, err)
+		return
+	}
+
+	b, _ := json.Marshal(struct {
+		Stroke Stroke `json:"stroke"`
+	}{Stroke: *s})
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func postAPIStrokesRoomsIDDraftsCancel(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	t, id, ok := parseDraftRequest(ctx, w, r)
+	if !ok {
+		return
+	}
+	draftID, ok := draftIDParam(ctx, w)
+	if !ok {
+		return
+	}
+
+	if _, err := hub.TakeDraft(id, draftID, t.ID); err != nil {
+		outputDraftError(w, err)
+		return
+	}
+	hub.CancelDraft(id, draftID)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}"))
+}
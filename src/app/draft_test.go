@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAppendDraftLimit(t *testing.T) {
+	h := newRoomHub()
+	draftID, err := h.BeginDraft(1, 1, Stroke{Width: 4, Points: make([]Point, maxDraftPoints-1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AppendDraft(1, draftID, 1, []Point{{X: 1, Y: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AppendDraft(1, draftID, 1, []Point{{X: 2, Y: 2}}); err != errDraftTooLong {
+		t.Fatalf("append past %d points: %v", maxDraftPoints, err)
+	}
+	if _, err := h.BeginDraft(1, 1, Stroke{Width: 4, Points: make([]Point, maxDraftPoints+1)}); err != errDraftTooLong {
+		t.Fatalf("begin with %d points: %v", maxDraftPoints+1, err)
+	}
+}
+
+// TestAppendDraftExpires は放置された draft が他の draft への追記で捨てられることを確かめる
+func TestAppendDraftExpires(t *testing.T) {
+	h := newRoomHub()
+	idle, _ := h.BeginDraft(1, 1, Stroke{Width: 4})
+	active, _ := h.BeginDraft(1, 2, Stroke{Width: 4})
+
+	lr, _ := h.get(1)
+	lr.mu.Lock()
+	lr.drafts[idle].updatedAt = time.Now().Add(-draftIdleTimeout)
+	lr.mu.Unlock()
+
+	if err := h.AppendDraft(1, active, 2, []Point{{X: 1, Y: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AppendDraft(1, idle, 1, []Point{{X: 1, Y: 1}}); err != errDraftNotFound {
+		t.Fatalf("idle draft: %v", err)
+	}
+}
+
+// TestBeginDraftPerTokenLimit は1つのトークンが部屋をまたいで開ける draft の数に上限があり、
+// 終えたり捨てたりした draft の分はまた開けることを確かめる
+func TestBeginDraftPerTokenLimit(t *testing.T) {
+	h := newRoomHub()
+	drafts := []int64{}
+	for i := 0; i < maxDraftsPerToken; i++ {
+		draftID, err := h.BeginDraft(int64(i%2+1), 1, Stroke{Width: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		drafts = append(drafts, draftID)
+	}
+	if _, err := h.BeginDraft(3, 1, Stroke{Width: 4}); err != errTooManyDrafts {
+		t.Fatalf("begin draft %d: %v", maxDraftsPerToken+1, err)
+	}
+	if _, err := h.BeginDraft(3, 2, Stroke{Width: 4}); err != nil {
+		t.Fatalf("other token: %v", err)
+	}
+
+	if _, err := h.TakeDraft(1, drafts[0], 1); err != nil {
+		t.Fatal(err)
+	}
+	h.CancelDraft(1, drafts[0])
+	h.CancelDraft(2, drafts[1])
+	lr, _ := h.get(1)
+	lr.mu.Lock()
+	lr.drafts[drafts[2]].updatedAt = time.Now().Add(-draftIdleTimeout)
+	lr.mu.Unlock()
+
+	// 取り出したもの、捨てたもの、放置して期限が切れたものの3つ分開ける
+	for i := 0; i < 3; i++ {
+		if _, err := h.BeginDraft(1, 1, Stroke{Width: 4}); err != nil {
+			t.Fatalf("begin after releasing %d drafts: %v", i+1, err)
+		}
+	}
+	if _, err := h.BeginDraft(1, 1, Stroke{Width: 4}); err != errTooManyDrafts {
+		t.Fatalf("begin past the limit again: %v", err)
+	}
+}
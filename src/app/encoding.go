@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+)
+
+// 画像は Accept-Encoding を見て br, gzip, identity の順に選ぶ。
+// 圧縮したものは部屋ごと encoding ごとにキャッシュする。
+// 部屋の SVG の gzip だけは全体を圧縮し直さずに、gzipseg.go のブロックを繋げて作る。
+
+const (
+	encodingIdentity = "identity"
+	encodingGzip     = "gzip"
+	encodingBrotli   = "br"
+
+	brotliLevel = 5
+)
+
+var errNotAcceptableEncoding = errors.New("Accept-Encoding で受け取れる形式がありません。")
+
+// negotiateEncoding は Accept-Encoding から offered のうち使う encoding を前から順に選ぶ。q=0 のものは使わない。
+// identity は断られていなければ使う。identity も断られていて使えるものが無ければ false を返す
+func negotiateEncoding(header string, offered ...string) (string, bool) {
+	accepted := map[string]bool{}
+	wildcard, wildcardListed := false, false
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name == "*" {
+			wildcard, wildcardListed = q > 0, true
+			continue
+		}
+		accepted[name] = q > 0
+	}
+
+	for _, enc := range offered {
+		if ok, listed := accepted[enc]; ok || (!listed && wildcard) {
+			return enc, true
+		}
+	}
+	// identity は書かれていなければ使ってよいが、*;q=0 なら書かれていない限り使えない
+	if ok, listed := accepted[encodingIdentity]; ok || (!listed && (wildcard || !wildcardListed)) {
+		return encodingIdentity, true
+	}
+	return "", false
+}
+
+// encodeBody は src を encoding で圧縮する
+func encodeBody(src []byte, encoding string) []byte {
+	switch encoding {
+	case encodingGzip:
+		return compress(src)
+	case encodingBrotli:
+		buf := &bytes.Buffer{}
+		w := brotli.NewWriterLevel(buf, brotliLevel)
+		w.Write(src)
+		w.Close()
+		return buf.Bytes()
+	}
+	return src
+}
+
+func compress(src []byte) []byte {
+	buf := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(buf, 7)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(src)
+	w.Close()
+	return buf.Bytes()
+}
+
+// writeEncoded は encoding と長さのヘッダを付けて b を書く
+func writeEncoded(w http.ResponseWriter, b []byte, encoding string) {
+	if encoding != encodingIdentity {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+)
+
+// SVG の gzip は、ストロークを足すたびに全体を圧縮し直さないように、
+// レイヤーごとに deflate のブロックを継ぎ足しておき、頼まれたときに
+// ヘッダや <g> のタグの分と並べて1つの gzip にする。
+//
+// 足すストロークは sync flush で区切った deflate のブロックにする。
+// 区切りごとにバイト境界で終わり、最後のブロックの印も付かないので、そのまま繋げられる。
+// 前のストロークを参照できるように、レイヤーの直前の svgDictSize バイトを辞書にして圧縮する。
+// 辞書はすぐ前に並ぶ中身と同じなので、繋げた後も参照先は変わらない。
+// gzip の CRC32 は区切りごとに持っておき、crc32Combine でまとめる。
+
+const (
+	svgGzipLevel = 7
+	svgDictSize  = 8 << 10
+)
+
+var flateWriterPool = sync.Pool{
+	New: func() interface{} {
+		w, err := flate.NewWriter(nil, svgGzipLevel)
+		if err != nil {
+			panic(err)
+		}
+		return w
+	},
+}
+
+// deflateSegment は gzip の本体の一部になる deflate のブロックと、その中身の CRC32 と長さ
+type deflateSegment struct {
+	buf  bytes.Buffer
+	crc  uint32
+	size int64
+}
+
+// append は p を圧縮して足す。dict は p の直前に並ぶ中身
+func (seg *deflateSegment) append(p []byte, dict []byte) {
+	if len(dict) > svgDictSize {
+		dict = dict[len(dict)-svgDictSize:]
+	}
+	w := flateWriterPool.Get().(*flate.Writer)
+	w.ResetDict(&seg.buf, dict)
+	w.Write(p)
+	w.Flush()
+	// 部屋のバッファを掴んだままにしない
+	w.ResetDict(nil, nil)
+	flateWriterPool.Put(w)
+
+	seg.crc = crc32.Update(seg.crc, crc32.IEEETable, p)
+	seg.size += int64(len(p))
+}
+
+func newDeflateSegment(p []byte) *deflateSegment {
+	seg := &deflateSegment{}
+	seg.append(p, nil)
+	return seg
+}
+
+var (
+	gzipHeader = []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff}
+	// BFINAL を立てた空の stored ブロック
+	deflateFinalBlock = []byte{1, 0, 0, 0xff, 0xff}
+)
+
+// joinGzip は segs を順に並べた1つの gzip を作る。nil は飛ばす
+func joinGzip(segs []*deflateSegment) []byte {
+	n := len(gzipHeader) + len(deflateFinalBlock) + 8
+	for _, seg := range segs {
+		if seg != nil {
+			n += seg.buf.Len()
+		}
+	}
+
+	out := make([]byte, 0, n)
+	out = append(out, gzipHeader...)
+	var crc uint32
+	var size int64
+	for _, seg := range segs {
+		if seg == nil {
+			continue
+		}
+		out = append(out, seg.buf.Bytes()...)
+		crc = crc32Combine(crc, seg.crc, seg.size)
+		size += seg.size
+	}
+	out = append(out, deflateFinalBlock...)
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], crc)
+	binary.LittleEndian.PutUint32(trailer[4:], uint32(size))
+	return append(out, trailer[:]...)
+}
+
+// crc32Combine は zlib の crc32_combine と同じく、crc1 の中身の後に長さ len2 の
+// crc2 の中身を繋げたものの CRC32 を返す
+func crc32Combine(crc1 uint32, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+
+	var even, odd [32]uint32
+	odd[0] = crc32.IEEE
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+	gf2MatrixSquare(&even, &odd)
+	gf2MatrixSquare(&odd, &even)
+
+	for {
+		gf2MatrixSquare(&even, &odd)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&even, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+		gf2MatrixSquare(&odd, &even)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&odd, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat *[32]uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square *[32]uint32, mat *[32]uint32) {
+	for n := 0; n < 32; n++ {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// roomHub は watcher や購読者など、保存しない部屋ごとの状態を持つ。
+// どの RoomStore を使っていてもストリームはここで待ち合わせるので、
+// 部屋の中身を変えたら Notify を呼ぶこと。
+type roomHub struct {
+	mu    sync.RWMutex
+	rooms map[int64]*liveRoom
+
+	lastDraftID int64
+
+	// トークンごとの描いている途中の draft の数。liveRoom.mu の後に取る
+	draftMu       sync.Mutex
+	draftsByToken map[int64]int
+}
+
+type liveRoom struct {
+	mu           sync.Mutex
+	watchers     map[int64]time.Time
+	watcherCount int
+	// トークンごとの開いているストリームの数。同じトークンのタブが複数開いていることがある
+	streams     map[int64]int
+	subscribers map[chan struct{}]struct{}
+
+	drafts     map[int64]*strokeDraft
+	liveEvents []liveEvent
+	liveSeq    int64
+}
+
+var hub = newRoomHub()
+
+func newRoomHub() *roomHub {
+	return &roomHub{
+		rooms:         map[int64]*liveRoom{},
+		draftsByToken: map[int64]int{},
+	}
+}
+
+func (h *roomHub) get(roomID int64) (*liveRoom, bool) {
+	h.mu.RLock()
+	lr, ok := h.rooms[roomID]
+	h.mu.RUnlock()
+	return lr, ok
+}
+
+// room は部屋が無ければ作る。部屋が存在するかは呼ぶ側で RoomStore を見て確認しておくこと
+func (h *roomHub) room(roomID int64) *liveRoom {
+	if lr, ok := h.get(roomID); ok {
+		return lr
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	lr, ok := h.rooms[roomID]
+	if !ok {
+		lr = &liveRoom{
+			watchers:    map[int64]time.Time{},
+			streams:     map[int64]int{},
+			subscribers: map[chan struct{}]struct{}{},
+			drafts:      map[int64]*strokeDraft{},
+		}
+		h.rooms[roomID] = lr
+	}
+	return lr
+}
+
+func (h *roomHub) UpdateWatcherCount(roomID int64, tokenID int64) int {
+	lr := h.room(roomID)
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	lr.watchers[tokenID] = time.Now()
+	lr.expireWatchers()
+	return lr.watcherCount
+}
+
+func (h *roomHub) GetWatcherCount(roomID int64) int {
+	lr, ok := h.get(roomID)
+	if !ok {
+		return 0
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	lr.expireWatchers()
+	return lr.watcherCount
+}
+
+// AddWatcher はストリームを開いたときに呼び、watcher 数を返す。
+// 閉じるときは必ず RemoveWatcher を呼ぶこと
+func (h *roomHub) AddWatcher(roomID int64, tokenID int64) int {
+	lr := h.room(roomID)
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	lr.streams[tokenID]++
+	lr.watchers[tokenID] = time.Now()
+	lr.expireWatchers()
+	return lr.watcherCount
+}
+
+// RemoveWatcher はストリームを閉じたときに呼び、
+// そのトークンのストリームが他に開いていなければ watcher を即座に外す
+func (h *roomHub) RemoveWatcher(roomID int64, tokenID int64) {
+	lr, ok := h.get(roomID)
+	if !ok {
+		return
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	lr.streams[tokenID]--
+	if lr.streams[tokenID] > 0 {
+		return
+	}
+	delete(lr.streams, tokenID)
+	delete(lr.watchers, tokenID)
+	lr.expireWatchers()
+}
+
+// expireWatchers は liveRoom.mu を取った状態で呼ぶ
+func (lr *liveRoom) expireWatchers() {
+	for token, t := range lr.watchers {
+		if time.Since(t) >= time.Second*3 {
+			delete(lr.watchers, token)
+		}
+	}
+	if lr.watcherCount != len(lr.watchers) {
+		lr.watcherCount = len(lr.watchers)
+		lr.notify()
+	}
+}
+
+// Subscribe は部屋にストロークが追加されたり watcher 数が変わったときに
+// 通知を受け取るチャネルを返す。通知は溜まらないので、受け取ったら
+// GetStrokes などで最新の状態を取りに行くこと。
+func (h *roomHub) Subscribe(roomID int64) chan struct{} {
+	lr := h.room(roomID)
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	ch := make(chan struct{}, 1)
+	lr.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (h *roomHub) Unsubscribe(roomID int64, ch chan struct{}) {
+	lr, ok := h.get(roomID)
+	if !ok {
+		return
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	delete(lr.subscribers, ch)
+}
+
+// Notify は部屋の購読者を起こす
+func (h *roomHub) Notify(roomID int64) {
+	lr, ok := h.get(roomID)
+	if !ok {
+		return
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	lr.notify()
+}
+
+// notify は liveRoom.mu を取った状態で呼ぶ
+func (lr *liveRoom) notify() {
+	for ch := range lr.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"goji.io/pat"
+	"golang.org/x/net/context"
+)
+
+// 部屋の中のストロークはレイヤーに分けて描ける。
+// layer_id が 0 のストロークはどの部屋にもある土台のレイヤーに入り、常に一番下に見える状態で描く。
+// 作成したレイヤーは position の小さい順に上に重ねる。
+// レイヤーは acl と同じくメモリに持ち、書き込みは MySQL にも通す。
+// MySQL に書いている間は部屋ごとのロックだけを持ち、他の部屋の読み書きやストリームを止めない。
+// 変わったら部屋の version を上げ、ストリームはそれを見て layers イベントを送る。
+
+var errLayerNotFound = errors.New("このレイヤーは存在しません")
+
+type Layer struct {
+	ID        int64     `json:"id" db:"id"`
+	RoomID    int64     `json:"room_id" db:"room_id"`
+	Name      string    `json:"name" db:"name"`
+	Position  int       `json:"position" db:"position"`
+	Visible   bool      `json:"visible" db:"visible"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+type layerRegistry struct {
+	mu sync.RWMutex
+	// 部屋ごとに position 順
+	layers   map[int64][]Layer
+	versions map[int64]int64
+	// 同じ部屋への書き込みを一つずつにする
+	writing map[int64]*sync.Mutex
+}
+
+var layers = newLayerRegistry()
+
+func newLayerRegistry() *layerRegistry {
+	return &layerRegistry{
+		layers:   map[int64][]Layer{},
+		versions: map[int64]int64{},
+		writing:  map[int64]*sync.Mutex{},
+	}
+}
+
+// lockRoom は部屋の書き込みのロックを取り、外す関数を返す
+func (lr *layerRegistry) lockRoom(roomID int64) func() {
+	lr.mu.Lock()
+	m, ok := lr.writing[roomID]
+	if !ok {
+		m = &sync.Mutex{}
+		lr.writing[roomID] = m
+	}
+	lr.mu.Unlock()
+	m.Lock()
+	return m.Unlock
+}
+
+func (lr *layerRegistry) Load() error {
+	start := time.Now()
+
+	all := []Layer{}
+	query := "SELECT `id`, `room_id`, `name`, `position`, `visible`, `created_at` FROM `room_layers` ORDER BY `room_id`, `position`, `id`"
+	if err := dbx.Select(&all, query); err != nil {
+		return err
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	lr.layers = map[int64][]Layer{}
+	for _, l := range all {
+		lr.layers[l.RoomID] = append(lr.layers[l.RoomID], l)
+	}
+
+	startupStats.Set("room_layers_load", expvarDuration(time.Since(start)))
+	log.Printf("loaded %d layers in %s", len(all), time.Since(start))
+	return nil
+}
+
+// Layers は部屋のレイヤーを下から順に返す。土台のレイヤーは含まない
+func (lr *layerRegistry) Layers(roomID int64) []Layer {
+	lr.mu.RLock()
+	defer lr.mu.RUnlock()
+	ls := make([]Layer, len(lr.layers[roomID]))
+	copy(ls, lr.layers[roomID])
+	return ls
+}
+
+// Version はレイヤーが変わるたびに増える
+func (lr *layerRegistry) Version(roomID int64) int64 {
+	lr.mu.RLock()
+	defer lr.mu.RUnlock()
+	return lr.versions[roomID]
+}
+
+// Exists は layerID が 0 か、部屋にあるレイヤーなら true を返す
+func (lr *layerRegistry) Exists(roomID int64, layerID int64) bool {
+	if layerID == 0 {
+		return true
+	}
+	lr.mu.RLock()
+	defer lr.mu.RUnlock()
+	for _, l := range lr.layers[roomID] {
+		if l.ID == layerID {
+			return true
+		}
+	}
+	return false
+}
+
+// Create はレイヤーを一番上に足す
+func (lr *layerRegistry) Create(roomID int64, name string) (*Layer, error) {
+	defer lr.lockRoom(roomID)()
+
+	lr.mu.RLock()
+	n := len(lr.layers[roomID])
+	lr.mu.RUnlock()
+	l := Layer{
+		RoomID:    roomID,
+		Name:      name,
+		Position:  n + 1,
+		Visible:   true,
+		CreatedAt: time.Now().Truncate(time.Microsecond),
+	}
+	query := "INSERT INTO `room_layers` (`room_id`, `name`, `position`, `visible`, `created_at`) VALUES (?, ?, ?, ?, ?)"
+	result, err := dbx.Exec(query, l.RoomID, l.Name, l.Position, l.Visible, l.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	l.ID, err = result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	lr.mu.Lock()
+	lr.layers[roomID] = append(lr.layers[roomID], l)
+	lr.versions[roomID]++
+	lr.mu.Unlock()
+	return &l, nil
+}
+
+type layerUpdate struct {
+	Name     *string `json:"name"`
+	Visible  *bool   `json:"visible"`
+	Position *int    `json:"position"`
+}
+
+// Update は名前と表示を変え、position が指定されていればその位置に移して残りを詰め直す
+func (lr *layerRegistry) Update(roomID int64, layerID int64, u layerUpdate) ([]Layer, error) {
+	defer lr.lockRoom(roomID)()
+
+	old := lr.Layers(roomID)
+	i := -1
+	for j := range old {
+		if old[j].ID == layerID {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		return nil, errLayerNotFound
+	}
+
+	// 書き込みに失敗したときにメモリを変えないように、別のスライスに並べ替える
+	ls := make([]Layer, 0, len(old))
+	ls = append(ls, old[:i]...)
+	ls = append(ls, old[i+1:]...)
+	l := old[i]
+	if u.Name != nil {
+		l.Name = *u.Name
+	}
+	if u.Visible != nil {
+		l.Visible = *u.Visible
+	}
+	to := i
+	if u.Position != nil {
+		to = *u.Position - 1
+		if to < 0 {
+			to = 0
+		}
+		if to > len(ls) {
+			to = len(ls)
+		}
+	}
+	ls = append(ls, Layer{})
+	copy(ls[to+1:], ls[to:])
+	ls[to] = l
+	for j := range ls {
+		ls[j].Position = j + 1
+	}
+
+	tx, err := dbx.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range ls {
+		query := "UPDATE `room_layers` SET `name` = ?, `position` = ?, `visible` = ? WHERE `id` = ?"
+		if _, err := tx.Exec(query, l.Name, l.Position, l.Visible, l.ID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	lr.mu.Lock()
+	lr.layers[roomID] = ls
+	lr.versions[roomID]++
+	lr.mu.Unlock()
+
+	result := make([]Layer, len(ls))
+	copy(result, ls)
+	return result, nil
+}
+
+// changeLayers はレイヤーが変わったことを SVG とストリームに知らせる
+func changeLayers(room *Room) {
+	room.invalidateSVG()
+	hub.Notify(room.ID)
+}
+
+func parseLayerName(name string) (string, bool) {
+	if name == "" || utf8.RuneCountInString(name) > 64 {
+		return "", false
+	}
+	return name, true
+}
+
+func outputLayers(w http.ResponseWriter, ls []Layer) {
+	b, _ := json.Marshal(struct {
+		Layers []Layer `json:"layers"`
+	}{Layers: ls})
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func postAPIRoomsIDLayers(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	room, ok := parseOwnerRequest(ctx, w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	posted := struct {
+		Name string `json:"name"`
+	}{}
+	if json.Unmarshal(body, &posted) != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "リクエストが正しくありません。")
+		return
+	}
+	name, ok := parseLayerName(posted.Name)
+	if !ok {
+		outputErrorMsg(w, http.StatusBadRequest, "レイヤー名は64文字以内で指定してください。")
+		return
+	}
+
+	if _, err := layers.Create(room.ID, name); err != nil {
+		outputError(w, err)
+		return
+	}
+	changeLayers(room)
+	outputLayers(w, layers.Layers(room.ID))
+}
+
+func putAPIRoomsIDLayersID(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	room, ok := parseOwnerRequest(ctx, w, r)
+	if !ok {
+		return
+	}
+	layerID, err := strconv.ParseInt(pat.Param(ctx, "layer_id"), 10, 64)
+	if err != nil {
+		outputErrorMsg(w, http.StatusNotFound, errLayerNotFound.Error())
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	u := layerUpdate{}
+	if json.Unmarshal(body, &u) != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "リクエストが正しくありません。")
+		return
+	}
+	if u.Name != nil {
+		name, ok := parseLayerName(*u.Name)
+		if !ok {
+			outputErrorMsg(w, http.StatusBadRequest, "レイヤー名は64文字以内で指定してください。")
+			return
+		}
+		u.Name = &name
+	}
+
+	ls, err := layers.Update(room.ID, layerID, u)
+	if err == errLayerNotFound {
+		outputErrorMsg(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	changeLayers(room)
+	outputLayers(w, ls)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func decodeTestLayers(t *testing.T, b []byte) []Layer {
+	var res struct {
+		Layers []Layer `json:"layers"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Layers
+}
+
+func layerNames(ls []Layer) []string {
+	names := []string{}
+	for _, l := range ls {
+		names = append(names, fmt.Sprintf("%s:%d", l.Name, l.Position))
+	}
+	return names
+}
+
+// TestLayers はレイヤーを足して名前を変え、並べ替えると position が詰め直されることと、
+// 持ち主以外は変えられないことを確かめる
+func TestLayers(t *testing.T) {
+	defer useTestDB(t)()
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner, other := newTestToken(), newTestToken()
+	room := createTestRoom(t, ts, owner)
+	layersURL := fmt.Sprintf("%s/api/rooms/%d/layers", ts.URL, room.ID)
+
+	var ls []Layer
+	for _, name := range []string{"a", "b", "c"} {
+		code, b := doRequest(t, "POST", layersURL, owner, map[string]string{"name": name})
+		if code != http.StatusOK {
+			t.Fatalf("POST layer %s: %d %s", name, code, b)
+		}
+		ls = decodeTestLayers(t, b)
+	}
+	if got := fmt.Sprint(layerNames(ls)); got != "[a:1 b:2 c:3]" {
+		t.Fatalf("layers = %s", got)
+	}
+	version := layers.Version(room.ID)
+
+	layerURL := func(l Layer) string { return fmt.Sprintf("%s/%d", layersURL, l.ID) }
+	name, hidden, top, bottom := "renamed", false, 3, 1
+	tests := []struct {
+		name   string
+		url    string
+		tk     *Token
+		body   layerUpdate
+		want   int
+		layers string
+	}{
+		{"rename", layerURL(ls[0]), owner, layerUpdate{Name: &name, Visible: &hidden}, http.StatusOK, "[renamed:1 b:2 c:3]"},
+		{"move to top", layerURL(ls[0]), owner, layerUpdate{Position: &top}, http.StatusOK, "[b:1 c:2 renamed:3]"},
+		{"move to bottom", layerURL(ls[2]), owner, layerUpdate{Position: &bottom}, http.StatusOK, "[c:1 b:2 renamed:3]"},
+		{"not the owner", layerURL(ls[1]), other, layerUpdate{Position: &top}, http.StatusForbidden, "[c:1 b:2 renamed:3]"},
+		{"unknown layer", layersURL + "/9999", owner, layerUpdate{Name: &name}, http.StatusNotFound, "[c:1 b:2 renamed:3]"},
+	}
+	for _, tt := range tests {
+		if code, b := doRequest(t, "PUT", tt.url, tt.tk, tt.body); code != tt.want {
+			t.Errorf("%s: got %d %s, want %d", tt.name, code, b, tt.want)
+		}
+		if got := fmt.Sprint(layerNames(layers.Layers(room.ID))); got != tt.layers {
+			t.Errorf("%s: layers = %s, want %s", tt.name, got, tt.layers)
+		}
+	}
+	for _, l := range layers.Layers(room.ID) {
+		if l.Visible != (l.ID != ls[0].ID) {
+			t.Errorf("layer %s: visible = %v", l.Name, l.Visible)
+		}
+	}
+	if v := layers.Version(room.ID); v != version+3 {
+		t.Errorf("version = %d after 3 updates, want %d", v, version+3)
+	}
+}
+
+// TestLayerWriteDoesNotBlockReads は MySQL に書いている間も、レイヤーを読めることを確かめる
+func TestLayerWriteDoesNotBlockReads(t *testing.T) {
+	defer useTestDB(t)()
+	if os.Getenv("TEST_MYSQL_DSN") != "" {
+		t.Skip("holds statements of the recording driver")
+	}
+	lr := newLayerRegistry()
+	if _, err := lr.Create(2, "other room"); err != nil {
+		t.Fatal(err)
+	}
+
+	release := testRecordDriver.holdOn("INSERT INTO `room_layers`")
+	created := make(chan error, 1)
+	go func() {
+		_, err := lr.Create(1, "slow")
+		created <- err
+	}()
+
+	read := make(chan int, 1)
+	go func() {
+		// 書き込みが始まるのを待ってから読む
+		time.Sleep(10 * time.Millisecond)
+		read <- len(lr.Layers(2)) + len(lr.Layers(1))
+	}()
+	select {
+	case n := <-read:
+		if n != 1 {
+			t.Errorf("%d layers during the write, want 1", n)
+		}
+	case <-time.After(time.Second):
+		t.Error("reading layers waits for the write")
+	}
+
+	release()
+	if err := <-created; err != nil {
+		t.Fatal(err)
+	}
+	if n := len(lr.Layers(1)); n != 1 {
+		t.Errorf("%d layers after the write, want 1", n)
+	}
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"bytes"
+	"expvar"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"time"
 
 	_ "net/http/pprof"
@@ -32,6 +34,15 @@ var (
 	onStartProfileCmd = "/opt/isucon/on-start-bench"
 )
 
+// startupStats は /debug/vars の startup に起動時の処理にかかった時間を出す
+var startupStats = expvar.NewMap("startup")
+
+type expvarDuration time.Duration
+
+func (d expvarDuration) String() string {
+	return strconv.Quote(time.Duration(d).String())
+}
+
 func callOnStartProfile() {
 	if _, err := os.Stat(onStartProfileCmd); os.IsNotExist(err) {
 		log.Println("OnStartProfile command not found:", err)
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"math"
+	"strconv"
+)
+
+// PNG は SVG と同じ順番でストロークを白い背景に重ねて描く。
+// 線は各線分から半径 width/2 以内の画素を塗るので、端と継ぎ目は丸くなる。
+// 1本のストロークの中で重なったところが濃くならないように、ストロークごとに
+// 被覆率のマスクを作ってから色を重ねる。text は描かない。
+
+const (
+	maxPNGScale = 4.0
+	// 倍率はこの刻みに丸める。倍率ごとのキャッシュと描く数がこれで決まる数に収まる
+	pngScaleStep = 0.25
+	// 描いた人で絞り込んだ PNG はキャッシュしないので、倍率をここまでにする
+	maxFilteredPNGScale = 2.0
+	// 縦横どちらかがこれを超える大きさでは描かない
+	maxPNGSize = 4096
+	// この数を超えた倍率を頼まれたら PNG のキャッシュを捨てる
+	maxCachedPNGScales = 4
+	// 楕円を何角形で描くか
+	ellipseSegments = 64
+)
+
+var errInvalidScale = errors.New("scale が正しくありません。")
+
+// 描いた人で絞り込んだ PNG を同時に描く数。描いている間は1枚ごとに画素とマスクを持つので抑える
+var filteredPNGSlots = make(chan struct{}, 2)
+
+// 絞り込まない PNG を同時に描く数。同じ部屋と倍率は pngRendering で1枚にまとめる
+var pngSlots = make(chan struct{}, 4)
+
+// pngRender は描いている最中の PNG。描き終わったら done を閉じる
+type pngRender struct {
+	done chan struct{}
+	b    []byte
+	err  error
+}
+
+type raster struct {
+	w, h int
+	// 白で初期化した RGB
+	pix []uint8
+	// ストローク1本分の被覆率。描いた範囲を dirty に覚えておき、重ねたら 0 に戻す。
+	// サムネイルのように raster を取っておくときは release で捨てておき、描くときに作り直す
+	mask                               []float32
+	dirtyX0, dirtyY0, dirtyX1, dirtyY1 int
+}
+
+func newRaster(w, h int) *raster {
+	r := &raster{
+		w:    w,
+		h:    h,
+		pix:  make([]uint8, w*h*3),
+		mask: make([]float32, w*h),
+	}
+	for i := range r.pix {
+		r.pix[i] = 255
+	}
+	r.resetDirty()
+	return r
+}
+
+func (r *raster) resetDirty() {
+	r.dirtyX0, r.dirtyY0, r.dirtyX1, r.dirtyY1 = r.w, r.h, 0, 0
+}
+
+// clip は [x0, x1) と [y0, y1) をキャンバスに収めて dirty に足す
+func (r *raster) clip(fx0, fy0, fx1, fy1 float64) (int, int, int, int) {
+	x0, y0 := int(math.Floor(fx0)), int(math.Floor(fy0))
+	x1, y1 := int(math.Ceil(fx1))+1, int(math.Ceil(fy1))+1
+	if x0 < 0 {
+		x0 = 0
+	}
+	if y0 < 0 {
+		y0 = 0
+	}
+	if x1 > r.w {
+		x1 = r.w
+	}
+	if y1 > r.h {
+		y1 = r.h
+	}
+	if x0 < r.dirtyX0 {
+		r.dirtyX0 = x0
+	}
+	if y0 < r.dirtyY0 {
+		r.dirtyY0 = y0
+	}
+	if x1 > r.dirtyX1 {
+		r.dirtyX1 = x1
+	}
+	if y1 > r.dirtyY1 {
+		r.dirtyY1 = y1
+	}
+	return x0, y0, x1, y1
+}
+
+func (r *raster) release() {
+	r.mask = nil
+}
+
+func (r *raster) cover(x, y int, c float64) {
+	if c <= 0 {
+		return
+	}
+	if c > 1 {
+		c = 1
+	}
+	i := y*r.w + x
+	if float32(c) > r.mask[i] {
+		r.mask[i] = float32(c)
+	}
+}
+
+func distToSegment(px, py, ax, ay, bx, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = ((px-ax)*dx + (py-ay)*dy) / l
+		if t < 0 {
+			t = 0
+		} else if t > 1 {
+			t = 1
+		}
+	}
+	return math.Hypot(px-(ax+t*dx), py-(ay+t*dy))
+}
+
+// drawSegment は a から b への線分を半径 radius で塗る。端から1画素でぼかす
+func (r *raster) drawSegment(a, b Point, radius float64) {
+	x0, y0, x1, y1 := r.clip(
+		math.Min(a.X, b.X)-radius-1, math.Min(a.Y, b.Y)-radius-1,
+		math.Max(a.X, b.X)+radius+1, math.Max(a.Y, b.Y)+radius+1)
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			d := distToSegment(float64(x)+0.5, float64(y)+0.5, a.X, a.Y, b.X, b.Y)
+			r.cover(x, y, radius+0.5-d)
+		}
+	}
+}
+
+func (r *raster) drawPolyline(points []Point, radius float64, closed bool) {
+	if len(points) == 1 {
+		r.drawSegment(points[0], points[0], radius)
+		return
+	}
+	for i := 1; i < len(points); i++ {
+		r.drawSegment(points[i-1], points[i], radius)
+	}
+	if closed && len(points) > 2 {
+		r.drawSegment(points[len(points)-1], points[0], radius)
+	}
+}
+
+// fillPolygon は even-odd で内側を塗り、辺の近くは辺までの距離でぼかす
+func (r *raster) fillPolygon(points []Point) {
+	if len(points) < 3 {
+		return
+	}
+	minX, minY, maxX, maxY := points[0].X, points[0].Y, points[0].X, points[0].Y
+	for _, p := range points[1:] {
+		minX, minY = math.Min(minX, p.X), math.Min(minY, p.Y)
+		maxX, maxY = math.Max(maxX, p.X), math.Max(maxY, p.Y)
+	}
+	x0, y0, x1, y1 := r.clip(minX-1, minY-1, maxX+1, maxY+1)
+	for y := y0; y < y1; y++ {
+		py := float64(y) + 0.5
+		for x := x0; x < x1; x++ {
+			px := float64(x) + 0.5
+			inside := false
+			d := math.Inf(1)
+			for i, j := 0, len(points)-1; i < len(points); j, i = i, i+1 {
+				a, b := points[j], points[i]
+				if (a.Y > py) != (b.Y > py) && px < (b.X-a.X)*(py-a.Y)/(b.Y-a.Y)+a.X {
+					inside = !inside
+				}
+				d = math.Min(d, distToSegment(px, py, a.X, a.Y, b.X, b.Y))
+			}
+			if inside {
+				r.cover(x, y, 0.5+d)
+			} else {
+				r.cover(x, y, 0.5-d)
+			}
+		}
+	}
+}
+
+// composite はマスクを色で重ねてからマスクを消す
+func (r *raster) composite(red, green, blue int, alpha float64) {
+	cr, cg, cb := float32(red), float32(green), float32(blue)
+	for y := r.dirtyY0; y < r.dirtyY1; y++ {
+		for x := r.dirtyX0; x < r.dirtyX1; x++ {
+			i := y*r.w + x
+			m := r.mask[i]
+			if m == 0 {
+				continue
+			}
+			r.mask[i] = 0
+			a := float32(alpha) * m
+			p := r.pix[i*3 : i*3+3]
+			p[0] = uint8(float32(p[0])*(1-a) + cr*a + 0.5)
+			p[1] = uint8(float32(p[1])*(1-a) + cg*a + 0.5)
+			p[2] = uint8(float32(p[2])*(1-a) + cb*a + 0.5)
+		}
+	}
+	r.resetDirty()
+}
+
+func scalePoints(points []Point, scale float64) []Point {
+	scaled := make([]Point, len(points))
+	for i, p := range points {
+		scaled[i] = Point{X: p.X * scale, Y: p.Y * scale}
+	}
+	return scaled
+}
+
+func ellipsePoints(a, b Point) []Point {
+	cx, cy := (a.X+b.X)/2, (a.Y+b.Y)/2
+	rx, ry := math.Abs(b.X-a.X)/2, math.Abs(b.Y-a.Y)/2
+	points := make([]Point, ellipseSegments)
+	for i := range points {
+		t := 2 * math.Pi * float64(i) / ellipseSegments
+		points[i] = Point{X: cx + rx*math.Cos(t), Y: cy + ry*math.Sin(t)}
+	}
+	return points
+}
+
+// simplifyPoints は前の点から minDist 未満しか離れていない点を除く。最後の点は残す
+func simplifyPoints(points []Point, minDist float64) []Point {
+	if len(points) <= 2 {
+		return points
+	}
+	simplified := []Point{points[0]}
+	for i, p := range points[1:] {
+		last := simplified[len(simplified)-1]
+		if i == len(points)-2 || math.Hypot(p.X-last.X, p.Y-last.Y) >= minDist {
+			simplified = append(simplified, p)
+		}
+	}
+	return simplified
+}
+
+func (r *raster) drawStroke(s *Stroke, scale float64, opacity float64) {
+	if r.mask == nil {
+		r.mask = make([]float32, r.w*r.h)
+	}
+	points := scalePoints(s.Points, scale)
+	radius := math.Max(float64(s.Width)*scale/2, 0.5)
+	switch s.Type {
+	case shapePolyline, shapeLine:
+		// 縮小したときに1画素に満たない線分は描いても変わらないので間引く
+		r.drawPolyline(simplifyPoints(points, 0.5), radius, false)
+	case shapeRect, shapeEllipse:
+		var outline []Point
+		if s.Type == shapeRect {
+			a, b := points[0], points[1]
+			outline = []Point{a, {X: b.X, Y: a.Y}, b, {X: a.X, Y: b.Y}}
+		} else {
+			outline = ellipsePoints(points[0], points[1])
+		}
+		if s.Fill {
+			r.fillPolygon(outline)
+		}
+		r.drawPolyline(outline, radius, true)
+	case shapePolygon:
+		r.fillPolygon(points)
+		r.drawPolyline(points, radius, true)
+	default:
+		return
+	}
+	r.composite(s.Red, s.Green, s.Blue, s.Alpha*opacity)
+}
+
+func (r *raster) image() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, r.w, r.h))
+	for i := 0; i < r.w*r.h; i++ {
+		copy(img.Pix[i*4:i*4+3], r.pix[i*3:i*3+3])
+		img.Pix[i*4+3] = 255
+	}
+	return img
+}
+
+// rasterizeRoom は SVG と同じくレイヤーの順に PNG を描く。opacity が nil なら全部そのまま描く
+func rasterizeRoom(room *Room, strokes []Stroke, scale float64, opacity func(*Stroke) float64) ([]byte, error) {
+	w := int(math.Ceil(float64(room.CanvasWidth) * scale))
+	h := int(math.Ceil(float64(room.CanvasHeight) * scale))
+	if w <= 0 || h <= 0 || w > maxPNGSize || h > maxPNGSize {
+		return nil, errInvalidScale
+	}
+
+	r := newRaster(w, h)
+	r.drawLayers(strokes, visibleLayerOrder(room.ID), scale, opacity)
+	return r.encode()
+}
+
+// drawLayers は order のレイヤーの順にストロークを描く。order に無いレイヤーは描かない
+func (r *raster) drawLayers(strokes []Stroke, order []int64, scale float64, opacity func(*Stroke) float64) {
+	byLayer := map[int64][]*Stroke{}
+	for i := range strokes {
+		s := &strokes[i]
+		byLayer[s.LayerID] = append(byLayer[s.LayerID], s)
+	}
+	for _, layerID := range order {
+		for _, s := range byLayer[layerID] {
+			o := 1.0
+			if opacity != nil {
+				o = opacity(s)
+			}
+			if o > 0 {
+				r.drawStroke(s, scale, o)
+			}
+		}
+	}
+}
+
+func (r *raster) encode() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, r.image()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// visibleLayerOrder は見えるレイヤーの ID を下から順に返す。土台のレイヤーの 0 が先頭
+func visibleLayerOrder(roomID int64) []int64 {
+	order := []int64{0}
+	for _, l := range layers.Layers(roomID) {
+		if l.Visible {
+			order = append(order, l.ID)
+		}
+	}
+	return order
+}
+
+func parsePNGScale(s string) (float64, error) {
+	if s == "" {
+		return 1, nil
+	}
+	scale, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(scale > 0 && scale <= maxPNGScale) {
+		return 0, errInvalidScale
+	}
+	scale = math.Max(math.Round(scale/pngScaleStep), 1) * pngScaleStep
+	return scale, nil
+}
+
+// renderRoomPNG は倍率ごとにキャッシュした PNG を返す。
+// 描いている間に AddStroke の invalidatePNG を待たせないように、pngMtx の外で描く。
+// 同じ倍率を描いている最中なら、もう1枚描かずにそれを待つ
+func renderRoomPNG(room *Room, scale float64) ([]byte, error) {
+	room.pngMtx.Lock()
+	if b, ok := room.pngCache[scale]; ok {
+		room.pngMtx.Unlock()
+		return b, nil
+	}
+	if p, ok := room.pngRendering[scale]; ok {
+		room.pngMtx.Unlock()
+		<-p.done
+		return p.b, p.err
+	}
+	p := &pngRender{done: make(chan struct{})}
+	if room.pngRendering == nil {
+		room.pngRendering = map[float64]*pngRender{}
+	}
+	room.pngRendering[scale] = p
+	version := room.pngVersion
+	strokes := room.StrokesSnapshot()
+	room.pngMtx.Unlock()
+
+	pngSlots <- struct{}{}
+	p.b, p.err = rasterizeRoom(room, strokes, scale, nil)
+	<-pngSlots
+
+	room.pngMtx.Lock()
+	// invalidatePNG の後に始めた同じ倍率の描画があれば、そちらを残す
+	if room.pngRendering[scale] == p {
+		delete(room.pngRendering, scale)
+	}
+	// 描いている間にストロークが変わっていたら、古いストロークから描いたものは入れない
+	if p.err == nil && room.pngVersion == version {
+		if room.pngCache == nil || len(room.pngCache) >= maxCachedPNGScales {
+			room.pngCache = map[float64][]byte{}
+		}
+		room.pngCache[scale] = p.b
+	}
+	room.pngMtx.Unlock()
+	close(p.done)
+	return p.b, p.err
+}
+
+// renderFilteredRoomPNG は描いた人で絞り込んだ PNG を作る。
+// 組み合わせが多いのでキャッシュせず、そのかわり倍率と同時に描く数を抑える
+func renderFilteredRoomPNG(room *Room, strokes []Stroke, scale float64, opacity func(*Stroke) float64) ([]byte, error) {
+	if scale > maxFilteredPNGScale {
+		return nil, errInvalidScale
+	}
+	filteredPNGSlots <- struct{}{}
+	defer func() { <-filteredPNGSlots }()
+	return rasterizeRoom(room, strokes, scale, opacity)
+}
+
+func (room *Room) invalidatePNG() {
+	room.pngMtx.Lock()
+	room.pngCache = nil
+	// 描いている最中のものは古いストロークから描いているので、これから頼まれた分には使わない
+	room.pngRendering = nil
+	room.pngVersion++
+	room.pngMtx.Unlock()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestPNGRoom(t *testing.T) *Room {
+	m, _ := newTestImageRoom(t)
+	room, err := m.CreateRoom("png", 100, 80, roomOwner{TokenID: 1}, roomSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AddStroke(room.ID, benchStroke()); err != nil {
+		t.Fatal(err)
+	}
+	room, _ = roomRepo.Get(room.ID)
+	return room
+}
+
+func TestParsePNGScale(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		err  bool
+	}{
+		{"", 1, false},
+		{"1", 1, false},
+		{"1.5", 1.5, false},
+		{"1.51", 1.5, false},
+		{"1.13", 1.25, false},
+		{"0.01", pngScaleStep, false},
+		{"4", 4, false},
+		{"4.01", 0, true},
+		{"0", 0, true},
+		{"-1", 0, true},
+		{"NaN", 0, true},
+		{"x", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePNGScale(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("parsePNGScale(%q) = %v, %v, want %v (error %v)", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// TestPNGScaleCacheBounded はどんな倍率を頼まれても、倍率ごとのキャッシュの数が上限を超えないことを確かめる
+func TestPNGScaleCacheBounded(t *testing.T) {
+	defer useTestDB(t)()
+	room := newTestPNGRoom(t)
+
+	scales := map[float64]bool{}
+	for i := 1; i <= 400; i++ {
+		scale, err := parsePNGScale(fmt.Sprintf("%.2f", float64(i)/100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		scales[scale] = true
+		if _, err := renderRoomPNG(room, scale); err != nil {
+			t.Fatal(err)
+		}
+		room.pngMtx.Lock()
+		n := len(room.pngCache)
+		room.pngMtx.Unlock()
+		if n > maxCachedPNGScales {
+			t.Fatalf("%d scales cached, want at most %d", n, maxCachedPNGScales)
+		}
+	}
+	if want := int(maxPNGScale / pngScaleStep); len(scales) != want {
+		t.Errorf("%d distinct scales, want %d", len(scales), want)
+	}
+}
+
+// TestRenderRoomPNGShared は同じ倍率を同時に頼まれたら、1枚だけ描いて同じものを返すことを確かめる
+func TestRenderRoomPNGShared(t *testing.T) {
+	defer useTestDB(t)()
+	room := newTestPNGRoom(t)
+
+	// 空きを埋めておき、最初に頼まれた1枚を描き始める前に止める
+	for i := 0; i < cap(pngSlots); i++ {
+		pngSlots <- struct{}{}
+	}
+	const n = 8
+	results := make(chan []byte, n)
+	var started sync.WaitGroup
+	started.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			started.Done()
+			b, err := renderRoomPNG(room, 2)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- b
+		}()
+	}
+	started.Wait()
+
+	// 最初の1枚が描き始めるのを待つ
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		room.pngMtx.Lock()
+		rendering := len(room.pngRendering)
+		room.pngMtx.Unlock()
+		if rendering == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d renders in progress, want 1", rendering)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < cap(pngSlots); i++ {
+		<-pngSlots
+	}
+
+	var first []byte
+	for i := 0; i < n; i++ {
+		b := <-results
+		if len(b) == 0 {
+			t.Fatal("empty PNG")
+		}
+		if first == nil {
+			first = b
+		} else if &b[0] != &first[0] {
+			t.Error("concurrent requests rendered separate PNGs")
+		}
+	}
+}
@@ -3,83 +3,357 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"github.com/klauspost/compress/gzip"
-	"io"
+	"html"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"goji.io/pat"
 	"golang.org/x/net/context"
 )
 
-func renderRoomImage(w io.Writer, room *Room) {
+// renderRoomImage は encoding で圧縮した SVG を返す。
+// 圧縮はストロークが増えてから最初に頼まれたときに、頼まれた encoding の分だけする。
+// 圧縮している間に AddStroke を待たせないように、svgMtx の外で圧縮する
+func renderRoomImage(room *Room, encoding string) []byte {
+	svg, version, b := room.svgForEncoding(encoding)
+	if b != nil {
+		return b
+	}
+	b = encodeBody(svg, encoding)
+
+	room.svgMtx.Lock()
+	// 圧縮している間に作り直していたら、古い SVG から作ったものは入れない
+	if room.svgVersion == version {
+		room.svgVariants[encoding] = b
+	}
+	room.svgMtx.Unlock()
+	return b
+}
+
+// svgForEncoding は encoding の SVG が作ってあればそれを返し、
+// 無ければ圧縮する元の SVG とその版を返す
+func (room *Room) svgForEncoding(encoding string) ([]byte, int64, []byte) {
 	room.svgMtx.Lock()
+	defer room.svgMtx.Unlock()
 
 	if !room.svgInit {
+		room.svgLayers = map[int64]*bytes.Buffer{}
+		room.svgGzipLayers = map[int64]*deflateSegment{}
+		room.svgCount = 0
+		room.svgInit = true
+	}
+	room.updateSVG()
+
+	if b, ok := room.svgVariants[encoding]; ok {
+		return nil, 0, b
+	}
+	// gzip は圧縮済みのブロックを繋ぐだけなので、ここで作る
+	if encoding == encodingGzip {
+		b := room.joinSVGGzip()
+		room.svgVariants[encoding] = b
+		return nil, 0, b
+	}
+	svg, ok := room.svgVariants[encodingIdentity]
+	if !ok {
 		buf := bytes.NewBuffer(make([]byte, 0, 1024))
+		writeSVGHeader(buf, room)
+		writeSVGLayers(buf, room.ID, room.svgLayers)
+		buf.WriteString("</svg>")
+		svg = buf.Bytes()
+		room.svgVariants[encodingIdentity] = svg
+	}
+	if encoding == encodingIdentity {
+		return nil, 0, svg
+	}
+	return svg, room.svgVersion, nil
+}
 
-		fmt.Fprintf(buf,
-			`<?xml version="1.0" standalone="no"?><!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 1.1//EN" "http://www.w3.org/Graphics/SVG/1.1/DTD/svg11.dtd"><svg xmlns="http://www.w3.org/2000/svg" version="1.1" baseProfile="full" width="%d" height="%d" style="width:%dpx;height:%dpx;background-color:white;" viewBox="0 0 %d %d">`,
-			room.CanvasWidth, room.CanvasHeight,
-			room.CanvasWidth, room.CanvasHeight,
-			room.CanvasWidth, room.CanvasHeight)
-
-		for _, stroke := range room.Strokes {
-			fmt.Fprintf(buf,
-				`<polyline id="%d" stroke="rgba(%d,%d,%d,%v)" stroke-width="%d" stroke-linecap="round" stroke-linejoin="round" fill="none" points="`,
-				stroke.ID, stroke.Red, stroke.Green, stroke.Blue, stroke.Alpha, stroke.Width)
-			first := true
-			for _, point := range stroke.Points {
-				if !first {
-					buf.WriteByte(' ')
-				}
-				fmt.Fprintf(buf, `%.4f,%.4f`, point.X, point.Y)
-				first = false
-			}
-			buf.WriteString(`"></polyline>`)
+// updateSVG は svgMtx を取った状態で呼び、まだ svgLayers に書いていないストロークを
+// レイヤーごとに追記して gzip のブロックも継ぎ足し、作ってあった SVG を捨てる。
+// AddStroke と renderRoomImage のどちらが先に svgMtx を取っても取りこぼしや重複が無いように、
+// 何本目まで書いたかを svgCount で覚えておく。
+func (room *Room) updateSVG() {
+	strokes := room.StrokesSnapshot()
+	if room.svgCount >= len(strokes) && room.svgVariants != nil {
+		return
+	}
+
+	// 作り直すときにストロークごとに圧縮しないように、レイヤーごとにまとめて圧縮する
+	starts := map[int64]int{}
+	for i := range strokes[room.svgCount:] {
+		s := &strokes[room.svgCount+i]
+		buf := layerBuffer(room.svgLayers, s.LayerID)
+		if _, ok := starts[s.LayerID]; !ok {
+			starts[s.LayerID] = buf.Len()
 		}
+		writeSVGStroke(buf, s, 1)
+	}
+	for layerID, start := range starts {
+		seg, ok := room.svgGzipLayers[layerID]
+		if !ok {
+			seg = &deflateSegment{}
+			room.svgGzipLayers[layerID] = seg
+		}
+		b := room.svgLayers[layerID].Bytes()
+		seg.append(b[start:], b[:start])
+	}
+	room.svgCount = len(strokes)
+	room.svgVariants = map[string][]byte{}
+	room.svgVersion++
+}
 
-		room.svgBuf = buf
-		gbuf := append(buf.Bytes(), "</svg>"...)
-		room.svgCompressed = compress(gbuf)
-		room.svgInit = true
+// joinSVGGzip は svgMtx を取った状態で呼び、レイヤーごとの gzip のブロックを繋げる
+func (room *Room) joinSVGGzip() []byte {
+	buf := &bytes.Buffer{}
+	writeSVGHeader(buf, room)
+	segs := []*deflateSegment{newDeflateSegment(buf.Bytes())}
+	for _, l := range svgLayerList(room.ID) {
+		buf.Reset()
+		writeSVGGroupOpen(buf, l)
+		segs = append(segs, newDeflateSegment(buf.Bytes()), room.svgGzipLayers[l.ID], newDeflateSegment([]byte(`</g>`)))
 	}
+	segs = append(segs, newDeflateSegment([]byte("</svg>")))
+	return joinGzip(segs)
+}
 
-	gsvg := room.svgCompressed
-	room.svgMtx.Unlock()
+func layerBuffer(bufs map[int64]*bytes.Buffer, layerID int64) *bytes.Buffer {
+	buf, ok := bufs[layerID]
+	if !ok {
+		buf = &bytes.Buffer{}
+		bufs[layerID] = buf
+	}
+	return buf
+}
 
-	w.Write(gsvg)
+// writeSVGLayers は土台のレイヤーを一番下にして、部屋のレイヤーを順に <g> で重ねる。
+// 見えないレイヤーも display="none" にして残す
+func writeSVGLayers(buf *bytes.Buffer, roomID int64, bufs map[int64]*bytes.Buffer) {
+	for _, l := range svgLayerList(roomID) {
+		writeSVGGroupOpen(buf, l)
+		if strokes, ok := bufs[l.ID]; ok {
+			buf.Write(strokes.Bytes())
+		}
+		buf.WriteString(`</g>`)
+	}
 }
 
-func compress(src []byte) []byte {
-	buf := &bytes.Buffer{}
-	w, err := gzip.NewWriterLevel(buf, 7)
-	if err != nil {
-		panic(err)
+// svgLayerList は土台のレイヤーを先頭にして部屋のレイヤーを下から順に返す
+func svgLayerList(roomID int64) []Layer {
+	return append([]Layer{{Visible: true}}, layers.Layers(roomID)...)
+}
+
+func writeSVGGroupOpen(buf *bytes.Buffer, l Layer) {
+	fmt.Fprintf(buf, `<g id="layer-%d"`, l.ID)
+	if l.Name != "" {
+		fmt.Fprintf(buf, ` data-name="%s"`, html.EscapeString(l.Name))
+	}
+	if !l.Visible {
+		buf.WriteString(` display="none"`)
+	}
+	buf.WriteByte('>')
+}
+
+func writeSVGHeader(buf *bytes.Buffer, room *Room) {
+	fmt.Fprintf(buf,
+		`<?xml version="1.0" standalone="no"?><!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 1.1//EN" "http://www.w3.org/Graphics/SVG/1.1/DTD/svg11.dtd"><svg xmlns="http://www.w3.org/2000/svg" version="1.1" baseProfile="full" width="%d" height="%d" style="width:%dpx;height:%dpx;background-color:white;" viewBox="0 0 %d %d">`,
+		room.CanvasWidth, room.CanvasHeight,
+		room.CanvasWidth, room.CanvasHeight,
+		room.CanvasWidth, room.CanvasHeight)
+}
+
+// writeSVGStroke は opacity が 1 未満ならストロークを薄く描く
+func writeSVGStroke(buf *bytes.Buffer, stroke *Stroke, opacity float64) {
+	if stroke.Type != shapePolyline {
+		writeSVGShape(buf, stroke, opacity)
+		return
 	}
-	w.Write(src)
-	w.Close()
+	fmt.Fprintf(buf,
+		`<polyline id="%d" stroke="rgba(%d,%d,%d,%v)" stroke-width="%d" stroke-linecap="round" stroke-linejoin="round" fill="none"`,
+		stroke.ID, stroke.Red, stroke.Green, stroke.Blue, stroke.Alpha, stroke.Width)
+	writeSVGOpacity(buf, opacity)
+	buf.WriteString(` points="`)
+	writeSVGPoints(buf, stroke.Points)
+	buf.WriteString(`"></polyline>`)
+}
+
+func writeSVGOpacity(buf *bytes.Buffer, opacity float64) {
+	if opacity < 1 {
+		fmt.Fprintf(buf, ` opacity="%v"`, opacity)
+	}
+}
+
+// 強調するときにそれ以外のストロークにかける不透明度
+const dimmedStrokeOpacity = 0.2
+
+// authorOpacity は描いた人で絞り込むときの不透明度を返す。0 なら描かない
+func authorOpacity(hideAuthor string, highlightAuthor string) func(*Stroke) float64 {
+	return func(s *Stroke) float64 {
+		if hideAuthor != "" && s.Author == hideAuthor {
+			return 0
+		}
+		if highlightAuthor != "" && s.Author != highlightAuthor {
+			return dimmedStrokeOpacity
+		}
+		return 1
+	}
+}
+
+// renderFilteredRoomImage は描いた人で絞り込んだ SVG を作る。
+// 組み合わせが多いのでキャッシュはしない。
+func renderFilteredRoomImage(room *Room, strokes []Stroke, opacity func(*Stroke) float64) []byte {
+	bufs := map[int64]*bytes.Buffer{}
+	for i := range strokes {
+		s := &strokes[i]
+		if o := opacity(s); o > 0 {
+			writeSVGStroke(layerBuffer(bufs, s.LayerID), s, o)
+		}
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	writeSVGHeader(buf, room)
+	writeSVGLayers(buf, room.ID, bufs)
+	buf.WriteString("</svg>")
 	return buf.Bytes()
 }
 
-func getRoomImageID(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	idStr := pat.Param(ctx, "id")
+// invalidateSVG はストロークが消えたときなどに呼び、次に描くときに SVG と PNG とサムネイルを作り直させる
+func (room *Room) invalidateSVG() {
+	room.touch()
+	room.invalidatePNG()
+	room.invalidateThumbnails()
+
+	room.svgMtx.Lock()
+	room.svgInit = false
+	room.svgLayers = nil
+	room.svgGzipLayers = nil
+	room.svgVariants = nil
+	room.svgVersion++
+	room.svgCount = 0
+	room.svgMtx.Unlock()
+}
+
+// imageFormat は /img/:id.png や /img/:id.svg の拡張子か、なければ Accept ヘッダで形式を選ぶ。
+// 拡張子を除いた id も返す
+func imageFormat(idStr string, accept string) (string, string) {
+	for _, ext := range []string{"png", "svg"} {
+		if strings.HasSuffix(idStr, "."+ext) {
+			return strings.TrimSuffix(idStr, "."+ext), ext
+		}
+	}
+	if strings.Contains(accept, "image/png") && !strings.Contains(accept, "image/svg+xml") {
+		return idStr, "png"
+	}
+	return idStr, "svg"
+}
+
+// parseImageRequest は画像のエンドポイントで共通の部屋と見る権限を確かめる
+func parseImageRequest(w http.ResponseWriter, r *http.Request, idStr string) (*Room, bool) {
 	id, err := strconv.ParseInt(idStr, 10, 64)
 
 	if err != nil {
 		outputErrorMsg(w, http.StatusNotFound, "この部屋は存在しません。")
-		return
+		return nil, false
 	}
 
-	room, ok := roomRepo.Get(id)
-	if !ok {
+	room, err := store.GetRoom(id)
+	if err == errRoomNotFound {
 		log.Println("getRoomImageID", "room not found")
 		outputErrorMsg(w, http.StatusNotFound, "この部屋は存在しません。")
+		return nil, false
+	}
+	if err != nil {
+		outputError(w, err)
+		return nil, false
+	}
+
+	t, err := viewerToken(r)
+	if err == nil {
+		err = checkCanView(t, room)
+	}
+	if err != nil {
+		outputAccessError(w, err)
+		return nil, false
+	}
+	return room, true
+}
+
+func getRoomImageID(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	idStr, format := imageFormat(pat.Param(ctx, "id"), r.Header.Get("Accept"))
+	room, ok := parseImageRequest(w, r, idStr)
+	if !ok {
 		return
 	}
 
+	// 拡張子が無いときは Accept で形式が変わる
+	w.Header().Set("Vary", "Accept, Accept-Encoding")
+
+	q := r.URL.Query()
+	hideAuthor, highlightAuthor := q.Get("hide_author"), q.Get("highlight_author")
+	filtered := hideAuthor != "" || highlightAuthor != ""
+
+	// 作る前に確かめて、変わっていなければ描かずに返す
+	tag, modTime := roomValidators(room)
+	cacheControl := roomCacheControl(room, roomMaxAge)
+
+	if format == "png" {
+		scale, err := parsePNGScale(q.Get("scale"))
+		if err != nil {
+			outputErrorMsg(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// PNG は圧縮しないので、identity を断られたら返せるものが無い
+		if _, ok := negotiateEncoding(r.Header.Get("Accept-Encoding")); !ok {
+			outputErrorMsg(w, http.StatusNotAcceptable, errNotAcceptableEncoding.Error())
+			return
+		}
+		if checkNotModified(w, r, cacheControl, fmt.Sprintf(`W/"%s-png"`, tag), modTime) {
+			return
+		}
+		var b []byte
+		if filtered {
+			var strokes []Stroke
+			strokes, err = store.GetStrokes(room.ID, 0)
+			if err == nil {
+				b, err = renderFilteredRoomPNG(room, strokes, scale, authorOpacity(hideAuthor, highlightAuthor))
+			}
+		} else {
+			b, err = renderRoomPNG(room, scale)
+		}
+		if err == errInvalidScale {
+			outputErrorMsg(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			outputError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		writeEncoded(w, b, encodingIdentity)
+		return
+	}
+
+	encoding, ok := negotiateEncoding(r.Header.Get("Accept-Encoding"), encodingBrotli, encodingGzip)
+	if !ok {
+		outputErrorMsg(w, http.StatusNotAcceptable, errNotAcceptableEncoding.Error())
+		return
+	}
+	if checkNotModified(w, r, cacheControl, fmt.Sprintf(`W/"%s-svg"`, tag), modTime) {
+		return
+	}
+	var b []byte
+	if filtered {
+		strokes, err := store.GetStrokes(room.ID, 0)
+		if err != nil {
+			outputError(w, err)
+			return
+		}
+		b = encodeBody(renderFilteredRoomImage(room, strokes, authorOpacity(hideAuthor, highlightAuthor)), encoding)
+	} else {
+		b = renderRoomImage(room, encoding)
+	}
+
 	w.Header().Set("Content-Type", "image/svg+xml")
-	w.Header().Set("Content-Encoding", "gzip")
-	renderRoomImage(w, room)
+	writeEncoded(w, b, encoding)
 }
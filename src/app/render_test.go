@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func newTestImageRoom(tb testing.TB) (*memRoomStore, *Room) {
+	roomRepo = NewRoomRepo()
+	m := &memRoomStore{repo: roomRepo}
+	store = m
+	layers = newLayerRegistry()
+	room, err := m.CreateRoom("image", 1028, 768, roomOwner{TokenID: 1}, roomSettings{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	room, _ = roomRepo.Get(room.ID)
+	return m, room
+}
+
+func gunzip(t *testing.T, b []byte) []byte {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// TestJoinSVGGzip はストロークを足しながら、継ぎ足した gzip を展開すると圧縮していない SVG と同じになることを確かめる
+func TestJoinSVGGzip(t *testing.T) {
+	defer useTestDB(t)()
+	m, room := newTestImageRoom(t)
+	layer, err := layers.Create(room.ID, "upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		s := benchStroke()
+		if i%3 == 0 {
+			s.LayerID = layer.ID
+		}
+		if _, err := m.AddStroke(room.ID, s); err != nil {
+			t.Fatal(err)
+		}
+		// 最初の数本は1本ずつ、あとはまとめて継ぎ足す
+		if i >= 5 && i%10 != 0 {
+			continue
+		}
+		identity := renderRoomImage(room, encodingIdentity)
+		if got := gunzip(t, renderRoomImage(room, encodingGzip)); !bytes.Equal(got, identity) {
+			t.Fatalf("after %d strokes: gunzipped SVG differs from identity\n got: %s\nwant: %s", i+1, got, identity)
+		}
+	}
+
+	room.svgMtx.Lock()
+	joined := room.joinSVGGzip()
+	room.svgMtx.Unlock()
+	if got := gunzip(t, joined); !bytes.Equal(got, renderRoomImage(room, encodingIdentity)) {
+		t.Fatal("gunzipped joinSVGGzip differs from identity")
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		ok     bool
+	}{
+		{"", encodingIdentity, true},
+		{"gzip, deflate, br", encodingBrotli, true},
+		{"gzip", encodingGzip, true},
+		{"br;q=0, gzip", encodingGzip, true},
+		{"deflate", encodingIdentity, true},
+		{"*", encodingBrotli, true},
+		{"*;q=0, gzip", encodingGzip, true},
+		{"*;q=0, identity", encodingIdentity, true},
+		{"br;q=0, gzip;q=0", encodingIdentity, true},
+		{"gzip, identity;q=0", encodingGzip, true},
+		{"identity;q=0", "", false},
+		{"deflate, identity;q=0", "", false},
+		{"*;q=0", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := negotiateEncoding(tt.header, encodingBrotli, encodingGzip)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("negotiateEncoding(%q) = %q, %v, want %q, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestRoomImageNotAcceptable は identity も断られて返せる形式が無ければ 406 を返すことを確かめる
+func TestRoomImageNotAcceptable(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := newTestToken()
+	room := createTestRoom(t, ts, owner)
+
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		want           int
+	}{
+		{"%s/img/%d.svg", "identity;q=0", http.StatusNotAcceptable},
+		{"%s/img/%d.svg", "gzip, identity;q=0", http.StatusOK},
+		{"%s/img/%d.png", "gzip, identity;q=0", http.StatusNotAcceptable},
+		{"%s/img/%d.png", "gzip", http.StatusOK},
+	}
+	for _, tt := range tests {
+		url := fmt.Sprintf(tt.path, ts.URL, room.ID)
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.want {
+			t.Errorf("GET %s with %q: got %d, want %d", url, tt.acceptEncoding, res.StatusCode, tt.want)
+		}
+	}
+}
+
+// BenchmarkAddStrokeGzip はストロークの多い部屋で、1本足すたびに gzip の SVG を取り直す時間を測る
+func BenchmarkAddStrokeGzip(b *testing.B) {
+	m, room := newTestImageRoom(b)
+	for i := 0; i < 20000; i++ {
+		if _, err := m.AddStroke(room.ID, benchStroke()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	renderRoomImage(room, encodingGzip)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.AddStroke(room.ID, benchStroke()); err != nil {
+			b.Fatal(err)
+		}
+		renderRoomImage(room, encodingGzip)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// 初期データに無いテーブルは起動時に作る。
+// 既存のテーブルは変えないので、ここには CREATE TABLE IF NOT EXISTS だけを書くこと。
+var schemaMigrations = []string{
+	"CREATE TABLE IF NOT EXISTS `token_revocations` (" +
+		"`token_id` BIGINT NOT NULL PRIMARY KEY," +
+		"`expires_at` DATETIME(6) NOT NULL," +
+		"KEY `expires_at` (`expires_at`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `users` (" +
+		"`id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`name` VARCHAR(64) NOT NULL UNIQUE," +
+		"`password_hash` VARBINARY(64) NOT NULL," +
+		"`created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `sessions` (" +
+		"`id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`session_id` VARCHAR(64) NOT NULL UNIQUE," +
+		"`user_id` BIGINT NOT NULL," +
+		"`created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)," +
+		"KEY `user_id` (`user_id`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `token_users` (" +
+		"`token_id` BIGINT NOT NULL PRIMARY KEY," +
+		"`user_id` BIGINT NOT NULL" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `room_user_owners` (" +
+		"`room_id` BIGINT NOT NULL PRIMARY KEY," +
+		"`user_id` BIGINT NOT NULL," +
+		"KEY `user_id` (`user_id`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `room_settings` (" +
+		"`room_id` BIGINT NOT NULL PRIMARY KEY," +
+		"`visibility` VARCHAR(16) NOT NULL," +
+		"`drawing` VARCHAR(16) NOT NULL" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `room_members` (" +
+		"`room_id` BIGINT NOT NULL," +
+		"`token_id` BIGINT NOT NULL," +
+		"`user_id` BIGINT NOT NULL DEFAULT 0," +
+		"`permission` VARCHAR(8) NOT NULL," +
+		"PRIMARY KEY (`room_id`, `token_id`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `stroke_authors` (" +
+		"`stroke_id` BIGINT NOT NULL PRIMARY KEY," +
+		"`token_id` BIGINT NOT NULL," +
+		"`user_id` BIGINT NOT NULL DEFAULT 0" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `stroke_tombstones` (" +
+		"`id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`room_id` BIGINT NOT NULL," +
+		"`stroke_id` BIGINT NOT NULL UNIQUE," +
+		"`deleted_at` DATETIME(6) NOT NULL," +
+		"KEY `room_id` (`room_id`, `id`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `room_invites` (" +
+		"`invite_token` VARCHAR(64) NOT NULL PRIMARY KEY," +
+		"`room_id` BIGINT NOT NULL," +
+		"`permission` VARCHAR(8) NOT NULL," +
+		"`created_at` DATETIME(6) NOT NULL" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `deleted_id_marks` (" +
+		"`name` VARCHAR(32) NOT NULL PRIMARY KEY," +
+		"`last_id` BIGINT NOT NULL" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `room_layers` (" +
+		"`id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`room_id` BIGINT NOT NULL," +
+		"`name` VARCHAR(64) NOT NULL," +
+		"`position` INT NOT NULL," +
+		"`visible` TINYINT(1) NOT NULL DEFAULT 1," +
+		"`created_at` DATETIME(6) NOT NULL," +
+		"KEY `room_id` (`room_id`, `position`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `stroke_layers` (" +
+		"`stroke_id` BIGINT NOT NULL PRIMARY KEY," +
+		"`layer_id` BIGINT NOT NULL" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `stroke_shapes` (" +
+		"`stroke_id` BIGINT NOT NULL PRIMARY KEY," +
+		"`type` VARCHAR(16) NOT NULL," +
+		"`fill` TINYINT(1) NOT NULL DEFAULT 0," +
+		"`text` VARCHAR(256) NOT NULL DEFAULT ''" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `token_authors` (" +
+		"`token_id` BIGINT NOT NULL PRIMARY KEY," +
+		"`author_token_id` BIGINT NOT NULL" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+}
+
+func migrate() error {
+	start := time.Now()
+	for _, q := range schemaMigrations {
+		if _, err := dbx.Exec(q); err != nil {
+			return err
+		}
+	}
+	log.Printf("migrated %d tables in %s", len(schemaMigrations), time.Since(start))
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"math"
+	"unicode/utf8"
+)
+
+// Stroke は type で図形の種類を持つ。type が空のものは今までどおりの折れ線で、
+// それ以外は points の使い方が変わる。
+//
+//	line:    points[0] から points[1] への直線
+//	rect:    points[0] と points[1] を対角とする長方形。fill で塗りつぶす
+//	ellipse: points[0] と points[1] を対角とする長方形に内接する楕円。fill で塗りつぶす
+//	polygon: 3点以上の塗りつぶした多角形
+//	text:    points[0] を左下にした text。width を文字の大きさに使う
+//
+// 折れ線以外は stroke_shapes に種類と塗りと文字を持つ。
+// ストリームでは折れ線は stroke、それ以外は type と同じ名前のイベントで流す。
+
+const (
+	shapePolyline = ""
+	shapeLine     = "line"
+	shapeRect     = "rect"
+	shapeEllipse  = "ellipse"
+	shapePolygon  = "polygon"
+	shapeText     = "text"
+
+	maxShapeTextLength = 256
+)
+
+// normalizeShape は POST された図形を確かめ、保存する形に揃える
+func normalizeShape(s *Stroke) bool {
+	if s.Type == "polyline" {
+		s.Type = shapePolyline
+	}
+	n := len(s.Points)
+	switch s.Type {
+	case shapePolyline:
+		s.Fill = false
+		s.Text = ""
+		return n > 0
+	case shapeLine:
+		s.Fill = false
+		s.Text = ""
+		return n == 2
+	case shapeRect, shapeEllipse:
+		s.Text = ""
+		return n == 2
+	case shapePolygon:
+		s.Fill = true
+		s.Text = ""
+		return n >= 3
+	case shapeText:
+		s.Fill = true
+		return n == 1 && s.Text != "" && utf8.RuneCountInString(s.Text) <= maxShapeTextLength
+	}
+	return false
+}
+
+// isDraftable は描いている途中の点を流せる図形なら true を返す。点を足していくのは折れ線だけ
+func isDraftable(s *Stroke) bool {
+	return s.Type == shapePolyline || s.Type == "polyline"
+}
+
+// streamEvent はストリームでストロークを流すときのイベント名
+func (s *Stroke) streamEvent() string {
+	if s.Type == shapePolyline {
+		return "stroke"
+	}
+	return s.Type
+}
+
+func writeSVGPoints(buf *bytes.Buffer, points []Point) {
+	first := true
+	for _, point := range points {
+		if !first {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(buf, `%.4f,%.4f`, point.X, point.Y)
+		first = false
+	}
+}
+
+// writeSVGShape は折れ線以外の図形を書く。points の数は normalizeShape で確かめてある
+func writeSVGShape(buf *bytes.Buffer, s *Stroke, opacity float64) {
+	color := fmt.Sprintf("rgba(%d,%d,%d,%v)", s.Red, s.Green, s.Blue, s.Alpha)
+	fill := "none"
+	if s.Fill {
+		fill = color
+	}
+	p := s.Points
+	switch s.Type {
+	case shapeLine:
+		fmt.Fprintf(buf, `<line id="%d" x1="%.4f" y1="%.4f" x2="%.4f" y2="%.4f" stroke="%s" stroke-width="%d" stroke-linecap="round"`,
+			s.ID, p[0].X, p[0].Y, p[1].X, p[1].Y, color, s.Width)
+	case shapeRect:
+		fmt.Fprintf(buf, `<rect id="%d" x="%.4f" y="%.4f" width="%.4f" height="%.4f" stroke="%s" stroke-width="%d" stroke-linejoin="round" fill="%s"`,
+			s.ID, math.Min(p[0].X, p[1].X), math.Min(p[0].Y, p[1].Y), math.Abs(p[1].X-p[0].X), math.Abs(p[1].Y-p[0].Y),
+			color, s.Width, fill)
+	case shapeEllipse:
+		fmt.Fprintf(buf, `<ellipse id="%d" cx="%.4f" cy="%.4f" rx="%.4f" ry="%.4f" stroke="%s" stroke-width="%d" fill="%s"`,
+			s.ID, (p[0].X+p[1].X)/2, (p[0].Y+p[1].Y)/2, math.Abs(p[1].X-p[0].X)/2, math.Abs(p[1].Y-p[0].Y)/2,
+			color, s.Width, fill)
+	case shapePolygon:
+		fmt.Fprintf(buf, `<polygon id="%d" stroke="%s" stroke-width="%d" stroke-linejoin="round" fill="%s" points="`,
+			s.ID, color, s.Width, fill)
+		writeSVGPoints(buf, p)
+		buf.WriteByte('"')
+	case shapeText:
+		fmt.Fprintf(buf, `<text id="%d" x="%.4f" y="%.4f" font-size="%d" fill="%s"`,
+			s.ID, p[0].X, p[0].Y, s.Width, fill)
+		writeSVGOpacity(buf, opacity)
+		fmt.Fprintf(buf, `>%s</text>`, html.EscapeString(s.Text))
+		return
+	}
+	writeSVGOpacity(buf, opacity)
+	buf.WriteString(`/>`)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// RoomRepo の中身を定期的にファイルに書き出しておき、起動時はそれを読んでから
+// スナップショットより新しいストロークだけを MySQL から取ってくる。
+
+const (
+	snapshotVersion = 5
+	// ストロークの ID は採番順にコミットされるとは限らないので、
+	// スナップショットの最大 ID より少し前から取り直して重複を除く
+	snapshotReconcileMargin = 1000
+)
+
+var errSnapshotVersion = errors.New("snapshot version mismatch")
+
+var (
+	// 空ならスナップショットを使わない
+	snapshotPath     = ""
+	snapshotInterval = time.Minute
+)
+
+type roomSnapshot struct {
+	Version      int
+	SavedAt      time.Time
+	LastStrokeID int64
+	// ストロークの author ハンドルを作った鍵。今の鍵と違えばハンドルと JSON を作り直す
+	AuthorKeyID string
+	Rooms       []snapshotRoom
+}
+
+type snapshotRoom struct {
+	ID           int64
+	Name         string
+	CanvasWidth  int
+	CanvasHeight int
+	CreatedAt    time.Time
+	OwnerID      int64
+	OwnerUserID  int64
+	Strokes      []snapshotStroke
+	Tombstones   []strokeTombstone
+}
+
+type snapshotStroke struct {
+	Stroke Stroke
+	JSON   []byte
+}
+
+// SaveSnapshot は RoomRepo の中身を path に書き出す。
+// 書きかけのファイルを読まないように、一時ファイルに書いてから rename する。
+func (r *RoomRepo) SaveSnapshot(path string) error {
+	snap := roomSnapshot{
+		Version:     snapshotVersion,
+		SavedAt:     time.Now(),
+		AuthorKeyID: authorKeyID(),
+	}
+
+	r.mu.RLock()
+	rooms := make([]*Room, 0, len(r.Rooms))
+	for _, room := range r.Rooms {
+		rooms = append(rooms, room)
+	}
+	r.mu.RUnlock()
+
+	for _, room := range rooms {
+		strokes := room.StrokesSnapshot()
+		owner := room.Owner()
+		tombstones := r.GetTombstones(room.ID, 0)
+		sr := snapshotRoom{
+			ID:           room.ID,
+			Name:         room.Name,
+			CanvasWidth:  room.CanvasWidth,
+			CanvasHeight: room.CanvasHeight,
+			CreatedAt:    room.CreatedAt,
+			OwnerID:      owner.TokenID,
+			OwnerUserID:  owner.UserID,
+			Strokes:      make([]snapshotStroke, len(strokes)),
+			Tombstones:   tombstones,
+		}
+		for i, s := range strokes {
+			sr.Strokes[i] = snapshotStroke{Stroke: s, JSON: s.json}
+			if s.ID > snap.LastStrokeID {
+				snap.LastStrokeID = s.ID
+			}
+		}
+		snap.Rooms = append(snap.Rooms, sr)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriterSize(f, 1<<20)
+	if err := gob.NewEncoder(w).Encode(&snap); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSnapshot は path から RoomRepo を作り直して、スナップショットの最大のストローク ID を返す
+func (r *RoomRepo) LoadSnapshot(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	snap := roomSnapshot{}
+	if err := gob.NewDecoder(bufio.NewReaderSize(f, 1<<20)).Decode(&snap); err != nil {
+		return 0, err
+	}
+	if snap.Version != snapshotVersion {
+		return 0, errSnapshotVersion
+	}
+
+	// AUTHOR_SECRET が無いと起動ごとに鍵が変わるので、書き出したときのハンドルは使えない
+	reencode := snap.AuthorKeyID != authorKeyID()
+	if reencode {
+		log.Println("author key changed since the snapshot; re-encoding strokes")
+	}
+
+	m := make(map[int64]*Room, len(snap.Rooms))
+	for _, sr := range snap.Rooms {
+		room := &Room{
+			ID:           sr.ID,
+			Name:         sr.Name,
+			CanvasWidth:  sr.CanvasWidth,
+			CanvasHeight: sr.CanvasHeight,
+			CreatedAt:    sr.CreatedAt,
+			ownerID:      sr.OwnerID,
+			ownerUserID:  sr.OwnerUserID,
+			Strokes:      make([]Stroke, len(sr.Strokes)),
+			tombstones:   sr.Tombstones,
+		}
+		for i, ss := range sr.Strokes {
+			s := &room.Strokes[i]
+			*s = ss.Stroke
+			if s.Points == nil {
+				s.Points = []Point{}
+			}
+			if !reencode {
+				s.json = ss.JSON
+				continue
+			}
+			s.setAuthor()
+			s.json, err = json.Marshal(s)
+			if err != nil {
+				return 0, err
+			}
+		}
+		room.StrokeCount = len(room.Strokes)
+		room.publishStrokes()
+		m[room.ID] = room
+	}
+
+	r.mu.Lock()
+	r.Rooms = m
+	r.mu.Unlock()
+
+	log.Printf("loaded snapshot %s: %d rooms, last stroke %d, saved at %s",
+		path, len(m), snap.LastStrokeID, snap.SavedAt.Format(time.RFC3339))
+	return snap.LastStrokeID, nil
+}
+
+// Reconcile はスナップショットを読んだ後に、MySQL にしか無い部屋とストロークを取り込む
+func (r *RoomRepo) Reconcile(lastStrokeID int64) error {
+	rooms := []*Room{}
+	err := dbx.Select(&rooms, "SELECT `id`, `name`, `canvas_width`, `canvas_height`, `created_at` FROM `rooms` ORDER BY `id` ASC")
+	if err != nil {
+		return err
+	}
+	owners, err := loadRoomOwners()
+	if err != nil {
+		return err
+	}
+
+	newRooms := 0
+	for _, room := range rooms {
+		if cur, ok := r.Get(room.ID); ok {
+			// トークンの更新やアカウントへの紐付けで持ち主はすぐに MySQL に書かれるが、
+			// スナップショットには次に書き出すまで入らないので、MySQL の方を使う
+			if owner, ok := owners[room.ID]; ok {
+				atomic.StoreInt64(&cur.ownerID, owner.TokenID)
+				atomic.StoreInt64(&cur.ownerUserID, owner.UserID)
+			}
+			continue
+		}
+		room.Strokes = []Stroke{}
+		r.AddRoom(room, owners[room.ID])
+		newRooms++
+	}
+
+	since := lastStrokeID - snapshotReconcileMargin
+	if since < 0 {
+		since = 0
+	}
+	strokesByRoom, err := loadStrokesSince(since)
+	if err != nil {
+		return err
+	}
+
+	newStrokes := 0
+	for roomID, strokes := range strokesByRoom {
+		room, ok := r.Get(roomID)
+		if !ok {
+			log.Println("[warn] stroke for unknown room", roomID)
+			continue
+		}
+
+		room.mu.Lock()
+		known := map[int64]bool{}
+		for i := len(room.Strokes) - 1; i >= 0 && room.Strokes[i].ID > since; i-- {
+			known[room.Strokes[i].ID] = true
+		}
+		// 公開済みの slice は書き換えられないので、コピーしてから並べ直す
+		merged := append([]Stroke{}, room.Strokes...)
+		for _, s := range strokes {
+			if known[s.ID] {
+				continue
+			}
+			merged = append(merged, s)
+			newStrokes++
+		}
+		if len(merged) > len(room.Strokes) {
+			sort.Slice(merged, func(i, j int) bool {
+				return merged[i].ID < merged[j].ID
+			})
+			room.Strokes = merged
+			room.StrokeCount = len(room.Strokes)
+			room.publishStrokes()
+		}
+		room.mu.Unlock()
+	}
+
+	// 削除の記録は少ないので全部読み直して、スナップショットの後に消されたストロークを外す
+	tombstones, err := loadTombstones()
+	if err != nil {
+		return err
+	}
+	newTombstones := 0
+	for roomID, list := range tombstones {
+		known := map[int64]bool{}
+		for _, ts := range r.GetTombstones(roomID, 0) {
+			known[ts.ID] = true
+		}
+		for _, ts := range list {
+			if !known[ts.ID] {
+				r.DeleteStroke(ts)
+				newTombstones++
+			}
+		}
+	}
+
+	log.Printf("reconciled snapshot with MySQL: %d new rooms, %d new strokes, %d new tombstones", newRooms, newStrokes, newTombstones)
+	return nil
+}
+
+// runSnapshotter は interval ごとにスナップショットを書き出す
+func (r *RoomRepo) runSnapshotter(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		start := time.Now()
+		if err := r.SaveSnapshot(path); err != nil {
+			log.Println("snapshot:", err)
+			continue
+		}
+		log.Printf("saved snapshot %s in %s", path, time.Since(start))
+	}
+}
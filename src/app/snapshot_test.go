@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// saveAndLoadSnapshot は repo をスナップショットに書いて、新しい RoomRepo に読み直す
+func saveAndLoadSnapshot(t *testing.T, repo *RoomRepo) (*RoomRepo, int64) {
+	dir, err := ioutil.TempDir("", "isuketch-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot")
+	if err := repo.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewRoomRepo()
+	lastStrokeID, err := loaded.LoadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loaded, lastStrokeID
+}
+
+// TestReconcileRoomOwners はスナップショットの後にトークンの更新で持ち主が変わった部屋が、
+// 起動時に MySQL の持ち主に直されることを確かめる
+func TestReconcileRoomOwners(t *testing.T) {
+	defer useTestDB(t)()
+	if os.Getenv("TEST_MYSQL_DSN") != "" {
+		t.Skip("uses canned rows of the recording driver")
+	}
+
+	createdAt := time.Now().Truncate(time.Second)
+	repo := NewRoomRepo()
+	repo.AddRoom(&Room{ID: 1, Name: "old", CanvasWidth: 100, CanvasHeight: 100, CreatedAt: createdAt, Strokes: []Stroke{}}, roomOwner{TokenID: 1})
+	repo.AddRoom(&Room{ID: 2, Name: "kept", CanvasWidth: 100, CanvasHeight: 100, CreatedAt: createdAt, Strokes: []Stroke{}}, roomOwner{TokenID: 3})
+	loaded, lastStrokeID := saveAndLoadSnapshot(t, repo)
+
+	roomColumns := []string{"id", "name", "canvas_width", "canvas_height", "created_at"}
+	testRecordDriver.setRows("FROM `rooms`", roomColumns,
+		[]driver.Value{int64(1), "old", int64(100), int64(100), createdAt},
+		[]driver.Value{int64(2), "kept", int64(100), int64(100), createdAt},
+		[]driver.Value{int64(3), "new", int64(100), int64(100), createdAt},
+	)
+	testRecordDriver.setRows("FROM `room_owners`", []string{"room_id", "token_id", "user_id"},
+		[]driver.Value{int64(1), int64(2), int64(7)},
+		[]driver.Value{int64(2), int64(3), int64(0)},
+		[]driver.Value{int64(3), int64(4), int64(0)},
+	)
+	if err := loaded.Reconcile(lastStrokeID); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int64]roomOwner{
+		1: {TokenID: 2, UserID: 7},
+		2: {TokenID: 3},
+		3: {TokenID: 4},
+	}
+	for roomID, owner := range want {
+		room, ok := loaded.Get(roomID)
+		if !ok {
+			t.Fatalf("room %d not found", roomID)
+		}
+		if got := room.Owner(); got != owner {
+			t.Errorf("room %d: owner %+v, want %+v", roomID, got, owner)
+		}
+	}
+}
+
+// TestLoadSnapshotReencodesAuthors は鍵が変わって起動したときに、スナップショットの
+// ストロークの author ハンドルと JSON を今の鍵で作り直すことを確かめる
+func TestLoadSnapshotReencodesAuthors(t *testing.T) {
+	prev := authorSecret
+	defer func() { authorSecret = prev }()
+	dir, err := ioutil.TempDir("", "isuketch-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot")
+
+	setAuthorSecret("old")
+	repo := NewRoomRepo()
+	repo.AddRoom(&Room{ID: 1, Name: "authors", CanvasWidth: 100, CanvasHeight: 100, Strokes: []Stroke{}}, roomOwner{TokenID: 1})
+	repo.AddStroke(1, Stroke{ID: 1, RoomID: 1, Width: 4, AuthorTokenID: 3}, []Point{{ID: 1, StrokeID: 1, X: 1, Y: 2}})
+	if err := repo.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{"old", "new"} {
+		setAuthorSecret(secret)
+		loaded := NewRoomRepo()
+		if _, err := loaded.LoadSnapshot(path); err != nil {
+			t.Fatal(err)
+		}
+		room, ok := loaded.Get(1)
+		if !ok {
+			t.Fatal("room not loaded")
+		}
+		got := room.StrokesSnapshot()[0]
+		want := authorHandle(3, 0)
+		if got.Author != want {
+			t.Errorf("%s: author %q, want %q", secret, got.Author, want)
+		}
+		var decoded struct {
+			Author string `json:"author"`
+		}
+		if err := json.Unmarshal(got.json, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Author != want {
+			t.Errorf("%s: author in JSON %q, want %q", secret, decoded.Author, want)
+		}
+	}
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// RoomStore は部屋とストロークの保存先。起動時に ROOM_STORE で選ぶ。
+//
+//	cached: MySQL に書いて RoomRepo にキャッシュする (デフォルト)
+//	mysql:  毎回 MySQL に問い合わせる
+//	memory: RoomRepo だけに持つ。MySQL 無しでハンドラを試すとき用
+//
+// ストロークを追加したり消したりしたら hub.Notify を呼ぶのは呼ぶ側の責任。
+type RoomStore interface {
+	Init() error
+	CreateRoom(name string, canvasWidth int, canvasHeight int, owner roomOwner, settings roomSettings) (*Room, error)
+	// GetRoom は部屋が無ければ errRoomNotFound を返す
+	GetRoom(roomID int64) (*Room, error)
+	AddStroke(roomID int64, s Stroke) (*Stroke, error)
+	GetStrokes(roomID int64, greaterThanID int64) ([]Stroke, error)
+	// GetStroke と LastStrokeBy はストロークが無ければ errStrokeNotFound を返す
+	GetStroke(roomID int64, strokeID int64) (*Stroke, error)
+	LastStrokeBy(roomID int64, tokenID int64, userID int64) (*Stroke, error)
+	DeleteStroke(roomID int64, strokeID int64) (*strokeTombstone, error)
+	// GetTombstones は ID が afterID より大きい削除の記録を ID 順で返す
+	GetTombstones(roomID int64, afterID int64) ([]strokeTombstone, error)
+	RecentRooms(limit int) ([]*Room, error)
+	RoomOwner(roomID int64) (roomOwner, error)
+	// TransferRooms は fromTokenID が持っている部屋をすべて toTokenID に移す
+	TransferRooms(fromTokenID int64, toTokenID int64) error
+	// ClaimRooms は tokenID で作った部屋を userID のアカウントのものにする
+	ClaimRooms(tokenID int64, userID int64) error
+}
+
+var store RoomStore
+
+func newRoomStore(kind string) (RoomStore, error) {
+	switch kind {
+	case "", "cached":
+		return &cachedRoomStore{db: &mysqlRoomStore{}, repo: roomRepo}, nil
+	case "writebehind":
+		return newWriteBehindRoomStore(&cachedRoomStore{db: &mysqlRoomStore{}, repo: roomRepo}), nil
+	case "mysql":
+		return &mysqlRoomStore{}, nil
+	case "memory":
+		return &memRoomStore{repo: roomRepo}, nil
+	}
+	return nil, fmt.Errorf("unknown room store: %q", kind)
+}
+
+type memRoomStore struct {
+	repo *RoomRepo
+
+	lastRoomID      int64
+	lastStrokeID    int64
+	lastPointID     int64
+	lastTombstoneID int64
+}
+
+func (m *memRoomStore) Init() error {
+	return nil
+}
+
+func (m *memRoomStore) CreateRoom(name string, canvasWidth int, canvasHeight int, owner roomOwner, settings roomSettings) (*Room, error) {
+	room := &Room{
+		ID:           atomic.AddInt64(&m.lastRoomID, 1),
+		Name:         name,
+		CanvasWidth:  canvasWidth,
+		CanvasHeight: canvasHeight,
+		CreatedAt:    time.Now(),
+		Strokes:      []Stroke{},
+	}
+	// 一覧に出る前に設定を入れておく
+	acl.set(room.ID, settings)
+	m.repo.AddRoom(room, owner)
+	return room, nil
+}
+
+func (m *memRoomStore) GetRoom(roomID int64) (*Room, error) {
+	room, ok := m.repo.Get(roomID)
+	if !ok {
+		return nil, errRoomNotFound
+	}
+	return room, nil
+}
+
+func (m *memRoomStore) AddStroke(roomID int64, s Stroke) (*Stroke, error) {
+	room, ok := m.repo.Get(roomID)
+	if !ok {
+		return nil, errRoomNotFound
+	}
+	room.addMtx.Lock()
+	defer room.addMtx.Unlock()
+
+	s.ID = atomic.AddInt64(&m.lastStrokeID, 1)
+	s.RoomID = roomID
+	s.CreatedAt = time.Now()
+	points := make([]Point, len(s.Points))
+	for i, p := range s.Points {
+		points[i] = Point{
+			ID:       atomic.AddInt64(&m.lastPointID, 1),
+			StrokeID: s.ID,
+			X:        p.X,
+			Y:        p.Y,
+		}
+	}
+	s.Points = points
+
+	m.repo.AddStroke(roomID, s, s.Points)
+	return &s, nil
+}
+
+func (m *memRoomStore) GetStrokes(roomID int64, greaterThanID int64) ([]Stroke, error) {
+	return m.repo.GetStrokes(roomID, greaterThanID), nil
+}
+
+func (m *memRoomStore) GetStroke(roomID int64, strokeID int64) (*Stroke, error) {
+	s, ok := m.repo.FindStroke(roomID, strokeID)
+	if !ok {
+		return nil, errStrokeNotFound
+	}
+	return s, nil
+}
+
+func (m *memRoomStore) LastStrokeBy(roomID int64, tokenID int64, userID int64) (*Stroke, error) {
+	s, ok := m.repo.LastStrokeBy(roomID, tokenID, userID)
+	if !ok {
+		return nil, errStrokeNotFound
+	}
+	return s, nil
+}
+
+func (m *memRoomStore) DeleteStroke(roomID int64, strokeID int64) (*strokeTombstone, error) {
+	room, ok := m.repo.Get(roomID)
+	if !ok {
+		return nil, errRoomNotFound
+	}
+	room.addMtx.Lock()
+	defer room.addMtx.Unlock()
+
+	if _, ok := m.repo.FindStroke(roomID, strokeID); !ok {
+		return nil, errStrokeNotFound
+	}
+	ts := strokeTombstone{
+		ID:        atomic.AddInt64(&m.lastTombstoneID, 1),
+		RoomID:    roomID,
+		StrokeID:  strokeID,
+		DeletedAt: time.Now(),
+	}
+	m.repo.DeleteStroke(ts)
+	return &ts, nil
+}
+
+func (m *memRoomStore) GetTombstones(roomID int64, afterID int64) ([]strokeTombstone, error) {
+	return m.repo.GetTombstones(roomID, afterID), nil
+}
+
+func (m *memRoomStore) RecentRooms(limit int) ([]*Room, error) {
+	return m.repo.RecentRooms(limit), nil
+}
+
+func (m *memRoomStore) RoomOwner(roomID int64) (roomOwner, error) {
+	room, ok := m.repo.Get(roomID)
+	if !ok {
+		return roomOwner{}, errRoomNotFound
+	}
+	return room.Owner(), nil
+}
+
+func (m *memRoomStore) TransferRooms(fromTokenID int64, toTokenID int64) error {
+	m.repo.TransferRooms(fromTokenID, toTokenID)
+	return nil
+}
+
+func (m *memRoomStore) ClaimRooms(tokenID int64, userID int64) error {
+	m.repo.ClaimRooms(tokenID, userID)
+	return nil
+}
+
+type mysqlRoomStore struct{}
+
+// Init は消した行の ID を AUTO_INCREMENT で使い直さないようにする。
+// MySQL 5.7 は起動し直すと AUTO_INCREMENT を MAX(id)+1 に戻すので、最後のストロークを消してから
+// 起動し直すと同じ ID を採番してしまい、stroke_tombstones の UNIQUE にぶつかる
+func (m *mysqlRoomStore) Init() error {
+	lastStrokeID, err := lastUsedStrokeID()
+	if err != nil {
+		return err
+	}
+	lastPointID, err := lastUsedPointID()
+	if err != nil {
+		return err
+	}
+	// 今の値より小さければ MySQL が MAX(id)+1 にするので、そのまま指定してよい
+	if _, err := dbx.Exec(fmt.Sprintf("ALTER TABLE `strokes` AUTO_INCREMENT = %d", lastStrokeID+1)); err != nil {
+		return err
+	}
+	if _, err := dbx.Exec(fmt.Sprintf("ALTER TABLE `points` AUTO_INCREMENT = %d", lastPointID+1)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// lastUsedStrokeID は消したストロークも含めて、使ったことのあるストロークの ID の最大を返す
+func lastUsedStrokeID() (int64, error) {
+	return maxIDOf(
+		"SELECT COALESCE(MAX(`id`), 0) FROM `strokes`",
+		"SELECT COALESCE(MAX(`stroke_id`), 0) FROM `stroke_tombstones`",
+	)
+}
+
+// lastUsedPointID は消した点も含めて、使ったことのある点の ID の最大を返す
+func lastUsedPointID() (int64, error) {
+	return maxIDOf(
+		"SELECT COALESCE(MAX(`id`), 0) FROM `points`",
+		"SELECT COALESCE(MAX(`last_id`), 0) FROM `deleted_id_marks` WHERE `name` = 'points'",
+	)
+}
+
+// maxIDOf は1つの値を返す queries の結果のうち一番大きいものを返す
+func maxIDOf(queries ...string) (int64, error) {
+	var max int64
+	for _, q := range queries {
+		var id int64
+		if err := dbx.QueryRow(q).Scan(&id); err != nil {
+			return 0, err
+		}
+		if id > max {
+			max = id
+		}
+	}
+	return max, nil
+}
+
+func (m *mysqlRoomStore) CreateRoom(name string, canvasWidth int, canvasHeight int, owner roomOwner, settings roomSettings) (*Room, error) {
+	tx, err := dbx.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	query := "INSERT INTO `rooms` (`name`, `canvas_width`, `canvas_height`)"
+	query += " VALUES (?, ?, ?)"
+
+	result, err := tx.Exec(query, name, canvasWidth, canvasHeight)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	roomID, err := result.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	query = "INSERT INTO `room_owners` (`room_id`, `token_id`) VALUES (?, ?)"
+	if _, err := tx.Exec(query, roomID, owner.TokenID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if owner.UserID != 0 {
+		query = "INSERT INTO `room_user_owners` (`room_id`, `user_id`) VALUES (?, ?)"
+		if _, err := tx.Exec(query, roomID, owner.UserID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if settings != defaultRoomSettings {
+		query = "INSERT INTO `room_settings` (`room_id`, `visibility`, `drawing`) VALUES (?, ?, ?)"
+		if _, err := tx.Exec(query, roomID, settings.Visibility, settings.Drawing); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	// 一覧に出る前に設定を入れておく
+	acl.set(roomID, settings)
+
+	room, err := getRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	room.ownerID = owner.TokenID
+	room.ownerUserID = owner.UserID
+	room.publishStrokes()
+	return room, nil
+}
+
+func (m *mysqlRoomStore) GetRoom(roomID int64) (*Room, error) {
+	room, err := getRoom(roomID)
+	if err == sql.ErrNoRows {
+		return nil, errRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	room.Strokes, err = m.GetStrokes(roomID, 0)
+	if err != nil {
+		return nil, err
+	}
+	room.StrokeCount = len(room.Strokes)
+	room.publishStrokes()
+	return room, nil
+}
+
+// 点は複数行の INSERT でまとめて書く。max_allowed_packet を超えないように
+// 1文あたりの行数を抑える (1行はおおよそ 50 バイト)
+const pointInsertChunkSize = 1000
+
+// AddStroke は読み直しをせずに、採番された ID から作成したストロークを組み立てる。
+// 1つの INSERT 文で入れた行の ID は連番になる前提 (auto_increment_increment = 1)。
+func (m *mysqlRoomStore) AddStroke(roomID int64, postedStroke Stroke) (*Stroke, error) {
+	// created_at は DATETIME(6) なので精度を合わせておく
+	createdAt := time.Now().Truncate(time.Microsecond)
+
+	tx, err := dbx.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	query := "INSERT INTO `strokes` (`room_id`, `width`, `red`, `green`, `blue`, `alpha`, `created_at`)"
+	query += " VALUES(?, ?, ?, ?, ?, ?, ?)"
+
+	result, err := tx.Exec(query,
+		roomID,
+		postedStroke.Width,
+		postedStroke.Red,
+		postedStroke.Green,
+		postedStroke.Blue,
+		postedStroke.Alpha,
+		createdAt,
+	)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	strokeID, err := result.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	points := make([]Point, len(postedStroke.Points))
+	for i, p := range postedStroke.Points {
+		points[i] = Point{StrokeID: strokeID, X: p.X, Y: p.Y}
+	}
+	if err := insertPoints(tx, points); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if postedStroke.AuthorTokenID != 0 {
+		query = "INSERT INTO `stroke_authors` (`stroke_id`, `token_id`, `user_id`) VALUES (?, ?, ?)"
+		if _, err := tx.Exec(query, strokeID, postedStroke.AuthorTokenID, postedStroke.AuthorUserID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if postedStroke.LayerID != 0 {
+		query = "INSERT INTO `stroke_layers` (`stroke_id`, `layer_id`) VALUES (?, ?)"
+		if _, err := tx.Exec(query, strokeID, postedStroke.LayerID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if postedStroke.Type != shapePolyline {
+		query = "INSERT INTO `stroke_shapes` (`stroke_id`, `type`, `fill`, `text`) VALUES (?, ?, ?, ?)"
+		if _, err := tx.Exec(query, strokeID, postedStroke.Type, postedStroke.Fill, postedStroke.Text); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	s := Stroke{
+		ID:        strokeID,
+		RoomID:    roomID,
+		Width:     postedStroke.Width,
+		Red:       postedStroke.Red,
+		Green:     postedStroke.Green,
+		Blue:      postedStroke.Blue,
+		Alpha:     postedStroke.Alpha,
+		CreatedAt: createdAt,
+		Points:    points,
+		LayerID:   postedStroke.LayerID,
+		Type:      postedStroke.Type,
+		Fill:      postedStroke.Fill,
+		Text:      postedStroke.Text,
+
+		AuthorTokenID: postedStroke.AuthorTokenID,
+		AuthorUserID:  postedStroke.AuthorUserID,
+	}
+	s.setAuthor()
+	return &s, nil
+}
+
+// insertPoints は points を pointInsertChunkSize 行ずつ INSERT して、採番された ID を points に入れる
+func insertPoints(tx *sqlx.Tx, points []Point) error {
+	for len(points) > 0 {
+		n := len(points)
+		if n > pointInsertChunkSize {
+			n = pointInsertChunkSize
+		}
+		chunk := points[:n]
+		points = points[n:]
+
+		query := make([]byte, 0, 64+len(chunk)*10)
+		query = append(query, "INSERT INTO `points` (`stroke_id`, `x`, `y`) VALUES "...)
+		args := make([]interface{}, 0, len(chunk)*3)
+		for i, p := range chunk {
+			if i > 0 {
+				query = append(query, ',')
+			}
+			query = append(query, "(?, ?, ?)"...)
+			args = append(args, p.StrokeID, p.X, p.Y)
+		}
+
+		result, err := tx.Exec(string(query), args...)
+		if err != nil {
+			return err
+		}
+		firstID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for i := range chunk {
+			chunk[i].ID = firstID + int64(i)
+		}
+	}
+	return nil
+}
+
+func (m *mysqlRoomStore) GetStrokes(roomID int64, greaterThanID int64) ([]Stroke, error) {
+	strokes, err := getStrokes(roomID, greaterThanID)
+	if err != nil {
+		return nil, err
+	}
+	if len(strokes) == 0 {
+		return strokes, nil
+	}
+
+	// ストロークごとに引くと本数だけ往復するので、部屋の点をまとめて引いて振り分ける
+	index := make(map[int64]int, len(strokes))
+	for i := range strokes {
+		index[strokes[i].ID] = i
+	}
+	query := "SELECT p.`id`, p.`stroke_id`, p.`x`, p.`y` FROM `points` p JOIN `strokes` s ON s.`id` = p.`stroke_id`"
+	query += " WHERE s.`room_id` = ? AND s.`id` > ? AND s.`id` <= ? ORDER BY p.`stroke_id` ASC, p.`id` ASC"
+	ps := []Point{}
+	if err := dbx.Select(&ps, query, roomID, greaterThanID, strokes[len(strokes)-1].ID); err != nil {
+		return nil, err
+	}
+	for _, p := range ps {
+		i, ok := index[p.StrokeID]
+		if !ok {
+			continue
+		}
+		strokes[i].Points = append(strokes[i].Points, p)
+	}
+	return strokes, nil
+}
+
+func (m *mysqlRoomStore) GetStroke(roomID int64, strokeID int64) (*Stroke, error) {
+	s := &Stroke{}
+	err := dbx.Get(s, strokeSelectQuery+" WHERE s.`room_id` = ? AND s.`id` = ?", roomID, strokeID)
+	if err == sql.ErrNoRows {
+		return nil, errStrokeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Points, err = getStrokePoints(s.ID)
+	if err != nil {
+		return nil, err
+	}
+	s.setAuthor()
+	return s, nil
+}
+
+func (m *mysqlRoomStore) LastStrokeBy(roomID int64, tokenID int64, userID int64) (*Stroke, error) {
+	query := "SELECT s.`id` FROM `strokes` s JOIN `stroke_authors` a ON a.`stroke_id` = s.`id`"
+	query += " WHERE s.`room_id` = ? AND (a.`token_id` = ? OR (a.`user_id` <> 0 AND a.`user_id` = ?))"
+	query += " ORDER BY s.`id` DESC LIMIT 1"
+	var strokeID int64
+	err := dbx.QueryRow(query, roomID, tokenID, userID).Scan(&strokeID)
+	if err == sql.ErrNoRows {
+		return nil, errStrokeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m.GetStroke(roomID, strokeID)
+}
+
+func (m *mysqlRoomStore) DeleteStroke(roomID int64, strokeID int64) (*strokeTombstone, error) {
+	ts := strokeTombstone{
+		RoomID:    roomID,
+		StrokeID:  strokeID,
+		DeletedAt: time.Now().Truncate(time.Microsecond),
+	}
+
+	tx, err := dbx.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	err = tx.QueryRow("SELECT COUNT(*) FROM `strokes` WHERE `id` = ? AND `room_id` = ? FOR UPDATE", strokeID, roomID).Scan(&n)
+	if err == nil && n == 0 {
+		err = errStrokeNotFound
+	}
+	if err == nil {
+		_, err = deleteStrokeRows(tx, strokeID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	result, err := tx.Exec("INSERT INTO `stroke_tombstones` (`room_id`, `stroke_id`, `deleted_at`) VALUES (?, ?, ?)", ts.RoomID, ts.StrokeID, ts.DeletedAt)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	ts.ID, err = result.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &ts, nil
+}
+
+func (m *mysqlRoomStore) GetTombstones(roomID int64, afterID int64) ([]strokeTombstone, error) {
+	tombstones := []strokeTombstone{}
+	query := "SELECT `id`, `room_id`, `stroke_id`, `deleted_at` FROM `stroke_tombstones` WHERE `room_id` = ? AND `id` > ? ORDER BY `id` ASC"
+	err := dbx.Select(&tombstones, query, roomID, afterID)
+	return tombstones, err
+}
+
+func (m *mysqlRoomStore) RecentRooms(limit int) ([]*Room, error) {
+	query := "SELECT `room_id`, MAX(`id`) AS `max_id` FROM `strokes`"
+	query += " GROUP BY `room_id` ORDER BY `max_id` DESC LIMIT ?"
+
+	type result struct {
+		RoomID int64 `db:"room_id"`
+		MaxID  int64 `db:"max_id"`
+	}
+
+	results := []result{}
+	err := dbx.Select(&results, query, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := []*Room{}
+	for _, r := range results {
+		room, err := getRoom(r.RoomID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// 一覧では Points を返さないので読まない
+		room.Strokes, err = getStrokes(r.RoomID, 0)
+		if err != nil {
+			return nil, err
+		}
+		room.StrokeCount = len(room.Strokes)
+		room.publishStrokes()
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+func (m *mysqlRoomStore) RoomOwner(roomID int64) (roomOwner, error) {
+	owner := roomOwner{}
+	query := "SELECT o.`token_id`, COALESCE(u.`user_id`, 0) AS `user_id` FROM `room_owners` o"
+	query += " LEFT JOIN `room_user_owners` u ON u.`room_id` = o.`room_id` WHERE o.`room_id` = ?"
+	err := dbx.Get(&owner, query, roomID)
+	if err == sql.ErrNoRows {
+		return roomOwner{}, errRoomNotFound
+	}
+	return owner, err
+}
+
+func (m *mysqlRoomStore) TransferRooms(fromTokenID int64, toTokenID int64) error {
+	_, err := dbx.Exec("UPDATE `room_owners` SET `token_id` = ? WHERE `token_id` = ?", toTokenID, fromTokenID)
+	return err
+}
+
+func (m *mysqlRoomStore) ClaimRooms(tokenID int64, userID int64) error {
+	query := "INSERT IGNORE INTO `room_user_owners` (`room_id`, `user_id`)"
+	query += " SELECT `room_id`, ? FROM `room_owners` WHERE `token_id` = ?"
+	_, err := dbx.Exec(query, userID, tokenID)
+	return err
+}
+
+// cachedRoomStore は書き込みを MySQL に通してから RoomRepo に反映し、読み込みは RoomRepo から返す
+type cachedRoomStore struct {
+	db   *mysqlRoomStore
+	repo *RoomRepo
+}
+
+func (c *cachedRoomStore) Init() error {
+	if err := c.db.Init(); err != nil {
+		return err
+	}
+	if snapshotPath == "" {
+		return c.repo.Init()
+	}
+
+	start := time.Now()
+	lastStrokeID, err := c.repo.LoadSnapshot(snapshotPath)
+	if err == nil {
+		err = c.repo.Reconcile(lastStrokeID)
+		if err != nil {
+			return err
+		}
+		startupStats.Set("room_repo_init", expvarDuration(time.Since(start)))
+	} else {
+		log.Println("snapshot not loaded, falling back to MySQL:", err)
+		if err := c.repo.Init(); err != nil {
+			return err
+		}
+	}
+	go c.repo.runSnapshotter(snapshotPath, snapshotInterval)
+	return nil
+}
+
+func (c *cachedRoomStore) CreateRoom(name string, canvasWidth int, canvasHeight int, owner roomOwner, settings roomSettings) (*Room, error) {
+	room, err := c.db.CreateRoom(name, canvasWidth, canvasHeight, owner, settings)
+	if err != nil {
+		return nil, err
+	}
+	c.repo.AddRoom(room, owner)
+	return room, nil
+}
+
+func (c *cachedRoomStore) GetRoom(roomID int64) (*Room, error) {
+	room, ok := c.repo.Get(roomID)
+	if !ok {
+		return nil, errRoomNotFound
+	}
+	return room, nil
+}
+
+func (c *cachedRoomStore) AddStroke(roomID int64, postedStroke Stroke) (*Stroke, error) {
+	room, ok := c.repo.Get(roomID)
+	if !ok {
+		return nil, errRoomNotFound
+	}
+	// AUTO_INCREMENT の採番と RoomRepo に入れる順番を揃える
+	room.addMtx.Lock()
+	defer room.addMtx.Unlock()
+
+	s, err := c.db.AddStroke(roomID, postedStroke)
+	if err != nil {
+		return nil, err
+	}
+	c.repo.AddStroke(roomID, *s, s.Points)
+	return s, nil
+}
+
+func (c *cachedRoomStore) GetStrokes(roomID int64, greaterThanID int64) ([]Stroke, error) {
+	return c.repo.GetStrokes(roomID, greaterThanID), nil
+}
+
+func (c *cachedRoomStore) GetStroke(roomID int64, strokeID int64) (*Stroke, error) {
+	s, ok := c.repo.FindStroke(roomID, strokeID)
+	if !ok {
+		return nil, errStrokeNotFound
+	}
+	return s, nil
+}
+
+func (c *cachedRoomStore) LastStrokeBy(roomID int64, tokenID int64, userID int64) (*Stroke, error) {
+	s, ok := c.repo.LastStrokeBy(roomID, tokenID, userID)
+	if !ok {
+		return nil, errStrokeNotFound
+	}
+	return s, nil
+}
+
+func (c *cachedRoomStore) DeleteStroke(roomID int64, strokeID int64) (*strokeTombstone, error) {
+	room, ok := c.repo.Get(roomID)
+	if !ok {
+		return nil, errRoomNotFound
+	}
+	room.addMtx.Lock()
+	defer room.addMtx.Unlock()
+
+	ts, err := c.db.DeleteStroke(roomID, strokeID)
+	if err != nil {
+		return nil, err
+	}
+	c.repo.DeleteStroke(*ts)
+	return ts, nil
+}
+
+func (c *cachedRoomStore) GetTombstones(roomID int64, afterID int64) ([]strokeTombstone, error) {
+	return c.repo.GetTombstones(roomID, afterID), nil
+}
+
+func (c *cachedRoomStore) RecentRooms(limit int) ([]*Room, error) {
+	return c.repo.RecentRooms(limit), nil
+}
+
+func (c *cachedRoomStore) RoomOwner(roomID int64) (roomOwner, error) {
+	room, ok := c.repo.Get(roomID)
+	if !ok {
+		return roomOwner{}, errRoomNotFound
+	}
+	return room.Owner(), nil
+}
+
+func (c *cachedRoomStore) TransferRooms(fromTokenID int64, toTokenID int64) error {
+	if err := c.db.TransferRooms(fromTokenID, toTokenID); err != nil {
+		return err
+	}
+	c.repo.TransferRooms(fromTokenID, toTokenID)
+	return nil
+}
+
+func (c *cachedRoomStore) ClaimRooms(tokenID int64, userID int64) error {
+	if err := c.db.ClaimRooms(tokenID, userID); err != nil {
+		return err
+	}
+	c.repo.ClaimRooms(tokenID, userID)
+	return nil
+}
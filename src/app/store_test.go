@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// recordDriver は実行した文を覚えておくだけの database/sql のドライバ。
+// LastInsertId は文の行数だけ進めた連番を返すので、AUTO_INCREMENT と同じように振る舞う。
+// SELECT は setRows で決めておいた結果を返し、決めていなければ0行を返す。
+type recordDriver struct {
+	mu     sync.Mutex
+	execs  []recordedExec
+	lastID int64
+	rows   map[string]recordedRows
+	// これを含む文の Exec を失敗させる
+	failExec string
+	// これを含む文の Exec を hold が閉じるまで待たせる
+	holdExec string
+	hold     chan struct{}
+}
+
+type recordedExec struct {
+	query string
+	rows  int
+}
+
+var testRecordDriver = &recordDriver{}
+
+func init() {
+	sql.Register("isuketch-record", testRecordDriver)
+}
+
+func (d *recordDriver) Open(name string) (driver.Conn, error) {
+	return recordConn{d}, nil
+}
+
+func (d *recordDriver) reset() {
+	d.mu.Lock()
+	d.execs = nil
+	d.lastID = 0
+	d.rows = nil
+	d.failExec = ""
+	d.holdExec = ""
+	d.hold = nil
+	d.mu.Unlock()
+}
+
+// setRows は match を含む SELECT の結果を決める。複数当てはまるときは match の長い方を使う
+func (d *recordDriver) setRows(match string, columns []string, rows ...[]driver.Value) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.rows == nil {
+		d.rows = map[string]recordedRows{}
+	}
+	d.rows[match] = recordedRows{columns: columns, rows: rows}
+}
+
+// failOn は match を含む文の Exec をエラーにする。空なら戻す
+func (d *recordDriver) failOn(match string) {
+	d.mu.Lock()
+	d.failExec = match
+	d.mu.Unlock()
+}
+
+// holdOn は match を含む文の Exec を、返した関数を呼ぶまで待たせる
+func (d *recordDriver) holdOn(match string) func() {
+	hold := make(chan struct{})
+	d.mu.Lock()
+	d.holdExec = match
+	d.hold = hold
+	d.mu.Unlock()
+	return func() { close(hold) }
+}
+
+type recordConn struct{ d *recordDriver }
+
+func (c recordConn) Prepare(query string) (driver.Stmt, error) {
+	return recordStmt{c.d, query}, nil
+}
+func (c recordConn) Close() error              { return nil }
+func (c recordConn) Begin() (driver.Tx, error) { return recordTx{}, nil }
+
+type recordTx struct{}
+
+func (recordTx) Commit() error   { return nil }
+func (recordTx) Rollback() error { return nil }
+
+type recordStmt struct {
+	d     *recordDriver
+	query string
+}
+
+func (s recordStmt) Close() error  { return nil }
+func (s recordStmt) NumInput() int { return -1 }
+
+func (s recordStmt) Exec(args []driver.Value) (driver.Result, error) {
+	rows := strings.Count(s.query, "(?")
+	s.d.mu.Lock()
+	if s.d.holdExec != "" && strings.Contains(s.query, s.d.holdExec) {
+		hold := s.d.hold
+		s.d.mu.Unlock()
+		<-hold
+		s.d.mu.Lock()
+	}
+	defer s.d.mu.Unlock()
+	if s.d.failExec != "" && strings.Contains(s.query, s.d.failExec) {
+		return nil, fmt.Errorf("recordDriver: fail %q", s.query)
+	}
+	s.d.execs = append(s.d.execs, recordedExec{query: s.query, rows: rows})
+	first := s.d.lastID + 1
+	s.d.lastID += int64(rows)
+	return recordResult{rows: int64(rows), id: first}, nil
+}
+
+func (s recordStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	found := ""
+	for match := range s.d.rows {
+		if strings.Contains(s.query, match) && len(match) > len(found) {
+			found = match
+		}
+	}
+	if found == "" {
+		return &recordedRows{}, nil
+	}
+	r := s.d.rows[found]
+	return &recordedRows{columns: r.columns, rows: r.rows}, nil
+}
+
+type recordedRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *recordedRows) Columns() []string { return r.columns }
+func (r *recordedRows) Close() error      { return nil }
+
+func (r *recordedRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+type recordResult struct{ rows, id int64 }
+
+func (r recordResult) LastInsertId() (int64, error) { return r.id, nil }
+func (r recordResult) RowsAffected() (int64, error) { return r.rows, nil }
+
+// useTestDB は TEST_MYSQL_DSN があればその MySQL を、無ければ recordDriver を dbx にする
+func useTestDB(tb testing.TB) func() {
+	prev := dbx
+	if dsn := os.Getenv("TEST_MYSQL_DSN"); dsn != "" {
+		db, err := sqlx.Open("mysql", dsn)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		dbx = db
+		if err := migrate(); err != nil {
+			tb.Fatal(err)
+		}
+	} else {
+		testRecordDriver.reset()
+		db, err := sql.Open("isuketch-record", "")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		dbx = sqlx.NewDb(db, "mysql")
+	}
+	return func() {
+		dbx.Close()
+		dbx = prev
+	}
+}
+
+func TestInsertPointsChunks(t *testing.T) {
+	defer useTestDB(t)()
+	if os.Getenv("TEST_MYSQL_DSN") != "" {
+		t.Skip("counts statements with the recording driver")
+	}
+
+	for _, n := range []int{1, pointInsertChunkSize - 1, pointInsertChunkSize, pointInsertChunkSize + 1, 2*pointInsertChunkSize + 500} {
+		testRecordDriver.reset()
+		points := make([]Point, n)
+		for i := range points {
+			points[i] = Point{StrokeID: 1, X: float64(i), Y: float64(i)}
+		}
+
+		tx, err := dbx.Beginx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := insertPoints(tx, points); err != nil {
+			t.Fatal(err)
+		}
+		tx.Commit()
+
+		want := (n + pointInsertChunkSize - 1) / pointInsertChunkSize
+		if len(testRecordDriver.execs) != want {
+			t.Errorf("%d points: %d statements, want %d", n, len(testRecordDriver.execs), want)
+		}
+		total := 0
+		for _, e := range testRecordDriver.execs {
+			if e.rows > pointInsertChunkSize {
+				t.Errorf("%d points: %d rows in one statement", n, e.rows)
+			}
+			total += e.rows
+		}
+		if total != n {
+			t.Errorf("%d points: inserted %d rows", n, total)
+		}
+		for i, p := range points {
+			if p.ID != int64(i+1) {
+				t.Fatalf("%d points: points[%d].ID = %d, want %d", n, i, p.ID, i+1)
+			}
+		}
+	}
+}
+
+// BenchmarkMySQLAddStroke は点の数ごとの AddStroke の時間を測る。
+// TEST_MYSQL_DSN が無いときは MySQL への往復を除いた、文を組み立てる分だけを測る
+func BenchmarkMySQLAddStroke(b *testing.B) {
+	defer useTestDB(b)()
+	m := &mysqlRoomStore{}
+
+	for _, n := range []int{10, 100, 1000, 5000} {
+		s := Stroke{Width: 4, Alpha: 1, Points: make([]Point, n)}
+		for i := range s.Points {
+			s.Points[i] = Point{X: float64(i), Y: float64(i)}
+		}
+		b.Run(fmt.Sprintf("points=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := m.AddStroke(1, s); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMySQLGetStrokesPoints(t *testing.T) {
+	defer useTestDB(t)()
+	if os.Getenv("TEST_MYSQL_DSN") != "" {
+		t.Skip("uses canned rows of the recording driver")
+	}
+
+	createdAt := time.Now().Truncate(time.Second)
+	strokeColumns := []string{"id", "room_id", "width", "red", "green", "blue", "alpha", "created_at",
+		"author_token_id", "author_user_id", "layer_id", "type", "fill", "text"}
+	testRecordDriver.setRows("FROM `strokes` s LEFT JOIN", strokeColumns,
+		[]driver.Value{int64(3), int64(1), int64(8), int64(0), int64(0), int64(0), 1.0, createdAt, int64(0), int64(0), int64(0), "", int64(0), ""},
+		[]driver.Value{int64(5), int64(1), int64(8), int64(0), int64(0), int64(0), 1.0, createdAt, int64(0), int64(0), int64(0), "", int64(0), ""},
+	)
+	testRecordDriver.setRows("FROM `points` p", []string{"id", "stroke_id", "x", "y"},
+		[]driver.Value{int64(10), int64(3), 1.0, 2.0},
+		[]driver.Value{int64(11), int64(3), 3.0, 4.0},
+		[]driver.Value{int64(20), int64(5), 5.0, 6.0},
+	)
+
+	strokes, err := (&mysqlRoomStore{}).GetStrokes(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64][]int64{3: {10, 11}, 5: {20}}
+	if len(strokes) != len(want) {
+		t.Fatalf("got %d strokes, want %d", len(strokes), len(want))
+	}
+	for _, s := range strokes {
+		ids := []int64{}
+		for _, p := range s.Points {
+			ids = append(ids, p.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(want[s.ID]) {
+			t.Errorf("stroke %d: points %v, want %v", s.ID, ids, want[s.ID])
+		}
+	}
+}
+
+// TestMySQLInitAutoIncrement は起動時に AUTO_INCREMENT を消した行の ID より後に進めることを確かめる
+func TestMySQLInitAutoIncrement(t *testing.T) {
+	defer useTestDB(t)()
+	if os.Getenv("TEST_MYSQL_DSN") != "" {
+		t.Skip("uses canned rows of the recording driver")
+	}
+
+	setWriteBehindRows(5, 7, 20, 30)
+	if err := (&mysqlRoomStore{}).Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{
+		"ALTER TABLE `strokes` AUTO_INCREMENT = 8": false,
+		"ALTER TABLE `points` AUTO_INCREMENT = 31": false,
+	}
+	testRecordDriver.mu.Lock()
+	for _, e := range testRecordDriver.execs {
+		if _, ok := want[e.query]; ok {
+			want[e.query] = true
+		}
+	}
+	testRecordDriver.mu.Unlock()
+	for q, found := range want {
+		if !found {
+			t.Errorf("%s was not executed", q)
+		}
+	}
+}
@@ -4,198 +4,403 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func need(err error) {
-	if err != nil {
-		debug.PrintStack()
-		log.Println(err)
-	}
-}
-
+// RoomRepo の mu は Rooms の map だけを守り、部屋の中身は Room.mu で守る。
+// 部屋の追加はほとんど無いので RWMutex で読み込みを並列にする。
 type RoomRepo struct {
-	lock  chan bool
+	mu    sync.RWMutex
 	Rooms map[int64]*Room
 }
 
 func NewRoomRepo() *RoomRepo {
 	return &RoomRepo{
-		lock:  make(chan bool, 1),
 		Rooms: map[int64]*Room{},
 	}
 }
 
-func (r *RoomRepo) Lock() {
-	r.lock <- true
-}
-
-func (r *RoomRepo) Unlock() {
-	<-r.lock
-}
-
-func (r *RoomRepo) Init() {
+// Init は MySQL から全部屋を読み込む。部屋ごと・ストロークごとに問い合わせず、
+// 全ストロークと全点をそれぞれ1本のクエリで流し読みして Go 側でまとめる。
+func (r *RoomRepo) Init() error {
 	log.Println("room repo init start")
+	start := time.Now()
 
-	r.Lock()
-	defer r.Unlock()
-
-	rooms := []Room{}
+	rooms := []*Room{}
 	err := dbx.Select(&rooms, "SELECT `id`, `name`, `canvas_width`, `canvas_height`, `created_at` FROM `rooms` ORDER BY `id` ASC")
-	need(err)
+	if err != nil {
+		return fmt.Errorf("load rooms: %v", err)
+	}
+	log.Printf("room repo init: %d rooms (%s)", len(rooms), time.Since(start))
 
-	for i, _ := range rooms {
-		strokes := []Stroke{}
-		err := dbx.Select(&strokes, "SELECT `id`, `room_id`, `width`, `red`, `green`, `blue`, `alpha`, `created_at` FROM `strokes` WHERE `room_id` = ? ORDER BY `id` ASC", rooms[i].ID)
-		need(err)
+	owners, err := loadRoomOwners()
+	if err != nil {
+		return fmt.Errorf("load room owners: %v", err)
+	}
 
-		var owner_id int64
-		err = dbx.QueryRow("SELECT token_id FROM `room_owners` WHERE `room_id` = ?", rooms[i].ID).Scan(&owner_id)
+	strokesByRoom, err := loadStrokesSince(0)
+	if err != nil {
+		return err
+	}
+	tombstones, err := loadTombstones()
+	if err != nil {
+		return fmt.Errorf("load tombstones: %v", err)
+	}
 
-		for j, s := range strokes {
-			ps := []Point{}
-			dbx.Select(&ps, "SELECT `id`, `stroke_id`, `x`, `y` FROM `points` WHERE `stroke_id` = ? ORDER BY `id` ASC", s.ID)
-			strokes[j].Points = ps
-			strokes[j].json, err = json.Marshal(strokes[j])
+	m := make(map[int64]*Room, len(rooms))
+	for _, room := range rooms {
+		room.ownerID = owners[room.ID].TokenID
+		room.ownerUserID = owners[room.ID].UserID
+		room.tombstones = tombstones[room.ID]
+		room.Strokes = strokesByRoom[room.ID]
+		if room.Strokes == nil {
+			room.Strokes = []Stroke{}
 		}
-
-		rooms[i].ownerID = owner_id
-		rooms[i].Strokes = strokes
-		rooms[i].StrokeCount = len(strokes)
-		rooms[i].watchers = map[int64]time.Time{}
-		r.Rooms[rooms[i].ID] = &rooms[i]
+		room.StrokeCount = len(room.Strokes)
+		room.publishStrokes()
+		m[room.ID] = room
 	}
-	log.Println("room repo init end")
+
+	r.mu.Lock()
+	r.Rooms = m
+	r.mu.Unlock()
+
+	startupStats.Set("room_repo_init", expvarDuration(time.Since(start)))
+	log.Printf("room repo init end (%s)", time.Since(start))
+	return nil
 }
 
-func (r *RoomRepo) Get(ID int64) (*Room, bool) {
-	r.Lock()
-	defer r.Unlock()
+// roomOwner は部屋を作ったトークンと、そのトークンが紐付いていたアカウント
+type roomOwner struct {
+	TokenID int64 `db:"token_id"`
+	UserID  int64 `db:"user_id"`
+}
 
-	room, ok := r.Rooms[ID]
-	return room, ok
+// loadRoomOwners は部屋IDから作成者を引く map を返す
+func loadRoomOwners() (map[int64]roomOwner, error) {
+	owners := []struct {
+		RoomID int64 `db:"room_id"`
+		roomOwner
+	}{}
+	query := "SELECT o.`room_id`, o.`token_id`, COALESCE(u.`user_id`, 0) AS `user_id` FROM `room_owners` o"
+	query += " LEFT JOIN `room_user_owners` u ON u.`room_id` = o.`room_id`"
+	err := dbx.Select(&owners, query)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[int64]roomOwner, len(owners))
+	for _, o := range owners {
+		m[o.RoomID] = o.roomOwner
+	}
+	return m, nil
 }
 
-func (r *RoomRepo) UpdateWatcherCount(roomID int64, tokenID int64) int {
-	r.Lock()
-	defer r.Unlock()
+// 読み込みの進捗をこの行数ごとにログに出す
+const loadProgressRows = 100000
 
-	room, ok := r.Rooms[roomID]
-	if !ok {
-		log.Println("[warn] no such room")
+// loadStrokesSince は ID が greaterThanID より大きいストロークを点と一緒に読み込み、部屋ごとに ID 順で返す
+func loadStrokesSince(greaterThanID int64) (map[int64][]Stroke, error) {
+	start := time.Now()
+
+	byRoom := map[int64][]Stroke{}
+	// 点を割り当てるために、部屋ごとの slice の何番目かを覚えておく
+	type strokeIndex struct {
+		roomID int64
+		i      int
+	}
+	index := map[int64]strokeIndex{}
+
+	query := "SELECT `id`, `room_id`, `width`, `red`, `green`, `blue`, `alpha`, `created_at` FROM `strokes`"
+	query += " WHERE `id` > ? ORDER BY `id` ASC"
+	rows, err := dbx.Queryx(query, greaterThanID)
+	if err != nil {
+		return nil, fmt.Errorf("load strokes: %v", err)
+	}
+	nStrokes := 0
+	for rows.Next() {
+		var s Stroke
+		if err := rows.StructScan(&s); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("load strokes: %v", err)
+		}
+		s.Points = []Point{}
+		index[s.ID] = strokeIndex{s.RoomID, len(byRoom[s.RoomID])}
+		byRoom[s.RoomID] = append(byRoom[s.RoomID], s)
+		nStrokes++
+		if nStrokes%loadProgressRows == 0 {
+			log.Printf("load strokes: %d rows (%s)", nStrokes, time.Since(start))
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("load strokes: %v", err)
+	}
+	log.Printf("load strokes: %d strokes (%s)", nStrokes, time.Since(start))
+
+	query = "SELECT `id`, `stroke_id`, `x`, `y` FROM `points` WHERE `stroke_id` > ? ORDER BY `stroke_id` ASC, `id` ASC"
+	rows, err = dbx.Queryx(query, greaterThanID)
+	if err != nil {
+		return nil, fmt.Errorf("load points: %v", err)
+	}
+	nPoints := 0
+	for rows.Next() {
+		var p Point
+		if err := rows.StructScan(&p); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("load points: %v", err)
+		}
+		nPoints++
+		if nPoints%loadProgressRows == 0 {
+			log.Printf("load points: %d rows (%s)", nPoints, time.Since(start))
+		}
+		si, ok := index[p.StrokeID]
+		if !ok {
+			// ストロークを読んだ後にコミットされた点
+			continue
+		}
+		s := &byRoom[si.roomID][si.i]
+		s.Points = append(s.Points, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("load points: %v", err)
+	}
+	log.Printf("load points: %d points (%s)", nPoints, time.Since(start))
+
+	authors := []struct {
+		StrokeID int64 `db:"stroke_id"`
+		TokenID  int64 `db:"token_id"`
+		UserID   int64 `db:"user_id"`
+	}{}
+	err = dbx.Select(&authors, "SELECT `stroke_id`, `token_id`, `user_id` FROM `stroke_authors` WHERE `stroke_id` > ?", greaterThanID)
+	if err != nil {
+		return nil, fmt.Errorf("load stroke authors: %v", err)
+	}
+	for _, a := range authors {
+		si, ok := index[a.StrokeID]
+		if !ok {
+			continue
+		}
+		s := &byRoom[si.roomID][si.i]
+		s.AuthorTokenID = a.TokenID
+		s.AuthorUserID = a.UserID
 	}
 
-	if room.watchers == nil {
-		room.watchers = map[int64]time.Time{}
+	strokeLayers := []struct {
+		StrokeID int64 `db:"stroke_id"`
+		LayerID  int64 `db:"layer_id"`
+	}{}
+	err = dbx.Select(&strokeLayers, "SELECT `stroke_id`, `layer_id` FROM `stroke_layers` WHERE `stroke_id` > ?", greaterThanID)
+	if err != nil {
+		return nil, fmt.Errorf("load stroke layers: %v", err)
+	}
+	for _, l := range strokeLayers {
+		si, ok := index[l.StrokeID]
+		if !ok {
+			continue
+		}
+		byRoom[si.roomID][si.i].LayerID = l.LayerID
 	}
-	room.watchers[tokenID] = time.Now()
 
-	for token, t := range room.watchers {
-		if time.Since(t) >= time.Second*3 {
-			delete(room.watchers, token)
+	shapes := []struct {
+		StrokeID int64  `db:"stroke_id"`
+		Type     string `db:"type"`
+		Fill     bool   `db:"fill"`
+		Text     string `db:"text"`
+	}{}
+	err = dbx.Select(&shapes, "SELECT `stroke_id`, `type`, `fill`, `text` FROM `stroke_shapes` WHERE `stroke_id` > ?", greaterThanID)
+	if err != nil {
+		return nil, fmt.Errorf("load stroke shapes: %v", err)
+	}
+	for _, sh := range shapes {
+		si, ok := index[sh.StrokeID]
+		if !ok {
+			continue
 		}
+		s := &byRoom[si.roomID][si.i]
+		s.Type = sh.Type
+		s.Fill = sh.Fill
+		s.Text = sh.Text
 	}
 
-	room.WatcherCount = len(room.watchers)
-	return room.WatcherCount
+	for _, strokes := range byRoom {
+		for i := range strokes {
+			strokes[i].setAuthor()
+			strokes[i].json, err = json.Marshal(strokes[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return byRoom, nil
 }
 
-func (r *RoomRepo) GetWatcherCount(roomID int64) int {
-	r.Lock()
-	defer r.Unlock()
+func (r *RoomRepo) Get(ID int64) (*Room, bool) {
+	r.mu.RLock()
+	room, ok := r.Rooms[ID]
+	r.mu.RUnlock()
+	return room, ok
+}
 
-	room, ok := r.Rooms[roomID]
-	if !ok {
-		log.Println("[warn] no such room")
+// publishStrokes は Room.mu を取った状態で呼ぶ。
+// Strokes は append でしか伸ばさず、入っている要素は書き換えないので、
+// cap を切った slice を公開すれば読み手は lock の外で読んでも AddStroke と競合しない。
+func (room *Room) publishStrokes() {
+	if room.Strokes == nil {
+		room.Strokes = []Stroke{}
 	}
+	n := len(room.Strokes)
+	room.snapshot.Store(room.Strokes[:n:n])
+}
 
-	for token, t := range room.watchers {
-		if time.Since(t) >= time.Second*3 {
-			delete(room.watchers, token)
-		}
+// StrokesSnapshot はある時点のストロークの一覧を返す。返した slice は変更してはいけない
+func (room *Room) StrokesSnapshot() []Stroke {
+	if strokes, ok := room.snapshot.Load().([]Stroke); ok {
+		return strokes
 	}
-	room.WatcherCount = len(room.watchers)
+	return []Stroke{}
+}
 
-	return room.WatcherCount
+// View は JSON で返すための Room のコピーを作る
+func (room *Room) View() *Room {
+	strokes := room.StrokesSnapshot()
+	v := &Room{
+		ID:           room.ID,
+		Name:         room.Name,
+		CanvasWidth:  room.CanvasWidth,
+		CanvasHeight: room.CanvasHeight,
+		CreatedAt:    room.CreatedAt,
+		Strokes:      strokes,
+		StrokeCount:  len(strokes),
+		WatcherCount: hub.GetWatcherCount(room.ID),
+	}
+	s := acl.Settings(room.ID)
+	v.Visibility = s.Visibility
+	v.Drawing = s.Drawing
+	v.Layers = layers.Layers(room.ID)
+	return v
 }
 
 func (r *RoomRepo) GetStrokes(roomID int64, greaterThanID int64) []Stroke {
-	result := []Stroke{}
-
-	r.Lock()
-	room, ok := r.Rooms[roomID]
+	room, ok := r.Get(roomID)
 	if !ok {
 		log.Println("[warn] no such room")
+		return []Stroke{}
 	}
 
-	// lockの外にだしたいが怖い
-	for i, s := range room.Strokes {
-		if s.ID > greaterThanID {
-			result = room.Strokes[i:]
-			break
-		}
-	}
-	r.Unlock()
-	return result
+	strokes := room.StrokesSnapshot()
+	i := sort.Search(len(strokes), func(i int) bool {
+		return strokes[i].ID > greaterThanID
+	})
+	return strokes[i:]
 }
 
 func (r *RoomRepo) GetStrokeCount(roomID int64) int {
-	r.Lock()
-	defer r.Unlock()
-	room, ok := r.Rooms[roomID]
+	room, ok := r.Get(roomID)
 	if !ok {
 		log.Println("[warn] no such room")
 		return 0
 	}
-	return len(room.Strokes)
+	return len(room.StrokesSnapshot())
+}
+
+// RecentRooms はストロークがある部屋を最後にストロークが追加された順に返す
+func (r *RoomRepo) RecentRooms(limit int) []*Room {
+	type recent struct {
+		room  *Room
+		maxID int64
+	}
+	recents := []recent{}
+
+	r.mu.RLock()
+	for _, room := range r.Rooms {
+		strokes := room.StrokesSnapshot()
+		if len(strokes) == 0 {
+			continue
+		}
+		recents = append(recents, recent{room, strokes[len(strokes)-1].ID})
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(recents, func(i, j int) bool {
+		return recents[i].maxID > recents[j].maxID
+	})
+	if len(recents) > limit {
+		recents = recents[:limit]
+	}
+	rooms := make([]*Room, len(recents))
+	for i := range recents {
+		rooms[i] = recents[i].room
+	}
+	return rooms
 }
 
-func (r *RoomRepo) AddRoom(room *Room, ownerID int64) {
-	r.Lock()
-	defer r.Unlock()
+func (r *RoomRepo) AddRoom(room *Room, owner roomOwner) {
+	room.ownerID = owner.TokenID
+	room.ownerUserID = owner.UserID
+	room.publishStrokes()
 
-	room.ownerID = ownerID
-	room.watchers = map[int64]time.Time{}
+	r.mu.Lock()
 	r.Rooms[room.ID] = room
+	r.mu.Unlock()
+}
+
+func (r *RoomRepo) TransferRooms(fromTokenID int64, toTokenID int64) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, room := range r.Rooms {
+		if room.Owner().TokenID == fromTokenID {
+			atomic.StoreInt64(&room.ownerID, toTokenID)
+		}
+	}
+}
+
+// ClaimRooms は tokenID で作った部屋のうち、まだアカウントの無いものを userID のものにする
+func (r *RoomRepo) ClaimRooms(tokenID int64, userID int64) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, room := range r.Rooms {
+		if room.Owner().TokenID == tokenID {
+			atomic.CompareAndSwapInt64(&room.ownerUserID, 0, userID)
+		}
+	}
+}
+
+func (room *Room) Owner() roomOwner {
+	return roomOwner{
+		TokenID: atomic.LoadInt64(&room.ownerID),
+		UserID:  atomic.LoadInt64(&room.ownerUserID),
+	}
 }
 
 func (r *RoomRepo) AddStroke(roomID int64, stroke Stroke, points []Point) {
 	stroke.Points = points
+	stroke.setAuthor()
 	var err error
 	stroke.json, err = json.Marshal(stroke)
 	if err != nil {
 		panic(err)
 	}
 
-	r.Lock()
-	room, ok := r.Rooms[roomID]
+	room, ok := r.Get(roomID)
 	if !ok {
 		log.Println("[warn] no such room")
-		r.Unlock()
 		return
 	}
 
+	room.mu.Lock()
 	room.Strokes = append(room.Strokes, stroke)
 	room.StrokeCount = len(room.Strokes)
+	room.publishStrokes()
+	room.mu.Unlock()
 
 	room.svgMtx.Lock()
-	r.Unlock()
 	if room.svgInit {
-		buf := room.svgBuf
-		fmt.Fprintf(buf,
-			`<polyline id="%d" stroke="rgba(%d,%d,%d,%v)" stroke-width="%d" stroke-linecap="round" stroke-linejoin="round" fill="none" points="`,
-			stroke.ID, stroke.Red, stroke.Green, stroke.Blue, stroke.Alpha, stroke.Width)
-		first := true
-		for _, point := range stroke.Points {
-			if !first {
-				buf.WriteByte(' ')
-			}
-			fmt.Fprintf(buf, `%.4f,%.4f`, point.X, point.Y)
-			first = false
-		}
-		buf.WriteString(`"></polyline>`)
-		room.svgCompressed = compress(append(buf.Bytes(), "</svg>"...))
+		room.updateSVG()
 	}
 	room.svgMtx.Unlock()
+	room.invalidatePNG()
 }
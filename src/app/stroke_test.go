@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 部屋の数。ストリームは部屋ごとに GetStrokes を呼ぶので、部屋をまたいだ並列度を見る
+const benchRooms = 100
+
+func newBenchRepo(b *testing.B, strokesPerRoom int) (*RoomRepo, *memRoomStore) {
+	repo := NewRoomRepo()
+	m := &memRoomStore{repo: repo}
+	for i := 0; i < benchRooms; i++ {
+		room, err := m.CreateRoom("bench", 1028, 768, roomOwner{TokenID: 1}, roomSettings{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < strokesPerRoom; j++ {
+			if _, err := m.AddStroke(room.ID, benchStroke()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	return repo, m
+}
+
+func benchStroke() Stroke {
+	return Stroke{
+		Width:  8,
+		Red:    128,
+		Green:  128,
+		Blue:   128,
+		Alpha:  0.5,
+		Points: []Point{{X: 1, Y: 2}, {X: 3, Y: 4}, {X: 5, Y: 6}},
+	}
+}
+
+// nextRoomID は goroutine ごとに部屋を順に回す
+func nextRoomID(n *int64) int64 {
+	return atomic.AddInt64(n, 1)%benchRooms + 1
+}
+
+func BenchmarkRoomRepoGet(b *testing.B) {
+	repo, _ := newBenchRepo(b, 0)
+	var n int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, ok := repo.Get(nextRoomID(&n)); !ok {
+				b.Error("room not found")
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkRoomRepoGetStrokes(b *testing.B) {
+	repo, _ := newBenchRepo(b, 100)
+	var n int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			repo.GetStrokes(nextRoomID(&n), 0)
+		}
+	})
+}
+
+func BenchmarkRoomRepoAddStroke(b *testing.B) {
+	_, m := newBenchRepo(b, 0)
+	var n int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := m.AddStroke(nextRoomID(&n), benchStroke()); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkRoomRepoMixed は1部屋に書き込みが集中しているときに、他の部屋の読み込みが待たされないかを見る
+func BenchmarkRoomRepoMixed(b *testing.B) {
+	repo, m := newBenchRepo(b, 100)
+	var n int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&n, 1)
+			if i%4 == 0 {
+				m.AddStroke(1, benchStroke())
+				continue
+			}
+			roomID := i%(benchRooms-1) + 2
+			repo.GetStrokes(roomID, 0)
+			repo.Get(roomID)
+		}
+	})
+}
+
+// TestRoomRepoConcurrentAccess はストリームと同じように最後に見た ID から読み進めて、
+// 書き込みと並行しても取りこぼしや壊れたストロークが無いことを確かめる。go test -race で動かすこと
+func TestRoomRepoConcurrentAccess(t *testing.T) {
+	const (
+		rooms   = 4
+		writers = 4
+		strokes = 200
+	)
+	repo := NewRoomRepo()
+	m := &memRoomStore{repo: repo}
+	for i := 0; i < rooms; i++ {
+		if _, err := m.CreateRoom("stress", 100, 100, roomOwner{TokenID: 1}, roomSettings{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < strokes; i++ {
+				if _, err := m.AddStroke(int64((w+i)%rooms+1), benchStroke()); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	seen := make([]int, rooms)
+	var readers sync.WaitGroup
+	for r := 0; r < rooms; r++ {
+		readers.Add(1)
+		go func(roomID int64) {
+			defer readers.Done()
+			var lastID int64
+			n := 0
+			// 取りこぼしたときに終わらなくならないように
+			deadline := time.Now().Add(10 * time.Second)
+			for n < writers*strokes/rooms && time.Now().Before(deadline) {
+				for _, s := range repo.GetStrokes(roomID, lastID) {
+					if s.ID <= lastID || s.RoomID != roomID || len(s.Points) != 3 {
+						t.Errorf("room %d: unexpected stroke %d after %d", roomID, s.ID, lastID)
+						return
+					}
+					lastID = s.ID
+					n++
+				}
+				room, _ := repo.Get(roomID)
+				if _, err := json.Marshal(room.View()); err != nil {
+					t.Error(err)
+					return
+				}
+				runtime.Gosched()
+			}
+			seen[roomID-1] = n
+		}(int64(r + 1))
+	}
+
+	wg.Wait()
+	readers.Wait()
+	for i, n := range seen {
+		if n != writers*strokes/rooms {
+			t.Errorf("room %d: saw %d strokes, want %d", i+1, n, writers*strokes/rooms)
+		}
+	}
+}
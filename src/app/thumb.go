@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+
+	"goji.io/pat"
+	"golang.org/x/net/context"
+)
+
+// サムネイルは部屋の一覧のカード用に、決まった大きさに収まるように縮小した PNG。
+// 部屋ごと大きさごとに raster を取っておき、前に描いたときから増えたストロークだけを描き足す。
+// 描いた中で一番上のレイヤーより下に描き足すときと、削除やレイヤーの変更で
+// invalidateSVG が呼ばれたときは最初から描き直す。
+
+var thumbnailSizes = map[string]int{
+	"small": 160,
+	"large": 320,
+}
+
+const (
+	defaultThumbnailSize = "small"
+	// 一覧を開き直したときに取り直さなくてよい秒数
+	thumbnailMaxAge = 5
+)
+
+type roomThumbnail struct {
+	r     *raster
+	scale float64
+	// 描いたストロークの数と最後のストロークの ID、描いた中で一番上のレイヤーの順番
+	count  int
+	lastID int64
+	top    int
+	png    []byte
+}
+
+// drawn は strokes の先頭 count 本が描いたストロークのままかを返す。
+// ID は増える一方なので、count 本目が描いた最後のストロークなら間で消えたものも無い
+func (th *roomThumbnail) drawn(strokes []Stroke) bool {
+	if th.count > len(strokes) {
+		return false
+	}
+	return th.count == 0 || strokes[th.count-1].ID == th.lastID
+}
+
+func thumbnailScale(room *Room, size int) float64 {
+	scale := math.Min(float64(size)/float64(room.CanvasWidth), float64(size)/float64(room.CanvasHeight))
+	return math.Min(scale, 1)
+}
+
+// renderRoomThumbnail は size の大きさのサムネイルを返す
+func renderRoomThumbnail(room *Room, size string) ([]byte, error) {
+	room.thumbMtx.Lock()
+	defer room.thumbMtx.Unlock()
+
+	strokes := room.StrokesSnapshot()
+	th := room.thumbs[size]
+	// ストロークを消したときは invalidateThumbnails で捨てるが、それより先に来ることがあるので、
+	// 描いたストロークが残っていなければ描き直す
+	if th != nil && !th.drawn(strokes) {
+		th = nil
+	}
+	if th != nil && th.count == len(strokes) {
+		return th.png, nil
+	}
+
+	order := visibleLayerOrder(room.ID)
+	pos := make(map[int64]int, len(order))
+	for i, layerID := range order {
+		pos[layerID] = i
+	}
+
+	if th != nil {
+		for _, s := range strokes[th.count:] {
+			if p, ok := pos[s.LayerID]; ok && p < th.top {
+				th = nil
+				break
+			}
+		}
+	}
+	if th == nil {
+		scale := thumbnailScale(room, thumbnailSizes[size])
+		w := int(math.Ceil(float64(room.CanvasWidth) * scale))
+		h := int(math.Ceil(float64(room.CanvasHeight) * scale))
+		if w <= 0 || h <= 0 {
+			return nil, errInvalidScale
+		}
+		th = &roomThumbnail{r: newRaster(w, h), scale: scale}
+		th.r.drawLayers(strokes, order, scale, nil)
+		for i := range strokes {
+			if p, ok := pos[strokes[i].LayerID]; ok && p > th.top {
+				th.top = p
+			}
+		}
+	} else {
+		for i := range strokes[th.count:] {
+			s := &strokes[th.count+i]
+			p, ok := pos[s.LayerID]
+			if !ok {
+				continue
+			}
+			th.r.drawStroke(s, th.scale, 1)
+			if p > th.top {
+				th.top = p
+			}
+		}
+	}
+	th.r.release()
+	th.count = len(strokes)
+	if len(strokes) > 0 {
+		th.lastID = strokes[len(strokes)-1].ID
+	}
+
+	b, err := th.r.encode()
+	if err != nil {
+		return nil, err
+	}
+	th.png = b
+
+	if room.thumbs == nil {
+		room.thumbs = map[string]*roomThumbnail{}
+	}
+	room.thumbs[size] = th
+	return th.png, nil
+}
+
+func (room *Room) invalidateThumbnails() {
+	room.thumbMtx.Lock()
+	room.thumbs = nil
+	room.thumbMtx.Unlock()
+}
+
+func thumbnailURL(roomID int64) string {
+	return fmt.Sprintf("/img/%d/thumb", roomID)
+}
+
+func getRoomThumbnail(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	room, ok := parseImageRequest(w, r, pat.Param(ctx, "id"))
+	if !ok {
+		return
+	}
+
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = defaultThumbnailSize
+	}
+	if _, ok := thumbnailSizes[size]; !ok {
+		outputErrorMsg(w, http.StatusBadRequest, "size は small か large を指定してください。")
+		return
+	}
+
+	// 部屋の画像と同じく、描く前に確かめる
+	tag, modTime := roomValidators(room)
+	if checkNotModified(w, r, roomCacheControl(room, thumbnailMaxAge), fmt.Sprintf(`W/"%s-thumb-%s"`, tag, size), modTime) {
+		return
+	}
+
+	b, err := renderRoomThumbnail(room, size)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	writeEncoded(w, b, encodingIdentity)
+}
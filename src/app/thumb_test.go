@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// freshThumbnail はキャッシュを使わずに描いたサムネイルを返す
+func freshThumbnail(t *testing.T, room *Room) []byte {
+	room.thumbMtx.Lock()
+	saved := room.thumbs
+	room.thumbs = nil
+	room.thumbMtx.Unlock()
+
+	b, err := renderRoomThumbnail(room, defaultThumbnailSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	room.thumbMtx.Lock()
+	room.thumbs = saved
+	room.thumbMtx.Unlock()
+	return b
+}
+
+// TestThumbnailAfterDelete はサムネイルを描いた後にストロークを消すと、次は消したストロークの
+// 無いサムネイルになることを確かめる。invalidateThumbnails より先に描きに来たときのために、
+// 消す前のサムネイルが残っている場合も確かめる
+func TestThumbnailAfterDelete(t *testing.T) {
+	for _, stale := range []bool{false, true} {
+		for _, addAfterDelete := range []bool{false, true} {
+			m, room := newTestImageRoom(t)
+			var ids []int64
+			for i := 0; i < 3; i++ {
+				s := benchStroke()
+				s.Points = []Point{{X: float64(100 * i), Y: 0}, {X: float64(100 * i), Y: 700}}
+				added, err := m.AddStroke(room.ID, s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, added.ID)
+			}
+			if _, err := renderRoomThumbnail(room, defaultThumbnailSize); err != nil {
+				t.Fatal(err)
+			}
+
+			room.thumbMtx.Lock()
+			before := room.thumbs
+			room.thumbMtx.Unlock()
+			if _, err := m.DeleteStroke(room.ID, ids[1]); err != nil {
+				t.Fatal(err)
+			}
+			if addAfterDelete {
+				s := benchStroke()
+				s.Points = []Point{{X: 900, Y: 0}, {X: 900, Y: 700}}
+				if _, err := m.AddStroke(room.ID, s); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if stale {
+				room.thumbMtx.Lock()
+				room.thumbs = before
+				room.thumbMtx.Unlock()
+			}
+
+			got, err := renderRoomThumbnail(room, defaultThumbnailSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, freshThumbnail(t, room)) {
+				t.Errorf("stale=%v add=%v: thumbnail differs from a fresh render", stale, addAfterDelete)
+			}
+		}
+	}
+}
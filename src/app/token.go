@@ -0,0 +1,474 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CSRF トークンはメモリに持っておき、checkToken で MySQL を引かないようにする。
+// 作るときは MySQL にも書いておき、起動時にまだ有効なものを読み込む。
+//
+// TOKEN_SECRET があるときは "v1.<id>.<発行時刻>.<HMAC>" の形式のトークンを発行し、
+// 署名と期限を見て検証する。それ以前に発行された形式のトークンもメモリから引いて受け付ける。
+//
+// 署名付きトークンはメモリに無くても署名と期限だけで受け付ける。
+// 失効させた署名付きトークンの ID は期限が切れるまで token_revocations とメモリに残して断る。
+// そのときアカウントとの紐付けと作者は、初めて使うときに token_users と token_authors から読む。
+//
+// Refresh で作り直したトークンは、古いトークンで描いたストロークの作者として扱うために
+// 最初のトークンの ID を token_authors に持つ。
+
+var (
+	tokenTTL = 24 * time.Hour
+	// 期限切れのトークンをメモリと MySQL から消す間隔
+	tokenPurgeInterval = 10 * time.Minute
+	// 空なら署名付きトークンを発行しない
+	tokenSecret []byte
+)
+
+const signedTokenPrefix = "v1."
+
+type tokenRegistry struct {
+	mu     sync.RWMutex
+	tokens map[string]*Token
+	byID   map[int64]*Token
+	// 失効させた署名付きトークンの ID と、その期限
+	revokedIDs map[int64]time.Time
+}
+
+var tokens = newTokenRegistry()
+
+func newTokenRegistry() *tokenRegistry {
+	return &tokenRegistry{
+		tokens:     map[string]*Token{},
+		byID:       map[int64]*Token{},
+		revokedIDs: map[int64]time.Time{},
+	}
+}
+
+func (t *Token) expired(now time.Time) bool {
+	return !t.CreatedAt.After(now.Add(-tokenTTL))
+}
+
+func (t *Token) UserID() int64 {
+	userID, _, err := t.bindings()
+	if err != nil {
+		log.Println("token users:", err)
+	}
+	return userID
+}
+
+// AuthorTokenID は描いたストロークの作者として記録するトークン ID を返す
+func (t *Token) AuthorTokenID() int64 {
+	_, authorTokenID, err := t.bindings()
+	if err != nil {
+		log.Println("token authors:", err)
+	}
+	return authorTokenID
+}
+
+// bindings はアカウントと作者のトークン ID を返す。読めなかったら次に使うときに読み直す
+func (t *Token) bindings() (int64, int64, error) {
+	t.userMu.Lock()
+	defer t.userMu.Unlock()
+	if t.userUnknown {
+		var userID, authorTokenID int64
+		err := dbx.Get(&userID, "SELECT `user_id` FROM `token_users` WHERE `token_id` = ?", t.ID)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, t.ID, err
+		}
+		err = dbx.Get(&authorTokenID, "SELECT `author_token_id` FROM `token_authors` WHERE `token_id` = ?", t.ID)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, t.ID, err
+		}
+		t.userID, t.authorTokenID = userID, authorTokenID
+		t.userUnknown = false
+	}
+	if t.authorTokenID != 0 {
+		return t.userID, t.authorTokenID, nil
+	}
+	return t.userID, t.ID, nil
+}
+
+func (t *Token) setUserID(userID int64) {
+	t.userMu.Lock()
+	t.userID = userID
+	t.userUnknown = false
+	t.userMu.Unlock()
+}
+
+// Load は MySQL からまだ有効なトークンを読み込む
+func (reg *tokenRegistry) Load() error {
+	start := time.Now()
+	ts := []*Token{}
+	err := dbx.Select(&ts, "SELECT `id`, `csrf_token`, `created_at` FROM `tokens` WHERE `created_at` > ?", start.Add(-tokenTTL))
+	if err != nil {
+		return err
+	}
+
+	m := make(map[string]*Token, len(ts))
+	byID := make(map[int64]*Token, len(ts))
+	for _, t := range ts {
+		t.revoked = make(chan struct{})
+		m[t.CSRFToken] = t
+		byID[t.ID] = t
+	}
+
+	revocations := []struct {
+		TokenID   int64     `db:"token_id"`
+		ExpiresAt time.Time `db:"expires_at"`
+	}{}
+	err = dbx.Select(&revocations, "SELECT `token_id`, `expires_at` FROM `token_revocations` WHERE `expires_at` > ?", start)
+	if err != nil {
+		return err
+	}
+	revokedIDs := make(map[int64]time.Time, len(revocations))
+	for _, r := range revocations {
+		revokedIDs[r.TokenID] = r.ExpiresAt
+	}
+
+	reg.mu.Lock()
+	reg.tokens = m
+	reg.byID = byID
+	reg.revokedIDs = revokedIDs
+	reg.mu.Unlock()
+
+	bindings := []struct {
+		TokenID int64 `db:"token_id"`
+		UserID  int64 `db:"user_id"`
+	}{}
+	if err := dbx.Select(&bindings, "SELECT `token_id`, `user_id` FROM `token_users`"); err != nil {
+		return err
+	}
+	for _, b := range bindings {
+		if t, ok := byID[b.TokenID]; ok {
+			t.userID = b.UserID
+		}
+	}
+	authors := []struct {
+		TokenID       int64 `db:"token_id"`
+		AuthorTokenID int64 `db:"author_token_id"`
+	}{}
+	if err := dbx.Select(&authors, "SELECT `token_id`, `author_token_id` FROM `token_authors`"); err != nil {
+		return err
+	}
+	for _, a := range authors {
+		if t, ok := byID[a.TokenID]; ok {
+			t.authorTokenID = a.AuthorTokenID
+		}
+	}
+
+	startupStats.Set("token_registry_load", expvarDuration(time.Since(start)))
+	log.Printf("loaded %d tokens in %s", len(m), time.Since(start))
+	return nil
+}
+
+// Create はトークンを作って MySQL に書いてからメモリに入れる。
+// 署名付きトークンは ID を含むので、AUTO_INCREMENT で採番された ID で署名してから書き直す。
+func (reg *tokenRegistry) Create() (*Token, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	t := &Token{
+		CSRFToken: hex.EncodeToString(b),
+		CreatedAt: time.Now().Truncate(time.Microsecond),
+		revoked:   make(chan struct{}),
+	}
+	if tokenSecret != nil {
+		t.CreatedAt = t.CreatedAt.Truncate(time.Second)
+	}
+
+	result, err := dbx.Exec("INSERT INTO `tokens` (`csrf_token`, `created_at`) VALUES (?, ?)", t.CSRFToken, t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	t.ID, err = result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if tokenSecret != nil {
+		t.CSRFToken = signToken(t.ID, t.CreatedAt)
+		if _, err := dbx.Exec("UPDATE `tokens` SET `csrf_token` = ? WHERE `id` = ?", t.CSRFToken, t.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	reg.mu.Lock()
+	reg.tokens[t.CSRFToken] = t
+	reg.byID[t.ID] = t
+	reg.mu.Unlock()
+	return t, nil
+}
+
+// Get は有効なトークンを返す。無いか期限切れなら nil。
+// メモリにあれば、TOKEN_SECRET を外す前に発行した署名付きトークンもそのまま受け付ける
+func (reg *tokenRegistry) Get(csrfToken string) *Token {
+	reg.mu.RLock()
+	t, ok := reg.tokens[csrfToken]
+	reg.mu.RUnlock()
+	if !ok && strings.HasPrefix(csrfToken, signedTokenPrefix) {
+		return reg.getSigned(csrfToken)
+	}
+	if !ok || t.expired(time.Now()) {
+		return nil
+	}
+	return t
+}
+
+// getSigned は署名と期限を確かめ、失効させていなければトークンを返す。
+// メモリに無いときは、失効を伝えられるようにメモリに入れてから返す
+func (reg *tokenRegistry) getSigned(csrfToken string) *Token {
+	signed := verifyToken(csrfToken)
+	if signed == nil || signed.expired(time.Now()) {
+		return nil
+	}
+	reg.mu.RLock()
+	t, ok := reg.byID[signed.ID]
+	_, revoked := reg.revokedIDs[signed.ID]
+	reg.mu.RUnlock()
+	if revoked {
+		return nil
+	}
+	if ok {
+		return t
+	}
+
+	signed.userUnknown = true
+	signed.revoked = make(chan struct{})
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, revoked := reg.revokedIDs[signed.ID]; revoked {
+		return nil
+	}
+	if t, ok := reg.byID[signed.ID]; ok {
+		return t
+	}
+	reg.tokens[csrfToken] = signed
+	reg.byID[signed.ID] = signed
+	return signed
+}
+
+// Bind はトークンをアカウントに紐付け、そのトークンで作った部屋をアカウントのものにする
+func (reg *tokenRegistry) Bind(t *Token, userID int64) error {
+	query := "INSERT INTO `token_users` (`token_id`, `user_id`) VALUES (?, ?)"
+	query += " ON DUPLICATE KEY UPDATE `user_id` = VALUES(`user_id`)"
+	if _, err := dbx.Exec(query, t.ID, userID); err != nil {
+		return err
+	}
+	t.setUserID(userID)
+	return store.ClaimRooms(t.ID, userID)
+}
+
+// Unbind はトークンをアカウントから外す。作った部屋はアカウントのまま
+func (reg *tokenRegistry) Unbind(t *Token) error {
+	if _, err := dbx.Exec("DELETE FROM `token_users` WHERE `token_id` = ?", t.ID); err != nil {
+		return err
+	}
+	t.setUserID(0)
+	return nil
+}
+
+// Revoke はトークンを MySQL とメモリから消し、そのトークンで開いているストリームを閉じさせる。
+// 署名付きトークンは署名だけでは失効がわからないので、期限まで ID を覚えておく
+func (reg *tokenRegistry) Revoke(t *Token) error {
+	signed := strings.HasPrefix(t.CSRFToken, signedTokenPrefix)
+	expiresAt := t.CreatedAt.Add(tokenTTL)
+	if signed {
+		query := "INSERT INTO `token_revocations` (`token_id`, `expires_at`) VALUES (?, ?)"
+		query += " ON DUPLICATE KEY UPDATE `expires_at` = VALUES(`expires_at`)"
+		if _, err := dbx.Exec(query, t.ID, expiresAt); err != nil {
+			return err
+		}
+	}
+	if _, err := dbx.Exec("DELETE FROM `tokens` WHERE `id` = ?", t.ID); err != nil {
+		return err
+	}
+	if _, err := dbx.Exec("DELETE FROM `token_users` WHERE `token_id` = ?", t.ID); err != nil {
+		return err
+	}
+	if _, err := dbx.Exec("DELETE FROM `token_authors` WHERE `token_id` = ?", t.ID); err != nil {
+		return err
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if signed {
+		reg.revokedIDs[t.ID] = expiresAt
+	}
+	if cur, ok := reg.byID[t.ID]; ok {
+		delete(reg.tokens, cur.CSRFToken)
+		delete(reg.byID, cur.ID)
+		close(cur.revoked)
+	}
+	return nil
+}
+
+// Refresh は新しいトークンを作って部屋の持ち主と招待で得た権限、描いたストロークの作者を引き継ぎ、
+// 古いトークンを失効させる。
+// 途中で失敗したら、移したものを古いトークンに戻して新しいトークンを捨てる
+func (reg *tokenRegistry) Refresh(old *Token) (*Token, error) {
+	t, err := reg.Create()
+	if err != nil {
+		return nil, err
+	}
+	err = reg.carryOver(old, t)
+	if err == nil {
+		err = reg.Revoke(old)
+	}
+	if err != nil {
+		if err2 := reg.undoRefresh(old, t); err2 != nil {
+			log.Println("token refresh: failed to undo:", err2)
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+// carryOver は old の部屋と権限を t に移し、old の作者とアカウントを t に引き継ぐ
+func (reg *tokenRegistry) carryOver(old *Token, t *Token) error {
+	userID, authorTokenID, err := old.bindings()
+	if err != nil {
+		return err
+	}
+	if err := store.TransferRooms(old.ID, t.ID); err != nil {
+		return err
+	}
+	if err := acl.TransferMembers(old.ID, t.ID); err != nil {
+		return err
+	}
+	query := "INSERT INTO `token_authors` (`token_id`, `author_token_id`) VALUES (?, ?)"
+	query += " ON DUPLICATE KEY UPDATE `author_token_id` = VALUES(`author_token_id`)"
+	if _, err := dbx.Exec(query, t.ID, authorTokenID); err != nil {
+		return err
+	}
+	t.userMu.Lock()
+	t.authorTokenID = authorTokenID
+	t.userMu.Unlock()
+	if userID != 0 {
+		return reg.Bind(t, userID)
+	}
+	return nil
+}
+
+// undoRefresh は Refresh の途中で移したものを old に戻して t を失効させる。
+// t はまだクライアントに返していないので、部屋をアカウントのものにした分はそのままでよい
+func (reg *tokenRegistry) undoRefresh(old *Token, t *Token) error {
+	if err := store.TransferRooms(t.ID, old.ID); err != nil {
+		return err
+	}
+	if err := acl.TransferMembers(t.ID, old.ID); err != nil {
+		return err
+	}
+	return reg.Revoke(t)
+}
+
+// Purge は期限切れのトークンと失効させた ID をメモリと MySQL から消す
+func (reg *tokenRegistry) Purge() error {
+	now := time.Now()
+
+	reg.mu.Lock()
+	purged := 0
+	for k, t := range reg.tokens {
+		if t.expired(now) {
+			delete(reg.tokens, k)
+			delete(reg.byID, t.ID)
+			// STREAM_MAX_LIFETIME=0 だとストリームは期限を見ないので、Revoke と同じく閉じさせる。
+			// map から消すのは mu を取った中だけなので、close は1回しか呼ばれない
+			close(t.revoked)
+			purged++
+		}
+	}
+	// 期限が切れたら署名の検証で断れるので、失効させた ID も忘れてよい
+	for id, expiresAt := range reg.revokedIDs {
+		if !expiresAt.After(now) {
+			delete(reg.revokedIDs, id)
+		}
+	}
+	reg.mu.Unlock()
+
+	if _, err := dbx.Exec("DELETE FROM `token_revocations` WHERE `expires_at` <= ?", now); err != nil {
+		return err
+	}
+
+	result, err := dbx.Exec("DELETE FROM `tokens` WHERE `created_at` <= ?", now.Add(-tokenTTL))
+	if err != nil {
+		return err
+	}
+	deleted, _ := result.RowsAffected()
+	query := "DELETE tu FROM `token_users` tu LEFT JOIN `tokens` t ON t.`id` = tu.`token_id` WHERE t.`id` IS NULL"
+	if _, err := dbx.Exec(query); err != nil {
+		return err
+	}
+	query = "DELETE ta FROM `token_authors` ta LEFT JOIN `tokens` t ON t.`id` = ta.`token_id` WHERE t.`id` IS NULL"
+	if _, err := dbx.Exec(query); err != nil {
+		return err
+	}
+	log.Printf("purged %d expired tokens from memory, %d from MySQL", purged, deleted)
+	return nil
+}
+
+func tokenSignature(payload string) string {
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signToken(id int64, issuedAt time.Time) string {
+	payload := signedTokenPrefix + strconv.FormatInt(id, 10) + "." + strconv.FormatInt(issuedAt.Unix(), 10)
+	return payload + "." + tokenSignature(payload)
+}
+
+// verifyToken は署名付きトークンの署名を確かめて中身を返す。期限は見ない
+func verifyToken(csrfToken string) *Token {
+	if tokenSecret == nil {
+		return nil
+	}
+	i := strings.LastIndexByte(csrfToken, '.')
+	if i < 0 {
+		return nil
+	}
+	payload, sig := csrfToken[:i], csrfToken[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(tokenSignature(payload))) {
+		return nil
+	}
+
+	fields := strings.Split(payload[len(signedTokenPrefix):], ".")
+	if len(fields) != 2 {
+		return nil
+	}
+	id, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil
+	}
+	issued, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &Token{ID: id, CSRFToken: csrfToken, CreatedAt: time.Unix(issued, 0)}
+}
+
+// runPurger は期限切れのトークンとセッションと招待を定期的に消す
+func (reg *tokenRegistry) runPurger(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := reg.Purge(); err != nil {
+			log.Println("token purge:", err)
+		}
+		if err := purgeSessions(); err != nil {
+			log.Println("session purge:", err)
+		}
+		if err := acl.PurgeInvites(); err != nil {
+			log.Println("invite purge:", err)
+		}
+	}
+}
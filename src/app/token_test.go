@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTokenSecret は TOKEN_SECRET を secret にする。空なら署名付きトークンを発行しない
+func useTokenSecret(secret string) func() {
+	prev := tokenSecret
+	tokenSecret = nil
+	if secret != "" {
+		tokenSecret = []byte(secret)
+	}
+	return func() { tokenSecret = prev }
+}
+
+// TestSignedToken は署名付きトークンを署名と期限で検証し、
+// メモリに無くても受け付けて、失効させたものは断ることを確かめる
+func TestSignedToken(t *testing.T) {
+	defer useTestDB(t)()
+	defer useTokenSecret("secret")()
+	reg := newTokenRegistry()
+
+	tk, err := reg.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tk.CSRFToken, signedTokenPrefix) {
+		t.Fatalf("token %q is not signed", tk.CSRFToken)
+	}
+	if got := reg.Get(tk.CSRFToken); got != tk {
+		t.Fatalf("Get(%q) = %v, want the created token", tk.CSRFToken, got)
+	}
+
+	// 再起動した後などでメモリに無くても、署名が合えば受け付ける。アカウントは使うときに読む
+	other := newTokenRegistry()
+	got := other.Get(tk.CSRFToken)
+	if got == nil || got.ID != tk.ID {
+		t.Fatalf("Get(%q) on another registry = %v, want ID %d", tk.CSRFToken, got, tk.ID)
+	}
+	if !got.userUnknown {
+		t.Error("user of a signed token is read before it is used")
+	}
+	testRecordDriver.setRows("FROM `token_users`", []string{"user_id"}, []driver.Value{int64(5)})
+	if userID := got.UserID(); userID != 5 {
+		t.Errorf("UserID() = %d, want 5", userID)
+	}
+
+	i := strings.LastIndexByte(tk.CSRFToken, '.')
+	issued := tk.CreatedAt
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"tampered signature", tk.CSRFToken[:i+1] + strings.Repeat("A", len(tk.CSRFToken)-i-1)},
+		{"tampered id", strings.Replace(tk.CSRFToken, signedTokenPrefix, signedTokenPrefix+"9", 1)},
+		{"expired", signToken(tk.ID, issued.Add(-tokenTTL))},
+		{"other secret", func() string {
+			defer useTokenSecret("other")()
+			return signToken(tk.ID, issued)
+		}()},
+		{"malformed", signedTokenPrefix + "x"},
+	}
+	for _, tt := range tests {
+		if got := newTokenRegistry().Get(tt.token); got != nil {
+			t.Errorf("%s: Get(%q) = %v, want nil", tt.name, tt.token, got)
+		}
+	}
+
+	if err := reg.Revoke(tk); err != nil {
+		t.Fatal(err)
+	}
+	if got := reg.Get(tk.CSRFToken); got != nil {
+		t.Errorf("revoked token is accepted: %v", got)
+	}
+	select {
+	case <-tk.revoked:
+	default:
+		t.Error("revoked channel is not closed")
+	}
+}
+
+// TestLegacyToken は署名の無いトークンと、TOKEN_SECRET を外す前に発行した署名付きトークンを
+// メモリから引いて受け付けることを確かめる
+func TestLegacyToken(t *testing.T) {
+	defer useTestDB(t)()
+	reg := newTokenRegistry()
+
+	unsigned, err := reg.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := useTokenSecret("secret")
+	signed, err := reg.Create()
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{"", "secret"} {
+		func() {
+			defer useTokenSecret(secret)()
+			for _, tk := range []*Token{unsigned, signed} {
+				if got := reg.Get(tk.CSRFToken); got != tk {
+					t.Errorf("secret %q: Get(%q) = %v, want the created token", secret, tk.CSRFToken, got)
+				}
+			}
+			if got := reg.Get("unknown"); got != nil {
+				t.Errorf("secret %q: unknown token is accepted: %v", secret, got)
+			}
+		}()
+	}
+
+	unsigned.CreatedAt = time.Now().Add(-tokenTTL)
+	if got := reg.Get(unsigned.CSRFToken); got != nil {
+		t.Errorf("expired token is accepted: %v", got)
+	}
+}
+
+// refreshTestToken は POST /api/csrf_token/refresh で作り直したトークンを返す
+func refreshTestToken(t *testing.T, ts *httptest.Server, tk *Token) (int, *Token) {
+	code, b := doRequest(t, "POST", ts.URL+"/api/csrf_token/refresh", tk, nil)
+	if code != http.StatusOK {
+		return code, nil
+	}
+	var res struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatal(err)
+	}
+	refreshed := tokens.Get(res.Token)
+	if refreshed == nil {
+		t.Fatalf("refreshed token %q is not accepted", res.Token)
+	}
+	return code, refreshed
+}
+
+func strokeAuthor(t *testing.T, ts *httptest.Server, roomID int64, strokeID int64) string {
+	code, b := doRequest(t, "GET", fmt.Sprintf("%s/api/rooms/%d/strokes", ts.URL, roomID), nil, nil)
+	if code != http.StatusOK {
+		t.Fatalf("GET strokes: %d %s", code, b)
+	}
+	var res struct {
+		Strokes []Stroke `json:"strokes"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range res.Strokes {
+		if s.ID == strokeID {
+			return s.Author
+		}
+	}
+	t.Fatalf("stroke %d is not found", strokeID)
+	return ""
+}
+
+// TestRefreshToken は作り直したトークンが部屋の持ち主と描いたストロークの作者を引き継ぎ、
+// 古いトークンは使えなくなることを確かめる
+func TestRefreshToken(t *testing.T) {
+	defer useTestDB(t)()
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner, alice := newTestToken(), newTestToken()
+	room := createTestRoom(t, ts, owner)
+	postTestStroke(t, ts, owner, room.ID)
+	first := postTestStroke(t, ts, alice, room.ID)
+	author := strokeAuthor(t, ts, room.ID, first)
+
+	code, refreshedOwner := refreshTestToken(t, ts, owner)
+	if code != http.StatusOK {
+		t.Fatalf("refresh owner: %d", code)
+	}
+	code, refreshedAlice := refreshTestToken(t, ts, alice)
+	if code != http.StatusOK {
+		t.Fatalf("refresh alice: %d", code)
+	}
+
+	if code, b := doRequest(t, "POST", fmt.Sprintf("%s/api/strokes/rooms/%d", ts.URL, room.ID), alice, testStrokeBody()); code != http.StatusBadRequest {
+		t.Errorf("stroke with the old token: got %d %s, want %d", code, b, http.StatusBadRequest)
+	}
+	settingsURL := fmt.Sprintf("%s/api/rooms/%d/settings", ts.URL, room.ID)
+	settings := roomSettings{Visibility: visibilityPublic, Drawing: drawingAnyone}
+	if code, b := doRequest(t, "PUT", settingsURL, refreshedOwner, settings); code != http.StatusOK {
+		t.Errorf("settings with the refreshed owner: got %d %s", code, b)
+	}
+
+	second := postTestStroke(t, ts, refreshedAlice, room.ID)
+	if got := strokeAuthor(t, ts, room.ID, second); got != author {
+		t.Errorf("author after refresh = %q, want %q", got, author)
+	}
+	if code, b := doRequest(t, "DELETE", fmt.Sprintf("%s/api/strokes/rooms/%d/%d", ts.URL, room.ID, first), refreshedAlice, nil); code != http.StatusOK {
+		t.Errorf("delete own stroke drawn before refresh: got %d %s", code, b)
+	}
+}
+
+// TestRefreshTokenUndo は作り直す途中で失敗したら、古いトークンが部屋の持ち主のまま使えることを確かめる
+func TestRefreshTokenUndo(t *testing.T) {
+	defer useTestDB(t)()
+	if os.Getenv("TEST_MYSQL_DSN") != "" {
+		t.Skip("makes the recording driver fail")
+	}
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := newTestToken()
+	room := createTestRoom(t, ts, owner)
+
+	testRecordDriver.failOn("INSERT INTO `token_authors`")
+	if code, _ := refreshTestToken(t, ts, owner); code != http.StatusInternalServerError {
+		t.Fatalf("refresh: got %d, want %d", code, http.StatusInternalServerError)
+	}
+	testRecordDriver.failOn("")
+
+	settingsURL := fmt.Sprintf("%s/api/rooms/%d/settings", ts.URL, room.ID)
+	settings := roomSettings{Visibility: visibilityPublic, Drawing: drawingAnyone}
+	if code, b := doRequest(t, "PUT", settingsURL, owner, settings); code != http.StatusOK {
+		t.Errorf("settings with the old token after a failed refresh: got %d %s", code, b)
+	}
+	tokens.mu.RLock()
+	n := len(tokens.tokens)
+	tokens.mu.RUnlock()
+	if n != 1 {
+		t.Errorf("%d tokens after a failed refresh, want only the old one", n)
+	}
+
+	code, refreshed := refreshTestToken(t, ts, owner)
+	if code != http.StatusOK {
+		t.Fatalf("refresh again: %d", code)
+	}
+	if code, b := doRequest(t, "PUT", settingsURL, refreshed, settings); code != http.StatusOK {
+		t.Errorf("settings with the refreshed token: got %d %s", code, b)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"goji.io/pat"
+	"golang.org/x/net/context"
+)
+
+// ストロークを消すときは行を消して stroke_tombstones に記録を残す。
+// ストリームは stroke_deleted イベントで消えたことを伝え、Last-Event-ID 付きで
+// 再接続してきたクライアントには、それまでに受け取ったはずのストロークの削除をまとめて送る。
+// SSE の id は "<ストロークID>.<削除の記録ID>" の形で、どちらもどこまで送ったかを表す。
+
+var (
+	errStrokeNotFound   = errors.New("このストロークは存在しません")
+	errStrokeDeleteDeny = errors.New("自分が描いたストロークか、自分の部屋のストロークしか消せません")
+)
+
+type strokeTombstone struct {
+	ID        int64     `json:"id" db:"id"`
+	RoomID    int64     `json:"room_id" db:"room_id"`
+	StrokeID  int64     `json:"stroke_id" db:"stroke_id"`
+	DeletedAt time.Time `json:"deleted_at" db:"deleted_at"`
+}
+
+// loadTombstones は部屋ごとに ID 順で削除の記録を返す
+func loadTombstones() (map[int64][]strokeTombstone, error) {
+	tombstones := []strokeTombstone{}
+	err := dbx.Select(&tombstones, "SELECT `id`, `room_id`, `stroke_id`, `deleted_at` FROM `stroke_tombstones` ORDER BY `id` ASC")
+	if err != nil {
+		return nil, err
+	}
+	m := map[int64][]strokeTombstone{}
+	for _, ts := range tombstones {
+		m[ts.RoomID] = append(m[ts.RoomID], ts)
+	}
+	return m, nil
+}
+
+// deleteStrokeRows はストロークと、点や描いた人などそれに付いた行を消す。消す行が無くてもエラーにしない。
+// 点の ID を使い直さないように、消した点の一番大きい ID を deleted_id_marks に残す
+func deleteStrokeRows(tx *sqlx.Tx, strokeID int64) (int64, error) {
+	query := "INSERT INTO `deleted_id_marks` (`name`, `last_id`)"
+	query += " SELECT 'points', MAX(`id`) FROM `points` WHERE `stroke_id` = ? HAVING MAX(`id`) IS NOT NULL"
+	query += " ON DUPLICATE KEY UPDATE `last_id` = GREATEST(`last_id`, VALUES(`last_id`))"
+	if _, err := tx.Exec(query, strokeID); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec("DELETE FROM `strokes` WHERE `id` = ?", strokeID)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM `points` WHERE `stroke_id` = ?", strokeID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM `stroke_authors` WHERE `stroke_id` = ?", strokeID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM `stroke_layers` WHERE `stroke_id` = ?", strokeID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM `stroke_shapes` WHERE `stroke_id` = ?", strokeID); err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// FindStroke は部屋のストロークを ID で探す
+func (r *RoomRepo) FindStroke(roomID int64, strokeID int64) (*Stroke, bool) {
+	room, ok := r.Get(roomID)
+	if !ok {
+		return nil, false
+	}
+	strokes := room.StrokesSnapshot()
+	i := sort.Search(len(strokes), func(i int) bool {
+		return strokes[i].ID >= strokeID
+	})
+	if i == len(strokes) || strokes[i].ID != strokeID {
+		return nil, false
+	}
+	s := strokes[i]
+	return &s, true
+}
+
+// LastStrokeBy はトークンかアカウントが部屋に最後に描いたストロークを返す
+func (r *RoomRepo) LastStrokeBy(roomID int64, tokenID int64, userID int64) (*Stroke, bool) {
+	room, ok := r.Get(roomID)
+	if !ok {
+		return nil, false
+	}
+	strokes := room.StrokesSnapshot()
+	for i := len(strokes) - 1; i >= 0; i-- {
+		if isStrokeAuthor(&strokes[i], tokenID, userID) {
+			s := strokes[i]
+			return &s, true
+		}
+	}
+	return nil, false
+}
+
+// DeleteStroke はストロークを外して削除の記録を足し、SVG のキャッシュを捨てる
+func (r *RoomRepo) DeleteStroke(ts strokeTombstone) {
+	room, ok := r.Get(ts.RoomID)
+	if !ok {
+		return
+	}
+
+	room.mu.Lock()
+	i := sort.Search(len(room.Strokes), func(i int) bool {
+		return room.Strokes[i].ID >= ts.StrokeID
+	})
+	if i < len(room.Strokes) && room.Strokes[i].ID == ts.StrokeID {
+		// 公開済みの slice は書き換えられないのでコピーする
+		strokes := make([]Stroke, 0, len(room.Strokes)-1)
+		strokes = append(strokes, room.Strokes[:i]...)
+		strokes = append(strokes, room.Strokes[i+1:]...)
+		room.Strokes = strokes
+		room.StrokeCount = len(room.Strokes)
+		room.publishStrokes()
+	}
+	room.tombstones = append(room.tombstones, ts)
+	room.mu.Unlock()
+
+	room.invalidateSVG()
+}
+
+// HasTombstone は部屋にその ID の削除の記録があるかを返す
+func (r *RoomRepo) HasTombstone(roomID int64, tombstoneID int64) bool {
+	for _, ts := range r.GetTombstones(roomID, tombstoneID-1) {
+		return ts.ID == tombstoneID
+	}
+	return false
+}
+
+// GetTombstones は ID が afterID より大きい削除の記録を返す
+func (r *RoomRepo) GetTombstones(roomID int64, afterID int64) []strokeTombstone {
+	room, ok := r.Get(roomID)
+	if !ok {
+		return []strokeTombstone{}
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	i := sort.Search(len(room.tombstones), func(i int) bool {
+		return room.tombstones[i].ID > afterID
+	})
+	tombstones := make([]strokeTombstone, len(room.tombstones)-i)
+	copy(tombstones, room.tombstones[i:])
+	return tombstones
+}
+
+func isStrokeAuthor(s *Stroke, tokenID int64, userID int64) bool {
+	if s.AuthorTokenID != 0 && s.AuthorTokenID == tokenID {
+		return true
+	}
+	return userID != 0 && s.AuthorUserID == userID
+}
+
+// streamEventID は SSE の id に入れる、ストロークと削除の記録をどこまで送ったか
+func streamEventID(lastStrokeID int64, lastTombstoneID int64) string {
+	return fmt.Sprintf("%d.%d", lastStrokeID, lastTombstoneID)
+}
+
+// parseStreamEventID は streamEventID の形の id を読む。
+// 削除の記録 ID の無い以前の形の id なら lastTombstoneID に -1 を返す
+func parseStreamEventID(id string) (int64, int64, error) {
+	lastTombstoneID := int64(-1)
+	if i := strings.IndexByte(id, '.'); i >= 0 {
+		var err error
+		lastTombstoneID, err = strconv.ParseInt(id[i+1:], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		id = id[:i]
+	}
+	lastStrokeID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return lastStrokeID, lastTombstoneID, nil
+}
+
+// missedTombstones はストリームを始めるときに送る削除の記録と、次に読み始める ID を返す。
+// 再接続で削除の記録をどこまで送ったかがわかれば、その続きから読む。
+// わからなければ lastStrokeID までに送ったはずのストロークの削除を全部送る。
+func missedTombstones(roomID int64, lastStrokeID int64, lastTombstoneID int64) ([]strokeTombstone, int64, error) {
+	if lastStrokeID != 0 && lastTombstoneID >= 0 {
+		return nil, lastTombstoneID, nil
+	}
+	tombstones, err := store.GetTombstones(roomID, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	var lastID int64
+	if len(tombstones) > 0 {
+		lastID = tombstones[len(tombstones)-1].ID
+	}
+	if lastStrokeID == 0 {
+		return nil, lastID, nil
+	}
+	missed := []strokeTombstone{}
+	for _, ts := range tombstones {
+		if ts.StrokeID <= lastStrokeID {
+			missed = append(missed, ts)
+		}
+	}
+	return missed, lastID, nil
+}
+
+// deleteStroke は HTTP と WebSocket の両方から使う
+func deleteStroke(t *Token, roomID int64, strokeID int64) (*strokeTombstone, error) {
+	room, err := store.GetRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	// 描けなくなった部屋では、自分のストロークでも消せない
+	if err := checkDrawPermission(t, room); err != nil {
+		return nil, err
+	}
+	s, err := store.GetStroke(roomID, strokeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isStrokeAuthor(s, t.AuthorTokenID(), t.UserID()) {
+		owner, err := store.RoomOwner(room.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !isRoomOwner(t, owner) {
+			return nil, errStrokeDeleteDeny
+		}
+	}
+
+	ts, err := store.DeleteStroke(roomID, strokeID)
+	if err != nil {
+		return nil, err
+	}
+	hub.Notify(roomID)
+	return ts, nil
+}
+
+// undoStroke は自分が部屋に最後に描いたストロークを消す
+func undoStroke(t *Token, roomID int64) (*strokeTombstone, error) {
+	room, err := store.GetRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDrawPermission(t, room); err != nil {
+		return nil, err
+	}
+	s, err := store.LastStrokeBy(roomID, t.AuthorTokenID(), t.UserID())
+	if err != nil {
+		return nil, err
+	}
+	ts, err := store.DeleteStroke(roomID, s.ID)
+	if err != nil {
+		return nil, err
+	}
+	hub.Notify(roomID)
+	return ts, nil
+}
+
+func outputDeleteError(w http.ResponseWriter, err error) {
+	switch err {
+	case errStrokeNotFound:
+		outputErrorMsg(w, http.StatusNotFound, err.Error())
+	case errStrokeDeleteDeny:
+		outputErrorMsg(w, http.StatusForbidden, err.Error())
+	default:
+		outputStrokeError(w, err)
+	}
+}
+
+func outputTombstone(w http.ResponseWriter, ts *strokeTombstone) {
+	b, _ := json.Marshal(struct {
+		Tombstone *strokeTombstone `json:"stroke_deleted"`
+	}{Tombstone: ts})
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func deleteAPIStrokesRoomsIDStrokeID(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	t, id, ok := parseDraftRequest(ctx, w, r)
+	if !ok {
+		return
+	}
+	strokeID, err := strconv.ParseInt(pat.Param(ctx, "stroke_id"), 10, 64)
+	if err != nil {
+		outputErrorMsg(w, http.StatusNotFound, errStrokeNotFound.Error())
+		return
+	}
+
+	ts, err := deleteStroke(t, id, strokeID)
+	if err != nil {
+		outputDeleteError(w, err)
+		return
+	}
+	outputTombstone(w, ts)
+}
+
+func postAPIStrokesRoomsIDUndo(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	t, id, ok := parseDraftRequest(ctx, w, r)
+	if !ok {
+		return
+	}
+
+	ts, err := undoStroke(t, id)
+	if err != nil {
+		outputDeleteError(w, err)
+		return
+	}
+	outputTombstone(w, ts)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postTestStroke(t *testing.T, ts *httptest.Server, tk *Token, roomID int64) int64 {
+	code, b := doRequest(t, "POST", fmt.Sprintf("%s/api/strokes/rooms/%d", ts.URL, roomID), tk, testStrokeBody())
+	if code != http.StatusOK {
+		t.Fatalf("POST stroke: %d %s", code, b)
+	}
+	var res struct {
+		Stroke Stroke `json:"stroke"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Stroke.ID
+}
+
+func TestDeleteAndUndoPermissions(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner, alice, bob := newTestToken(), newTestToken(), newTestToken()
+	room := createTestRoom(t, ts, owner)
+
+	postTestStroke(t, ts, owner, room.ID)
+	aliceFirst := postTestStroke(t, ts, alice, room.ID)
+	aliceSecond := postTestStroke(t, ts, alice, room.ID)
+	bobStroke := postTestStroke(t, ts, bob, room.ID)
+
+	deleteURL := func(strokeID int64) string {
+		return fmt.Sprintf("%s/api/strokes/rooms/%d/%d", ts.URL, room.ID, strokeID)
+	}
+	undoURL := fmt.Sprintf("%s/api/strokes/rooms/%d/undo", ts.URL, room.ID)
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		tk         *Token
+		want       int
+		wantStroke int64
+	}{
+		{"other user deletes", "DELETE", deleteURL(aliceFirst), bob, http.StatusForbidden, 0},
+		{"no token", "DELETE", deleteURL(aliceFirst), nil, http.StatusBadRequest, 0},
+		{"unknown stroke", "DELETE", deleteURL(9999), owner, http.StatusNotFound, 0},
+		{"author deletes", "DELETE", deleteURL(aliceFirst), alice, http.StatusOK, aliceFirst},
+		{"already deleted", "DELETE", deleteURL(aliceFirst), alice, http.StatusNotFound, 0},
+		{"owner deletes others", "DELETE", deleteURL(aliceSecond), owner, http.StatusOK, aliceSecond},
+		{"undo own last stroke", "POST", undoURL, bob, http.StatusOK, bobStroke},
+		{"nothing to undo", "POST", undoURL, bob, http.StatusNotFound, 0},
+	}
+	for _, tt := range tests {
+		code, b := doRequest(t, tt.method, tt.url, tt.tk, nil)
+		if code != tt.want {
+			t.Errorf("%s: got %d %s, want %d", tt.name, code, b, tt.want)
+			continue
+		}
+		if tt.wantStroke == 0 {
+			continue
+		}
+		var res struct {
+			Tombstone strokeTombstone `json:"stroke_deleted"`
+		}
+		if err := json.Unmarshal(b, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Tombstone.StrokeID != tt.wantStroke {
+			t.Errorf("%s: deleted stroke %d, want %d", tt.name, res.Tombstone.StrokeID, tt.wantStroke)
+		}
+	}
+
+	if strokes := roomRepo.GetStrokes(room.ID, 0); len(strokes) != 1 {
+		t.Errorf("%d strokes left, want 1", len(strokes))
+	}
+}
+
+// TestDeleteAndUndoAccess は描く権限が無くなった部屋や見られない部屋では、
+// 自分のストロークでも消したり取り消したりできないことを確かめる
+func TestDeleteAndUndoAccess(t *testing.T) {
+	defer useTestDB(t)()
+	ts := newTestServer(t)
+	defer ts.Close()
+	room, roles := setupAccessRoom(t, ts, visibilityPublic)
+	alice := roles["stranger"]
+	aliceStroke := postTestStroke(t, ts, alice, room.ID)
+
+	deleteURL := fmt.Sprintf("%s/api/strokes/rooms/%d/%d", ts.URL, room.ID, aliceStroke)
+	undoURL := fmt.Sprintf("%s/api/strokes/rooms/%d/undo", ts.URL, room.ID)
+	settingsURL := fmt.Sprintf("%s/api/rooms/%d/settings", ts.URL, room.ID)
+
+	for _, s := range []roomSettings{
+		{Visibility: visibilityPublic, Drawing: drawingInvited},
+		{Visibility: visibilityPrivate, Drawing: drawingAnyone},
+	} {
+		if code, b := doRequest(t, "PUT", settingsURL, roles["owner"], s); code != http.StatusOK {
+			t.Fatalf("PUT settings: %d %s", code, b)
+		}
+		if code, b := doRequest(t, "DELETE", deleteURL, alice, nil); code != http.StatusForbidden {
+			t.Errorf("%+v: delete own stroke: got %d %s, want %d", s, code, b, http.StatusForbidden)
+		}
+		if code, b := doRequest(t, "POST", undoURL, alice, nil); code != http.StatusForbidden {
+			t.Errorf("%+v: undo: got %d %s, want %d", s, code, b, http.StatusForbidden)
+		}
+	}
+
+	if _, ok := roomRepo.FindStroke(room.ID, aliceStroke); !ok {
+		t.Error("stroke was deleted without permission")
+	}
+}
+
+// streamEventsUntilLayers はストリームを開いて、最初の layers イベントまでのイベント名と最後の id を返す
+func streamEventsUntilLayers(t *testing.T, url string, lastEventID string) ([]string, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	type result struct {
+		events []string
+		id     string
+	}
+	done := make(chan result, 1)
+	go func() {
+		r := result{}
+		sc := bufio.NewScanner(res.Body)
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case strings.HasPrefix(line, "id:"):
+				r.id = strings.TrimPrefix(line, "id:")
+			case strings.HasPrefix(line, "event:"):
+				ev := strings.TrimPrefix(line, "event:")
+				r.events = append(r.events, ev)
+				if ev == "layers" {
+					done <- r
+					return
+				}
+			}
+		}
+		done <- r
+	}()
+	select {
+	case r := <-done:
+		return r.events, r.id
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no layers event from %s", url)
+	}
+	return nil, ""
+}
+
+func countEvents(events []string, name string) int {
+	n := 0
+	for _, ev := range events {
+		if ev == name {
+			n++
+		}
+	}
+	return n
+}
+
+// TestStreamTombstoneCursor は再接続したときに、id に入れた位置より後の削除だけを送ることを確かめる
+func TestStreamTombstoneCursor(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := newTestToken()
+	room := createTestRoom(t, ts, owner)
+	first := postTestStroke(t, ts, owner, room.ID)
+	postTestStroke(t, ts, owner, room.ID)
+	if code, b := doRequest(t, "DELETE", fmt.Sprintf("%s/api/strokes/rooms/%d/%d", ts.URL, room.ID, first), owner, nil); code != http.StatusOK {
+		t.Fatalf("DELETE stroke: %d %s", code, b)
+	}
+	url := fmt.Sprintf("%s/api/stream/rooms/%d?csrf_token=%s", ts.URL, room.ID, owner.CSRFToken)
+
+	// 最初の接続では削除済みのストロークは送らないので、削除も送らない
+	events, id := streamEventsUntilLayers(t, url, "")
+	if n := countEvents(events, "stroke_deleted"); n != 0 {
+		t.Errorf("first connect: %d stroke_deleted, want 0", n)
+	}
+	if n := countEvents(events, "stroke"); n != 1 {
+		t.Errorf("first connect: %d strokes, want 1", n)
+	}
+
+	// 受け取った id で再接続したら、もう送った削除は送らない
+	events, _ = streamEventsUntilLayers(t, url, id)
+	if n := countEvents(events, "stroke_deleted"); n != 0 {
+		t.Errorf("reconnect with %q: %d stroke_deleted, want 0", id, n)
+	}
+
+	// 削除の位置の無い以前の形の id なら、受け取ったはずのストロークの削除を送る
+	events, _ = streamEventsUntilLayers(t, url, strings.SplitN(id, ".", 2)[0])
+	if n := countEvents(events, "stroke_deleted"); n != 1 {
+		t.Errorf("reconnect with stroke ID only: %d stroke_deleted, want 1", n)
+	}
+
+	// 再接続までに消えたストロークの削除は送る
+	second := postTestStroke(t, ts, owner, room.ID)
+	_, id = streamEventsUntilLayers(t, url, "")
+	if code, b := doRequest(t, "DELETE", fmt.Sprintf("%s/api/strokes/rooms/%d/%d", ts.URL, room.ID, second), owner, nil); code != http.StatusOK {
+		t.Fatalf("DELETE stroke: %d %s", code, b)
+	}
+	events, _ = streamEventsUntilLayers(t, url, id)
+	if n := countEvents(events, "stroke_deleted"); n != 1 {
+		t.Errorf("reconnect after delete: %d stroke_deleted, want 1", n)
+	}
+}
+
+// TestStreamEventFraming は id を付けたイベントで、id と event を同じまとまりに書くことを確かめる。
+// 空行で区切ると、ブラウザは id だけの空のイベントを先に届けてしまう
+func TestStreamEventFraming(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := newTestToken()
+	room := createTestRoom(t, ts, owner)
+	first := postTestStroke(t, ts, owner, room.ID)
+	postTestStroke(t, ts, owner, room.ID)
+
+	res, err := http.Get(fmt.Sprintf("%s/api/stream/rooms/%d?csrf_token=%s", ts.URL, room.ID, owner.CSRFToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	blocks := make(chan []string, 16)
+	go func() {
+		defer close(blocks)
+		block := []string{}
+		sc := bufio.NewScanner(res.Body)
+		for sc.Scan() {
+			if sc.Text() != "" {
+				block = append(block, sc.Text())
+				continue
+			}
+			blocks <- block
+			block = []string{}
+		}
+	}()
+
+	deleted := false
+	seen := map[string]bool{}
+	timeout := time.After(5 * time.Second)
+	for !seen["stroke"] || !seen["stroke_deleted"] {
+		select {
+		case block, ok := <-blocks:
+			if !ok {
+				t.Fatal("stream closed")
+			}
+			hasID, event := false, ""
+			for _, line := range block {
+				switch {
+				case strings.HasPrefix(line, "id:"):
+					hasID = true
+				case strings.HasPrefix(line, "event:"):
+					event = strings.TrimPrefix(line, "event:")
+				}
+			}
+			if hasID && event == "" {
+				t.Fatalf("id without an event: %q", block)
+			}
+			if hasID {
+				seen[event] = true
+			}
+			if event == "layers" && !deleted {
+				deleted = true
+				if code, b := doRequest(t, "DELETE", fmt.Sprintf("%s/api/strokes/rooms/%d/%d", ts.URL, room.ID, first), owner, nil); code != http.StatusOK {
+					t.Fatalf("DELETE stroke: %d %s", code, b)
+				}
+			}
+		case <-timeout:
+			t.Fatalf("timed out; events with id: %v", seen)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// アカウントは任意。ログインしているとトークンがアカウントに紐付き、
+// トークンを作り直しても自分で作った部屋に1画目を描ける。
+// ログイン状態はトークンとは別にセッションの cookie で持つ。
+
+const sessionCookieName = "isuketch_session"
+
+var sessionTTL = 30 * 24 * time.Hour
+
+var (
+	// 無いユーザー名でログインしたときも同じだけ時間をかけて、ユーザー名があるかを悟らせない
+	dummyPasswordHash     []byte
+	dummyPasswordHashOnce sync.Once
+)
+
+type User struct {
+	ID           int64     `json:"id" db:"id"`
+	Name         string    `json:"name" db:"name"`
+	PasswordHash []byte    `json:"-" db:"password_hash"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+func createSession(userID int64) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	sessionID := hex.EncodeToString(b)
+	_, err := dbx.Exec("INSERT INTO `sessions` (`session_id`, `user_id`) VALUES (?, ?)", sessionID, userID)
+	if err != nil {
+		return "", err
+	}
+	return sessionID, nil
+}
+
+// sessionUserID はリクエストの cookie からログイン中のアカウントを返す。ログインしていなければ 0
+func sessionUserID(r *http.Request) (int64, error) {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return 0, nil
+	}
+	var userID int64
+	query := "SELECT `user_id` FROM `sessions` WHERE `session_id` = ? AND `created_at` > ?"
+	err = dbx.QueryRow(query, c.Value, time.Now().Add(-sessionTTL)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return userID, err
+}
+
+// purgeSessions は期限切れのセッションを消す
+func purgeSessions() error {
+	_, err := dbx.Exec("DELETE FROM `sessions` WHERE `created_at` <= ?", time.Now().Add(-sessionTTL))
+	return err
+}
+
+// sessionCookie は cookie で状態を変える POST を受け付けるので、他のサイトからのリクエストには付けさせない
+func sessionCookie(r *http.Request, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, sessionID string) {
+	c := sessionCookie(r, sessionID)
+	c.Expires = time.Now().Add(sessionTTL)
+	http.SetCookie(w, c)
+}
+
+func parseAccountRequest(r *http.Request) (name string, password string, err error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", "", err
+	}
+	posted := struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}{}
+	err = json.Unmarshal(body, &posted)
+	return posted.Name, posted.Password, err
+}
+
+// loginAs はセッションを作り、リクエストのトークンがあればアカウントに紐付ける
+func loginAs(w http.ResponseWriter, r *http.Request, u *User) {
+	sessionID, err := createSession(u.ID)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+
+	t, err := checkToken(r.Header.Get("x-csrf-token"))
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	if t != nil {
+		if err := tokens.Bind(t, u.ID); err != nil {
+			outputError(w, err)
+			return
+		}
+	}
+
+	setSessionCookie(w, r, sessionID)
+
+	b, _ := json.Marshal(struct {
+		User *User `json:"user"`
+	}{User: u})
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func postAPIUsersRegister(w http.ResponseWriter, r *http.Request) {
+	name, password, err := parseAccountRequest(r)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "リクエストが正しくありません。")
+		return
+	}
+	if name == "" || utf8.RuneCountInString(name) > 64 || len(password) < 8 || len(password) > 72 {
+		outputErrorMsg(w, http.StatusBadRequest, "ユーザー名は64文字以内、パスワードは8文字以上72バイト以内で指定してください。")
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+
+	u := &User{Name: name, PasswordHash: hash, CreatedAt: time.Now().Truncate(time.Microsecond)}
+	result, err := dbx.Exec("INSERT INTO `users` (`name`, `password_hash`, `created_at`) VALUES (?, ?, ?)", u.Name, u.PasswordHash, u.CreatedAt)
+	if me, ok := err.(*mysql.MySQLError); ok && me.Number == 1062 {
+		outputErrorMsg(w, http.StatusConflict, "このユーザー名は既に使われています。")
+		return
+	}
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	u.ID, err = result.LastInsertId()
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+
+	loginAs(w, r, u)
+}
+
+func postAPIUsersLogin(w http.ResponseWriter, r *http.Request) {
+	name, password, err := parseAccountRequest(r)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "リクエストが正しくありません。")
+		return
+	}
+
+	u := &User{}
+	err = dbx.Get(u, "SELECT `id`, `name`, `password_hash`, `created_at` FROM `users` WHERE `name` = ?", name)
+	if err != nil && err != sql.ErrNoRows {
+		outputError(w, err)
+		return
+	}
+	if err == sql.ErrNoRows {
+		dummyPasswordHashOnce.Do(func() {
+			dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+		})
+		u.PasswordHash = dummyPasswordHash
+	}
+	if bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)) != nil || u.ID == 0 {
+		outputErrorMsg(w, http.StatusUnauthorized, "ユーザー名かパスワードが違います。")
+		return
+	}
+
+	loginAs(w, r, u)
+}
+
+// postAPIUsersLogout はセッションを消し、リクエストのトークンをアカウントから外す
+func postAPIUsersLogout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		if _, err := dbx.Exec("DELETE FROM `sessions` WHERE `session_id` = ?", c.Value); err != nil {
+			outputError(w, err)
+			return
+		}
+	}
+
+	t, err := checkToken(r.Header.Get("x-csrf-token"))
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	if t != nil {
+		if err := tokens.Unbind(t); err != nil {
+			outputError(w, err)
+			return
+		}
+	}
+
+	c := sessionCookie(r, "")
+	c.MaxAge = -1
+	http.SetCookie(w, c)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// doAccountRequest はアカウントの API を呼んで、ステータスとセッションの cookie を返す
+func doAccountRequest(t *testing.T, ts *httptest.Server, path string, tk *Token, name string, password string) (int, *http.Cookie) {
+	b, err := json.Marshal(map[string]string{"name": name, "password": password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", ts.URL+path, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk != nil {
+		req.Header.Set("x-csrf-token", tk.CSRFToken)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	for _, c := range res.Cookies() {
+		if c.Name == sessionCookieName {
+			return res.StatusCode, c
+		}
+	}
+	return res.StatusCode, nil
+}
+
+func checkSessionCookie(t *testing.T, what string, c *http.Cookie) {
+	if c == nil {
+		t.Errorf("%s: no session cookie", what)
+		return
+	}
+	if !c.HttpOnly || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("%s: cookie HttpOnly=%v SameSite=%v, want HttpOnly and Lax", what, c.HttpOnly, c.SameSite)
+	}
+}
+
+// TestUserAccounts はアカウントを作るとトークンが紐付き、ログアウトで外れることと、
+// ログインに失敗したときの応答を確かめる
+func TestUserAccounts(t *testing.T) {
+	defer useTestDB(t)()
+	if os.Getenv("TEST_MYSQL_DSN") != "" {
+		t.Skip("uses canned rows of the recording driver")
+	}
+	ts := newTestServer(t)
+	defer ts.Close()
+	tk := newTestToken()
+
+	code, c := doAccountRequest(t, ts, "/api/users/register", tk, "alice", "password1")
+	if code != http.StatusOK {
+		t.Fatalf("register: %d", code)
+	}
+	checkSessionCookie(t, "register", c)
+	userID := tk.UserID()
+	if userID == 0 {
+		t.Fatal("token is not bound to the registered user")
+	}
+
+	if code, _ := doAccountRequest(t, ts, "/api/users/register", tk, "bob", "short"); code != http.StatusBadRequest {
+		t.Errorf("register with a short password: got %d, want %d", code, http.StatusBadRequest)
+	}
+
+	// 無いユーザー名でも、パスワードが違うときと同じ応答にする
+	if code, c := doAccountRequest(t, ts, "/api/users/login", nil, "nobody", "dummy password"); code != http.StatusUnauthorized || c != nil {
+		t.Errorf("login as an unknown user: got %d %v, want %d", code, c, http.StatusUnauthorized)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("password1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRecordDriver.setRows("FROM `users` WHERE `name`", []string{"id", "name", "password_hash", "created_at"},
+		[]driver.Value{userID, "alice", hash, time.Now()})
+	if code, _ := doAccountRequest(t, ts, "/api/users/login", nil, "alice", "wrong password"); code != http.StatusUnauthorized {
+		t.Errorf("login with a wrong password: got %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	other := newTestToken()
+	code, c = doAccountRequest(t, ts, "/api/users/login", other, "alice", "password1")
+	if code != http.StatusOK {
+		t.Fatalf("login: %d", code)
+	}
+	checkSessionCookie(t, "login", c)
+	if other.UserID() != userID {
+		t.Errorf("logged in token is bound to %d, want %d", other.UserID(), userID)
+	}
+
+	code, c = doAccountRequest(t, ts, "/api/users/logout", other, "", "")
+	if code != http.StatusNoContent {
+		t.Fatalf("logout: %d", code)
+	}
+	if c == nil || c.MaxAge >= 0 {
+		t.Errorf("logout does not clear the session cookie: %v", c)
+	}
+	if other.UserID() != 0 {
+		t.Error("token is still bound after logout")
+	}
+}
+
+// TestPurgeSessions は期限切れのセッションを消すことを確かめる
+func TestPurgeSessions(t *testing.T) {
+	defer useTestDB(t)()
+	if os.Getenv("TEST_MYSQL_DSN") != "" {
+		t.Skip("reads executed statements of the recording driver")
+	}
+	if err := purgeSessions(); err != nil {
+		t.Fatal(err)
+	}
+	testRecordDriver.mu.Lock()
+	defer testRecordDriver.mu.Unlock()
+	for _, e := range testRecordDriver.execs {
+		if strings.HasPrefix(e.query, "DELETE FROM `sessions`") {
+			return
+		}
+	}
+	t.Error("expired sessions are not deleted")
+}
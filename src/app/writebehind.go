@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ROOM_STORE=writebehind のときは、ストロークと削除の記録の ID をプロセス内で採番して
+// ジャーナルに書いたらすぐに RoomRepo に入れてストリームに流し、
+// MySQL にはバックグラウンドでまとめて書く。
+// 起動時はジャーナルに残っているストロークを MySQL に書いてからリクエストを受ける。
+
+var (
+	strokeJournalPath = "/var/tmp/isuketch-strokes.journal"
+	// 1回のトランザクションでまとめて書くストロークの数
+	writeBehindBatchSize = 100
+	// ジャーナルのセグメントをこの大きさで切り替える
+	journalSegmentSize int64 = 64 * 1024 * 1024
+)
+
+type writeBehindRoomStore struct {
+	*cachedRoomStore
+
+	journal *strokeJournal
+	queue   chan journalEntry
+
+	lastStrokeID    int64
+	lastPointID     int64
+	lastTombstoneID int64
+}
+
+// journalEntry はジャーナルの1行で、ストロークの追加か削除のどちらか
+type journalEntry struct {
+	Stroke *Stroke `json:"stroke,omitempty"`
+	// Stroke の JSON には描いた人が出ないので別に持つ
+	AuthorTokenID int64            `json:"author_token_id,omitempty"`
+	AuthorUserID  int64            `json:"author_user_id,omitempty"`
+	Tombstone     *strokeTombstone `json:"tombstone,omitempty"`
+
+	// 書いたジャーナルのセグメント
+	segment int
+}
+
+func newWriteBehindRoomStore(c *cachedRoomStore) *writeBehindRoomStore {
+	return &writeBehindRoomStore{
+		cachedRoomStore: c,
+		queue:           make(chan journalEntry, 10000),
+	}
+}
+
+func (wb *writeBehindRoomStore) Init() error {
+	if err := wb.cachedRoomStore.Init(); err != nil {
+		return err
+	}
+
+	journal, pending, err := openStrokeJournal(strokeJournalPath)
+	if err != nil {
+		return err
+	}
+	wb.journal = journal
+
+	if len(pending) > 0 {
+		// 削除の記録だけ MySQL に入ってセグメントが消えていると、ストロークを書き直すと
+		// 消したものが生き返るので、削除済みのストロークは書かない
+		pending, err = dropTombstonedStrokes(pending)
+		if err != nil {
+			return err
+		}
+		// 削除は対象のストロークより後に書かれているので、ジャーナルの順番のまま書く
+		log.Printf("replaying %d entries from %s", len(pending), strokeJournalPath)
+		for i := 0; i < len(pending); i += writeBehindBatchSize {
+			end := i + writeBehindBatchSize
+			if end > len(pending) {
+				end = len(pending)
+			}
+			if err := persistEntries(pending[i:end]); err != nil {
+				return err
+			}
+		}
+		for _, e := range pending {
+			if ts := e.Tombstone; ts != nil {
+				if !wb.repo.HasTombstone(ts.RoomID, ts.ID) {
+					wb.repo.DeleteStroke(*ts)
+				}
+				continue
+			}
+			s := *e.Stroke
+			if _, ok := wb.repo.Get(s.RoomID); !ok {
+				log.Println("[warn] journaled stroke for unknown room", s.RoomID)
+				continue
+			}
+			if _, ok := wb.repo.FindStroke(s.RoomID, s.ID); ok {
+				// MySQL から読み込み済み
+				continue
+			}
+			wb.repo.AddStroke(s.RoomID, s, s.Points)
+		}
+	}
+	if err := wb.journal.Start(); err != nil {
+		return err
+	}
+
+	// 消したストロークの ID を使い直すと、再接続したクライアントが削除の記録を見て
+	// 新しいストロークを消してしまうので、消した行の ID より後から採番する
+	wb.lastStrokeID, err = lastUsedStrokeID()
+	if err != nil {
+		return err
+	}
+	wb.lastPointID, err = lastUsedPointID()
+	if err != nil {
+		return err
+	}
+	err = dbx.QueryRow("SELECT COALESCE(MAX(`id`), 0) FROM `stroke_tombstones`").Scan(&wb.lastTombstoneID)
+	if err != nil {
+		return err
+	}
+
+	go wb.runWriter()
+	return nil
+}
+
+func (wb *writeBehindRoomStore) AddStroke(roomID int64, postedStroke Stroke) (*Stroke, error) {
+	room, ok := wb.repo.Get(roomID)
+	if !ok {
+		return nil, errRoomNotFound
+	}
+	room.addMtx.Lock()
+	defer room.addMtx.Unlock()
+
+	s := Stroke{
+		ID:        atomic.AddInt64(&wb.lastStrokeID, 1),
+		RoomID:    roomID,
+		Width:     postedStroke.Width,
+		Red:       postedStroke.Red,
+		Green:     postedStroke.Green,
+		Blue:      postedStroke.Blue,
+		Alpha:     postedStroke.Alpha,
+		CreatedAt: time.Now().Truncate(time.Microsecond),
+		Points:    make([]Point, len(postedStroke.Points)),
+		LayerID:   postedStroke.LayerID,
+		Type:      postedStroke.Type,
+		Fill:      postedStroke.Fill,
+		Text:      postedStroke.Text,
+
+		AuthorTokenID: postedStroke.AuthorTokenID,
+		AuthorUserID:  postedStroke.AuthorUserID,
+	}
+	lastPointID := atomic.AddInt64(&wb.lastPointID, int64(len(s.Points)))
+	firstPointID := lastPointID - int64(len(s.Points)) + 1
+	for i, p := range postedStroke.Points {
+		s.Points[i] = Point{ID: firstPointID + int64(i), StrokeID: s.ID, X: p.X, Y: p.Y}
+	}
+
+	e := journalEntry{Stroke: &s, AuthorTokenID: s.AuthorTokenID, AuthorUserID: s.AuthorUserID}
+	seq, err := wb.journal.Append(e)
+	if err != nil {
+		return nil, err
+	}
+	e.segment = seq
+	// 見えるようにする前にキューに入れて、このストロークの削除より先に書かれるようにする
+	wb.queue <- e
+	wb.repo.AddStroke(roomID, s, s.Points)
+	return &s, nil
+}
+
+func (wb *writeBehindRoomStore) DeleteStroke(roomID int64, strokeID int64) (*strokeTombstone, error) {
+	room, ok := wb.repo.Get(roomID)
+	if !ok {
+		return nil, errRoomNotFound
+	}
+	room.addMtx.Lock()
+	defer room.addMtx.Unlock()
+
+	if _, ok := wb.repo.FindStroke(roomID, strokeID); !ok {
+		return nil, errStrokeNotFound
+	}
+
+	ts := strokeTombstone{
+		ID:        atomic.AddInt64(&wb.lastTombstoneID, 1),
+		RoomID:    roomID,
+		StrokeID:  strokeID,
+		DeletedAt: time.Now().Truncate(time.Microsecond),
+	}
+	e := journalEntry{Tombstone: &ts}
+	seq, err := wb.journal.Append(e)
+	if err != nil {
+		return nil, err
+	}
+	e.segment = seq
+	wb.queue <- e
+	wb.repo.DeleteStroke(ts)
+	return &ts, nil
+}
+
+// dropTombstonedStrokes は MySQL に削除の記録があるストロークの追加を entries から除く
+func dropTombstonedStrokes(entries []journalEntry) ([]journalEntry, error) {
+	minID := int64(-1)
+	for _, e := range entries {
+		if e.Stroke != nil && (minID < 0 || e.Stroke.ID < minID) {
+			minID = e.Stroke.ID
+		}
+	}
+	if minID < 0 {
+		return entries, nil
+	}
+	ids := []int64{}
+	err := dbx.Select(&ids, "SELECT `stroke_id` FROM `stroke_tombstones` WHERE `stroke_id` >= ?", minID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return entries, nil
+	}
+	deleted := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		deleted[id] = true
+	}
+	kept := make([]journalEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.Stroke != nil && deleted[e.Stroke.ID] {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept, nil
+}
+
+// runWriter はキューに溜まった追加と削除をまとめて MySQL に書く。
+// 書けなかったときは捨てずに書けるまでやり直す。
+func (wb *writeBehindRoomStore) runWriter() {
+	batch := make([]journalEntry, 0, writeBehindBatchSize)
+	for {
+		batch = append(batch[:0], <-wb.queue)
+	fill:
+		for len(batch) < writeBehindBatchSize {
+			select {
+			case e := <-wb.queue:
+				batch = append(batch, e)
+			default:
+				break fill
+			}
+		}
+
+		wait := 100 * time.Millisecond
+		for {
+			err := persistEntries(batch)
+			if err == nil {
+				break
+			}
+			log.Printf("write-behind: failed to persist %d entries: %s", len(batch), err)
+			time.Sleep(wait)
+			if wait < 5*time.Second {
+				wait *= 2
+			}
+		}
+		if err := wb.journal.Persisted(batch); err != nil {
+			log.Println("write-behind: journal:", err)
+		}
+	}
+}
+
+// persistEntries は採番済みの追加と削除を順番どおりに1つのトランザクションで書く。
+// ジャーナルの再生で同じものを書くことがあるので、何度書いても同じ結果になるようにする。
+func persistEntries(entries []journalEntry) error {
+	tx, err := dbx.Beginx()
+	if err != nil {
+		return err
+	}
+	strokes := []Stroke{}
+	for _, e := range entries {
+		if e.Stroke != nil {
+			s := *e.Stroke
+			s.AuthorTokenID = e.AuthorTokenID
+			s.AuthorUserID = e.AuthorUserID
+			strokes = append(strokes, s)
+			continue
+		}
+		// 削除する前に、それまでの追加を書いておく
+		if len(strokes) > 0 {
+			if err := insertStrokesWithIDs(tx, strokes); err != nil {
+				tx.Rollback()
+				return err
+			}
+			strokes = strokes[:0]
+		}
+		ts := e.Tombstone
+		if _, err := deleteStrokeRows(tx, ts.StrokeID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		query := "INSERT IGNORE INTO `stroke_tombstones` (`id`, `room_id`, `stroke_id`, `deleted_at`) VALUES (?, ?, ?, ?)"
+		if _, err := tx.Exec(query, ts.ID, ts.RoomID, ts.StrokeID, ts.DeletedAt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if len(strokes) > 0 {
+		if err := insertStrokesWithIDs(tx, strokes); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func insertStrokesWithIDs(tx *sqlx.Tx, strokes []Stroke) error {
+	query := make([]byte, 0, 128+len(strokes)*24)
+	query = append(query, "INSERT IGNORE INTO `strokes` (`id`, `room_id`, `width`, `red`, `green`, `blue`, `alpha`, `created_at`) VALUES "...)
+	args := make([]interface{}, 0, len(strokes)*8)
+	points := []Point{}
+	for i, s := range strokes {
+		if i > 0 {
+			query = append(query, ',')
+		}
+		query = append(query, "(?, ?, ?, ?, ?, ?, ?, ?)"...)
+		args = append(args, s.ID, s.RoomID, s.Width, s.Red, s.Green, s.Blue, s.Alpha, s.CreatedAt)
+		points = append(points, s.Points...)
+	}
+	if _, err := tx.Exec(string(query), args...); err != nil {
+		return err
+	}
+
+	query = query[:0]
+	query = append(query, "INSERT IGNORE INTO `stroke_authors` (`stroke_id`, `token_id`, `user_id`) VALUES "...)
+	args = args[:0]
+	for _, s := range strokes {
+		if s.AuthorTokenID == 0 {
+			continue
+		}
+		if len(args) > 0 {
+			query = append(query, ',')
+		}
+		query = append(query, "(?, ?, ?)"...)
+		args = append(args, s.ID, s.AuthorTokenID, s.AuthorUserID)
+	}
+	if len(args) > 0 {
+		if _, err := tx.Exec(string(query), args...); err != nil {
+			return err
+		}
+	}
+
+	query = query[:0]
+	query = append(query, "INSERT IGNORE INTO `stroke_layers` (`stroke_id`, `layer_id`) VALUES "...)
+	args = args[:0]
+	for _, s := range strokes {
+		if s.LayerID == 0 {
+			continue
+		}
+		if len(args) > 0 {
+			query = append(query, ',')
+		}
+		query = append(query, "(?, ?)"...)
+		args = append(args, s.ID, s.LayerID)
+	}
+	if len(args) > 0 {
+		if _, err := tx.Exec(string(query), args...); err != nil {
+			return err
+		}
+	}
+
+	query = query[:0]
+	query = append(query, "INSERT IGNORE INTO `stroke_shapes` (`stroke_id`, `type`, `fill`, `text`) VALUES "...)
+	args = args[:0]
+	for _, s := range strokes {
+		if s.Type == shapePolyline {
+			continue
+		}
+		if len(args) > 0 {
+			query = append(query, ',')
+		}
+		query = append(query, "(?, ?, ?, ?)"...)
+		args = append(args, s.ID, s.Type, s.Fill, s.Text)
+	}
+	if len(args) > 0 {
+		if _, err := tx.Exec(string(query), args...); err != nil {
+			return err
+		}
+	}
+
+	for len(points) > 0 {
+		n := len(points)
+		if n > pointInsertChunkSize {
+			n = pointInsertChunkSize
+		}
+		chunk := points[:n]
+		points = points[n:]
+
+		query = query[:0]
+		query = append(query, "INSERT IGNORE INTO `points` (`id`, `stroke_id`, `x`, `y`) VALUES "...)
+		args = args[:0]
+		for i, p := range chunk {
+			if i > 0 {
+				query = append(query, ',')
+			}
+			query = append(query, "(?, ?, ?, ?)"...)
+			args = append(args, p.ID, p.StrokeID, p.X, p.Y)
+		}
+		if _, err := tx.Exec(string(query), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// strokeJournal は MySQL に書く前の追加と削除を1行1つの JSON で追記するファイル。
+// 同時に来た追記はまとめて書いて1回の fsync で済ませる。
+// journalSegmentSize ごとに別のファイル (セグメント) に切り替えて、
+// 中身が全部 MySQL に入ったセグメントから消していく。
+type strokeJournal struct {
+	path string
+	kick chan struct{}
+
+	mu      sync.Mutex
+	f       *os.File
+	seq     int
+	size    int64
+	buf     []byte
+	waiters []chan error
+	// セグメントごとの、まだ MySQL に書かれていない数
+	pending map[int]int
+	// 起動時に読んだファイル。再生して MySQL に書いたら Start で消す
+	old []string
+}
+
+// openStrokeJournal はジャーナルを読んで、まだ MySQL に書かれていないかもしれない追加と削除を返す
+func openStrokeJournal(path string) (*strokeJournal, []journalEntry, error) {
+	j := &strokeJournal{
+		path:    path,
+		kick:    make(chan struct{}, 1),
+		pending: map[int]int{},
+	}
+
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, nil, err
+	}
+	seqs := []int{}
+	for _, m := range matches {
+		seq, err := strconv.Atoi(strings.TrimPrefix(m, path+"."))
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+
+	// セグメントに分ける前のジャーナルは1つのファイルだった
+	if _, err := os.Stat(path); err == nil {
+		j.old = append(j.old, path)
+	}
+	for _, seq := range seqs {
+		j.old = append(j.old, j.segmentPath(seq))
+		j.seq = seq
+	}
+
+	pending := []journalEntry{}
+	for _, name := range j.old {
+		entries, err := readJournalFile(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		pending = append(pending, entries...)
+	}
+	return j, pending, nil
+}
+
+func readJournalFile(name string) ([]journalEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []journalEntry{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		var e journalEntry
+		err := json.Unmarshal(sc.Bytes(), &e)
+		if err == nil && e.Stroke == nil && e.Tombstone == nil {
+			// 削除を入れる前の形式では1行がストロークそのもの
+			e.Stroke = &Stroke{}
+			err = json.Unmarshal(sc.Bytes(), e.Stroke)
+		}
+		if err != nil {
+			// 書き込み途中で落ちた最後の行は、クライアントにも成功を返していないので捨てる
+			log.Println("stroke journal: skip broken entry:", err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (j *strokeJournal) segmentPath(seq int) string {
+	return fmt.Sprintf("%s.%d", j.path, seq)
+}
+
+// Start は起動時に読んだファイルを消して新しいセグメントに書き始める。
+// 読んだものを MySQL に書いてから呼ぶこと
+func (j *strokeJournal) Start() error {
+	for _, name := range j.old {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	j.old = nil
+
+	j.mu.Lock()
+	err := j.rotate()
+	j.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	go j.run()
+	return nil
+}
+
+// rotate は次のセグメントを開き、閉じたセグメントが全部 MySQL に書かれていれば消す。
+// j.mu を取ってから呼ぶ
+func (j *strokeJournal) rotate() error {
+	f, err := os.OpenFile(j.segmentPath(j.seq+1), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	old := j.seq
+	j.f = f
+	j.seq++
+	j.size = 0
+	if j.pending[old] == 0 {
+		delete(j.pending, old)
+		if err := os.Remove(j.segmentPath(old)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Append は書き込んで fsync が終わるまで待ち、書いたセグメントを返す
+func (j *strokeJournal) Append(e journalEntry) (int, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	b = append(b, '\n')
+	done := make(chan error, 1)
+
+	j.mu.Lock()
+	seq := j.seq
+	j.buf = append(j.buf, b...)
+	j.waiters = append(j.waiters, done)
+	j.pending[seq]++
+	j.mu.Unlock()
+
+	select {
+	case j.kick <- struct{}{}:
+	default:
+	}
+	if err := <-done; err != nil {
+		j.mu.Lock()
+		j.release(seq)
+		j.mu.Unlock()
+		return 0, err
+	}
+	return seq, nil
+}
+
+// run は溜まった追記をまとめて書いて fsync し、待っている Append に返す
+func (j *strokeJournal) run() {
+	for range j.kick {
+		j.mu.Lock()
+		buf, waiters, f := j.buf, j.waiters, j.f
+		j.buf, j.waiters = nil, nil
+		if len(waiters) == 0 {
+			j.mu.Unlock()
+			continue
+		}
+		// このまとまりまでを今のセグメントに書いて、次からは新しいセグメントに書く
+		j.size += int64(len(buf))
+		if j.size >= journalSegmentSize {
+			if err := j.rotate(); err != nil {
+				log.Println("stroke journal: rotate:", err)
+			}
+		}
+		rotated := f != j.f
+		j.mu.Unlock()
+
+		_, err := f.Write(buf)
+		if err == nil {
+			err = f.Sync()
+		}
+		for _, done := range waiters {
+			done <- err
+		}
+		if rotated {
+			f.Close()
+		}
+	}
+}
+
+// Persisted は MySQL に書けたことを記録し、全部書けた古いセグメントを消す
+func (j *strokeJournal) Persisted(entries []journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var err error
+	for _, e := range entries {
+		if e2 := j.release(e.segment); e2 != nil {
+			err = e2
+		}
+	}
+	return err
+}
+
+// release はセグメントの残りを1つ減らす。書いている途中のセグメントは rotate で閉じるときに、
+// 閉じたセグメントは残りが無くなったときに消す
+func (j *strokeJournal) release(seq int) error {
+	if _, ok := j.pending[seq]; !ok {
+		// rotate で消したセグメント
+		return nil
+	}
+	j.pending[seq]--
+	if j.pending[seq] > 0 || seq == j.seq {
+		return nil
+	}
+	delete(j.pending, seq)
+	if err := os.Remove(j.segmentPath(seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
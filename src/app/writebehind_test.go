@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setWriteBehindRows は部屋1つと、起動時に読む ID の最大値を recordDriver に決める
+func setWriteBehindRows(lastStrokeID, lastTombstonedID, lastPointID, lastDeletedPointID int64) {
+	testRecordDriver.setRows("FROM `rooms`", []string{"id", "name", "canvas_width", "canvas_height", "created_at"},
+		[]driver.Value{int64(1), "wb", int64(100), int64(100), time.Now()})
+	testRecordDriver.setRows("FROM `room_owners`", []string{"room_id", "token_id", "user_id"},
+		[]driver.Value{int64(1), int64(1), int64(0)})
+	testRecordDriver.setRows("MAX(`id`), 0) FROM `strokes`", []string{"id"}, []driver.Value{lastStrokeID})
+	testRecordDriver.setRows("MAX(`stroke_id`), 0) FROM `stroke_tombstones`", []string{"id"}, []driver.Value{lastTombstonedID})
+	testRecordDriver.setRows("MAX(`id`), 0) FROM `points`", []string{"id"}, []driver.Value{lastPointID})
+	testRecordDriver.setRows("FROM `deleted_id_marks`", []string{"id"}, []driver.Value{lastDeletedPointID})
+	testRecordDriver.setRows("MAX(`id`), 0) FROM `stroke_tombstones`", []string{"id"}, []driver.Value{int64(0)})
+}
+
+func newTestWriteBehind(t *testing.T, journal string) *writeBehindRoomStore {
+	prev := strokeJournalPath
+	strokeJournalPath = journal
+	defer func() { strokeJournalPath = prev }()
+
+	wb := newWriteBehindRoomStore(&cachedRoomStore{db: &mysqlRoomStore{}, repo: NewRoomRepo()})
+	if err := wb.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return wb
+}
+
+// waitPersisted はジャーナルに書いたものが全部 MySQL に書かれるまで待つ
+func waitPersisted(t *testing.T, wb *writeBehindRoomStore) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		wb.journal.mu.Lock()
+		pending := 0
+		for _, n := range wb.journal.pending {
+			pending += n
+		}
+		wb.journal.mu.Unlock()
+		if pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d journal entries are not persisted", pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestWriteBehindIDsAfterDeletedStroke は最後のストロークを消して起動し直しても、
+// 消したストロークと点の ID を使い直さないことを確かめる
+func TestWriteBehindIDsAfterDeletedStroke(t *testing.T) {
+	defer useTestDB(t)()
+	if os.Getenv("TEST_MYSQL_DSN") != "" {
+		t.Skip("uses canned rows of the recording driver")
+	}
+	dir, err := ioutil.TempDir("", "isuketch-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	setWriteBehindRows(0, 0, 0, 0)
+	wb := newTestWriteBehind(t, filepath.Join(dir, "first"))
+	for i := 0; i < 2; i++ {
+		if _, err := wb.AddStroke(1, benchStroke()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := wb.DeleteStroke(1, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	waitPersisted(t, wb)
+
+	// 消した点の ID を残してから消していることを確かめる
+	marked, deleted := -1, -1
+	testRecordDriver.mu.Lock()
+	for i, e := range testRecordDriver.execs {
+		switch {
+		case strings.HasPrefix(e.query, "INSERT INTO `deleted_id_marks`"):
+			marked = i
+		case strings.HasPrefix(e.query, "DELETE FROM `strokes`"):
+			deleted = i
+		}
+	}
+	testRecordDriver.mu.Unlock()
+	if deleted < 0 || marked < 0 || marked > deleted {
+		t.Fatalf("deleted_id_marks at %d, DELETE strokes at %d", marked, deleted)
+	}
+
+	// MySQL にはストローク 1 と点 1-3 が残り、ストローク 2 の点 4-6 は消えている
+	setWriteBehindRows(1, 2, 3, 6)
+	wb = newTestWriteBehind(t, filepath.Join(dir, "second"))
+	s, err := wb.AddStroke(1, benchStroke())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitPersisted(t, wb)
+	if s.ID != 3 {
+		t.Errorf("next stroke ID = %d, want 3", s.ID)
+	}
+	if s.Points[0].ID != 7 {
+		t.Errorf("next point ID = %d, want 7", s.Points[0].ID)
+	}
+}
+
+// TestJournalRotateRemovesPersistedSegment は全部 MySQL に書いたセグメントが
+// 切り替えたときに消えることを確かめる
+func TestJournalRotateRemovesPersistedSegment(t *testing.T) {
+	defer useTestDB(t)()
+	if os.Getenv("TEST_MYSQL_DSN") != "" {
+		t.Skip("uses canned rows of the recording driver")
+	}
+	dir, err := ioutil.TempDir("", "isuketch-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	setWriteBehindRows(0, 0, 0, 0)
+	path := filepath.Join(dir, "journal")
+	wb := newTestWriteBehind(t, path)
+	if _, err := wb.AddStroke(1, benchStroke()); err != nil {
+		t.Fatal(err)
+	}
+	waitPersisted(t, wb)
+
+	wb.journal.mu.Lock()
+	seq := wb.journal.seq
+	err = wb.journal.rotate()
+	wb.journal.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(wb.journal.segmentPath(seq)); !os.IsNotExist(err) {
+		t.Errorf("persisted segment %d is left after rotate: %v", seq, err)
+	}
+
+	// 切り替えた後に書いたものは新しいセグメントに入り、書けたら残りは今のセグメントだけになる
+	if _, err := wb.AddStroke(1, benchStroke()); err != nil {
+		t.Fatal(err)
+	}
+	waitPersisted(t, wb)
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0] != wb.journal.segmentPath(seq+1) {
+		t.Errorf("segments = %v, want only %s", matches, wb.journal.segmentPath(seq+1))
+	}
+}
+
+// TestWriteBehindReplaySkipsDeletedStroke はジャーナルに残ったストロークが MySQL で
+// 削除済みなら、起動時に書き直さないことを確かめる
+func TestWriteBehindReplaySkipsDeletedStroke(t *testing.T) {
+	defer useTestDB(t)()
+	if os.Getenv("TEST_MYSQL_DSN") != "" {
+		t.Skip("uses canned rows of the recording driver")
+	}
+	dir, err := ioutil.TempDir("", "isuketch-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// ストローク 1 を書いたセグメントが残ったまま、削除の記録を書いたセグメントは消えている
+	path := filepath.Join(dir, "journal")
+	s := benchStroke()
+	s.ID = 1
+	s.RoomID = 1
+	b, err := json.Marshal(journalEntry{Stroke: &s, AuthorTokenID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".1", append(b, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	setWriteBehindRows(0, 1, 0, 3)
+	testRecordDriver.setRows("`stroke_id` FROM `stroke_tombstones` WHERE", []string{"stroke_id"}, []driver.Value{int64(1)})
+	wb := newTestWriteBehind(t, path)
+
+	testRecordDriver.mu.Lock()
+	for _, e := range testRecordDriver.execs {
+		if strings.HasPrefix(e.query, "INSERT IGNORE INTO `strokes`") {
+			t.Errorf("deleted stroke is written again: %s", e.query)
+		}
+	}
+	testRecordDriver.mu.Unlock()
+	if _, ok := wb.repo.FindStroke(1, 1); ok {
+		t.Error("deleted stroke is back in the room")
+	}
+}
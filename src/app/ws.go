@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"goji.io/pat"
+	"golang.org/x/net/context"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// 上りのメッセージの大きさの上限は、stroke_points で maxDraftPoints 個の点を1回で送れるだけにする。
+// 点1つの JSON がこれを超えることは無い
+const wsMaxPointBytes = 128
+
+// wsMessage は WebSocket で上りも下りも使うメッセージ。
+// 下りの event は SSE と同じく stroke と図形ごとのイベント / stroke_deleted / watcher_count / layers と
+// draft.go の live イベントで、
+// 上りは stroke (data は POST /api/strokes/rooms/:id と同じ JSON) と図形の type と同じ名前のイベント、
+// 描画中の点を流す stroke_begin / stroke_points / stroke_end、
+// 削除の stroke_delete (data は {"id": ストロークID}) / stroke_undo を受け付ける。
+// draft は1接続につき1つまでで、上りでは draft_id を指定しない。
+// 下りの stroke と stroke_deleted の id は SSE と同じ形で、つなぎ直すときに last_event_id に渡す。
+type wsMessage struct {
+	Event string          `json:"event"`
+	ID    string          `json:"id,omitempty"`
+	Data  json.RawMessage `json:"data"`
+}
+
+func getAPIWSRoomsID(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	idStr := pat.Param(ctx, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		outputErrorMsg(w, http.StatusNotFound, "この部屋は存在しません。")
+		return
+	}
+
+	// ブラウザの WebSocket はヘッダを付けられないのでクエリで受け取る
+	t, err := checkToken(r.URL.Query().Get("csrf_token"))
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	if t == nil {
+		outputErrorMsg(w, http.StatusBadRequest, "トークンエラー。ページを再読み込みしてください。")
+		return
+	}
+
+	// SSE と同じ形で、stroke の id と stroke_deleted の id から作る
+	var lastStrokeID int64
+	lastTombstoneID := int64(-1)
+	if s := r.URL.Query().Get("last_event_id"); s != "" {
+		lastStrokeID, lastTombstoneID, err = parseStreamEventID(s)
+		if err != nil {
+			outputErrorMsg(w, http.StatusBadRequest, "リクエストが正しくありません。")
+			return
+		}
+	}
+
+	// 確かめた後に権限が変わったら、ループで確かめ直す
+	aclVersion, aclUserID := acl.Version(id), t.UserID()
+	room, err := store.GetRoom(id)
+	if err == nil {
+		err = checkCanView(t, room)
+	}
+	if err != nil {
+		outputAccessError(w, err)
+		return
+	}
+	missed, lastTombstoneID, err := missedTombstones(id, lastStrokeID, lastTombstoneID)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+
+	notify := hub.Subscribe(id)
+	defer hub.Unsubscribe(id, notify)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade が失敗したときはレスポンスを書き込み済み
+		log.Println("websocket upgrade:", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(int64(maxDraftPoints) * wsMaxPointBytes)
+
+	watcherCount := hub.AddWatcher(id, t.ID)
+	defer hub.RemoveWatcher(id, t.ID)
+	if err := writeWSEvent(conn, "watcher_count", "", []byte(strconv.Itoa(watcherCount))); err != nil {
+		return
+	}
+
+	// 書き込みは1goroutineからしかできないので、読んだメッセージは
+	// チャネルで渡してこの goroutine で処理する
+	received := make(chan wsMessage)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		conn.SetReadDeadline(time.Now().Add(streamHeartbeatInterval * 2))
+		conn.SetPongHandler(func(string) error {
+			conn.SetReadDeadline(time.Now().Add(streamHeartbeatInterval * 2))
+			return nil
+		})
+		for {
+			var m wsMessage
+			if err := conn.ReadJSON(&m); err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case received <- m:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	c := &wsClient{conn: conn, token: t, roomID: id}
+	defer c.cancelDraft()
+
+	liveSeq := int64(-1)
+	layerVersion := int64(-1)
+	for {
+		if v, u := acl.Version(id), t.UserID(); v != aclVersion || u != aclUserID {
+			aclVersion, aclUserID = v, u
+			if err := checkCanView(t, room); err != nil {
+				msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "access denied")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+				return
+			}
+		}
+		liveEvents, newLiveSeq := hub.GetLiveEvents(id, liveSeq)
+		liveSeq = newLiveSeq
+		tombstones, err := store.GetTombstones(id, lastTombstoneID)
+		if err != nil {
+			log.Println("websocket:", err)
+			return
+		}
+		tombstones = append(missed, tombstones...)
+		missed = nil
+		strokes, err := store.GetStrokes(id, lastStrokeID)
+		if err != nil {
+			log.Println("websocket:", err)
+			return
+		}
+		for _, s := range strokes {
+			d := s.json
+			if d == nil {
+				d, err = json.Marshal(s)
+				if err != nil {
+					panic(err)
+				}
+			}
+			lastStrokeID = s.ID
+			if err := writeWSEvent(conn, s.streamEvent(), streamEventID(lastStrokeID, lastTombstoneID), d); err != nil {
+				return
+			}
+		}
+		for _, ts := range tombstones {
+			d, _ := json.Marshal(ts)
+			if ts.ID > lastTombstoneID {
+				lastTombstoneID = ts.ID
+			}
+			if err := writeWSEvent(conn, "stroke_deleted", streamEventID(lastStrokeID, lastTombstoneID), d); err != nil {
+				return
+			}
+		}
+		for _, e := range liveEvents {
+			if err := writeWSEvent(conn, e.event, "", e.data); err != nil {
+				return
+			}
+		}
+		if v := layers.Version(id); v != layerVersion {
+			layerVersion = v
+			d, _ := json.Marshal(layers.Layers(id))
+			if err := writeWSEvent(conn, "layers", "", d); err != nil {
+				return
+			}
+		}
+
+		newWatcherCount := hub.GetWatcherCount(id)
+		if newWatcherCount != watcherCount {
+			watcherCount = newWatcherCount
+			if err := writeWSEvent(conn, "watcher_count", "", []byte(strconv.Itoa(watcherCount))); err != nil {
+				return
+			}
+		}
+
+		select {
+		case m := <-received:
+			if err := c.handleMessage(m); err != nil {
+				return
+			}
+		case <-notify:
+		case <-ticker.C:
+			hub.UpdateWatcherCount(id, t.ID)
+		case <-heartbeat.C:
+			conn.SetWriteDeadline(time.Now().Add(streamHeartbeatInterval))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-t.revoked:
+			msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token revoked")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			return
+		case err := <-readErr:
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println("websocket read:", err)
+			}
+			return
+		}
+	}
+}
+
+type wsClient struct {
+	conn    *websocket.Conn
+	token   *Token
+	roomID  int64
+	draftID int64
+}
+
+func (c *wsClient) cancelDraft() {
+	if c.draftID == 0 {
+		return
+	}
+	if _, err := hub.TakeDraft(c.roomID, c.draftID, c.token.ID); err == nil {
+		hub.CancelDraft(c.roomID, c.draftID)
+	}
+	c.draftID = 0
+}
+
+// handleMessage はクライアントのエラーを error イベントで返す。
+// 戻り値の error は接続が使えなくなったときだけ返す。
+func (c *wsClient) handleMessage(m wsMessage) error {
+	var err error
+	switch m.Event {
+	case "stroke", shapeLine, shapeRect, shapeEllipse, shapePolygon, shapeText:
+		postedStroke := Stroke{}
+		if json.Unmarshal(m.Data, &postedStroke) != nil {
+			return writeWSError(c.conn, errInvalidStroke)
+		}
+		if m.Event != "stroke" {
+			postedStroke.Type = m.Event
+		}
+		// 作成したストロークは notify 経由で他の購読者と同じように届く
+		_, err = createStroke(c.token, c.roomID, postedStroke)
+	case "stroke_begin":
+		postedStroke := Stroke{}
+		if json.Unmarshal(m.Data, &postedStroke) != nil || postedStroke.Width == 0 ||
+			!isDraftable(&postedStroke) || !layers.Exists(c.roomID, postedStroke.LayerID) {
+			return writeWSError(c.conn, errInvalidStroke)
+		}
+		c.cancelDraft()
+		var room *Room
+		room, err = store.GetRoom(c.roomID)
+		if err == nil {
+			err = checkCanDraw(c.token, room)
+		}
+		if err == nil {
+			c.draftID, err = hub.BeginDraft(c.roomID, c.token.ID, postedStroke)
+		}
+	case "stroke_points":
+		posted := struct {
+			Points []Point `json:"points"`
+		}{}
+		if json.Unmarshal(m.Data, &posted) != nil {
+			return writeWSError(c.conn, errInvalidStroke)
+		}
+		err = hub.AppendDraft(c.roomID, c.draftID, c.token.ID, posted.Points)
+	case "stroke_end":
+		draftID := c.draftID
+		c.draftID = 0
+		_, err = finishDraft(c.token, c.roomID, draftID)
+	case "stroke_delete":
+		posted := struct {
+			ID int64 `json:"id"`
+		}{}
+		if json.Unmarshal(m.Data, &posted) != nil {
+			return writeWSError(c.conn, errStrokeNotFound)
+		}
+		_, err = deleteStroke(c.token, c.roomID, posted.ID)
+	case "stroke_undo":
+		_, err = undoStroke(c.token, c.roomID)
+	default:
+		err = errInvalidStroke
+	}
+
+	switch err {
+	case nil:
+		return nil
+	case errRoomNotFound, errInvalidStroke, errFirstStrokeDeny, errDraftNotFound, errDraftTooLong,
+		errTooManyDrafts, errRoomViewDeny, errRoomDrawDeny, errRoomOwnerOnly, errStrokeNotFound, errStrokeDeleteDeny:
+		return writeWSError(c.conn, err)
+	default:
+		log.Println("websocket:", err)
+		return writeWSError(c.conn, errors.New("InternalServerError"))
+	}
+}
+
+func writeWSEvent(conn *websocket.Conn, event string, id string, data []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(streamHeartbeatInterval))
+	return conn.WriteJSON(wsMessage{Event: event, ID: id, Data: data})
+}
+
+func writeWSError(conn *websocket.Conn, err error) error {
+	d, _ := json.Marshal(err.Error())
+	return writeWSEvent(conn, "error", "", d)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestWSServer は閉じるときに WebSocket のハンドラが終わるまで待つ。
+// httptest.Server は乗っ取られた接続を待たないので、待たないと次のテストが部屋や hub を作り直すのと重なる
+func newTestWSServer(t *testing.T) (*httptest.Server, func()) {
+	var wg sync.WaitGroup
+	mux := newTestMux()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+		mux.ServeHTTP(w, r)
+	}))
+	return ts, func() {
+		ts.Close()
+		wg.Wait()
+	}
+}
+
+func dialTestWS(t *testing.T, ts *httptest.Server, tk *Token, roomID int64, lastEventID string) *websocket.Conn {
+	q := url.Values{"csrf_token": {tk.CSRFToken}}
+	if lastEventID != "" {
+		q.Set("last_event_id", lastEventID)
+	}
+	u := fmt.Sprintf("ws%s/api/ws/rooms/%d?%s", strings.TrimPrefix(ts.URL, "http"), roomID, q.Encode())
+	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readWSUntil は event が届くまで読んで、それまでに届いたイベント名と event のメッセージを返す
+func readWSUntil(t *testing.T, conn *websocket.Conn, event string) ([]string, wsMessage) {
+	events := []string{}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var m wsMessage
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatalf("waiting for %s after %v: %s", event, events, err)
+		}
+		events = append(events, m.Event)
+		if m.Event == event {
+			return events, m
+		}
+	}
+}
+
+func writeTestWS(t *testing.T, conn *websocket.Conn, event string, data interface{}) {
+	d, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(wsMessage{Event: event, Data: d}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWSStrokeDeleteAndResume は WebSocket で描いて消し、
+// 最後に受け取った id でつなぎ直すと同じものを送り直さないことを確かめる
+func TestWSStrokeDeleteAndResume(t *testing.T) {
+	ts, closeServer := newTestWSServer(t)
+	defer closeServer()
+	tk := newTestToken()
+	room := createTestRoom(t, ts, tk)
+
+	conn := dialTestWS(t, ts, tk, room.ID, "")
+	readWSUntil(t, conn, "layers")
+	writeTestWS(t, conn, "stroke", testStrokeBody())
+	_, m := readWSUntil(t, conn, "stroke")
+	var s Stroke
+	if err := json.Unmarshal(m.Data, &s); err != nil {
+		t.Fatal(err)
+	}
+	if want := streamEventID(s.ID, 0); m.ID != want {
+		t.Errorf("stroke id = %q, want %q", m.ID, want)
+	}
+
+	writeTestWS(t, conn, "stroke_delete", map[string]int64{"id": s.ID})
+	_, m = readWSUntil(t, conn, "stroke_deleted")
+	var ts1 strokeTombstone
+	if err := json.Unmarshal(m.Data, &ts1); err != nil {
+		t.Fatal(err)
+	}
+	if ts1.StrokeID != s.ID {
+		t.Errorf("deleted stroke %d, want %d", ts1.StrokeID, s.ID)
+	}
+	if want := streamEventID(s.ID, ts1.ID); m.ID != want {
+		t.Errorf("stroke_deleted id = %q, want %q", m.ID, want)
+	}
+	lastEventID := m.ID
+	conn.Close()
+
+	// つなぎ直したら、次に描かれたストロークより前には何も送り直さない
+	conn = dialTestWS(t, ts, tk, room.ID, lastEventID)
+	defer conn.Close()
+	readWSUntil(t, conn, "layers")
+	next := postTestStroke(t, ts, tk, room.ID)
+	events, m := readWSUntil(t, conn, "stroke")
+	if n := countEvents(events, "stroke_deleted"); n != 0 {
+		t.Errorf("resume with %q: %d stroke_deleted, want 0", lastEventID, n)
+	}
+	if err := json.Unmarshal(m.Data, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != next {
+		t.Errorf("resume with %q: got stroke %d, want %d", lastEventID, s.ID, next)
+	}
+}
+
+// TestWSReadLimit は上限を超える大きさのメッセージを受け取ったら接続を閉じることを確かめる
+func TestWSReadLimit(t *testing.T) {
+	ts, closeServer := newTestWSServer(t)
+	defer closeServer()
+	tk := newTestToken()
+	room := createTestRoom(t, ts, tk)
+
+	conn := dialTestWS(t, ts, tk, room.ID, "")
+	defer conn.Close()
+	readWSUntil(t, conn, "layers")
+	big := make([]byte, maxDraftPoints*wsMaxPointBytes+1)
+	for i := range big {
+		big[i] = ' '
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, big); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			t.Errorf("read after a large message: %s, want close %d", err, websocket.CloseMessageTooBig)
+		}
+		return
+	}
+}